@@ -0,0 +1,161 @@
+package xdrgateway
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/xhoms/xdrgateway/xdrclient"
+)
+
+const (
+	aggregationMaxGroups = 10000
+	aggregationTSLayout  = "2006-01-02T15:04:05.000Z07:00"
+)
+
+var (
+	defaultAggregationKeys = []string{"src", "dst", "dport", "name", "action"}
+)
+
+// alertGroup accumulates near-identical alerts received within the aggregation window
+type alertGroup struct {
+	alert  *xdrclient.Alert
+	first  int64
+	last   int64
+	count  int
+	opened time.Time
+}
+
+// aggregator folds alerts sharing the same key within a time window into a single alert. The resulting alert keeps
+// the fields of the first one and appends the occurrence count and the first/last timestamps to its description
+type aggregator struct {
+	mu        sync.Mutex
+	window    time.Duration
+	keys      []string
+	maxGroups int
+	groups    map[string]*alertGroup
+	emit      func(alert *xdrclient.Alert) error
+	ticker    *time.Ticker
+	done      chan struct{}
+	stats     *APIStats
+}
+
+func newAggregator(window time.Duration, keys []string, emit func(alert *xdrclient.Alert) error, stats *APIStats) (g *aggregator) {
+	if len(keys) == 0 {
+		keys = defaultAggregationKeys
+	}
+	tick := window / 4
+	if tick < 100*time.Millisecond {
+		tick = 100 * time.Millisecond
+	}
+	g = &aggregator{
+		window:    window,
+		keys:      keys,
+		maxGroups: aggregationMaxGroups,
+		groups:    make(map[string]*alertGroup),
+		emit:      emit,
+		ticker:    time.NewTicker(tick),
+		done:      make(chan struct{}),
+		stats:     stats,
+	}
+	go func() {
+		log.Println("starting aggregation goroutine")
+		for {
+			select {
+			case <-g.done:
+				g.ticker.Stop()
+				log.Println("ending aggregation goroutine")
+				return
+			case now := <-g.ticker.C:
+				g.expire(now, false)
+			}
+		}
+	}()
+	return
+}
+
+func (g *aggregator) key(alert *xdrclient.Alert) string {
+	values := make([]string, len(g.keys))
+	for idx, key := range g.keys {
+		values[idx] = alertField(alert, key)
+	}
+	return strings.Join(values, "\x00")
+}
+
+// add folds the alert into its group (opening a new one if needed)
+func (g *aggregator) add(alert *xdrclient.Alert) (err error) {
+	key := g.key(alert)
+	g.mu.Lock()
+	group, exists := g.groups[key]
+	if exists {
+		group.count++
+		if alert.Timestamp < group.first {
+			group.first = alert.Timestamp
+		}
+		if alert.Timestamp > group.last {
+			group.last = alert.Timestamp
+		}
+		atomic.AddUint64(&g.stats.AlertsFolded, 1)
+		g.mu.Unlock()
+		return
+	}
+	if len(g.groups) >= g.maxGroups {
+		g.mu.Unlock()
+		// too many distinct groups. Let the alert go through without aggregation
+		return g.emit(alert)
+	}
+	g.groups[key] = &alertGroup{
+		alert:  alert,
+		first:  alert.Timestamp,
+		last:   alert.Timestamp,
+		count:  1,
+		opened: time.Now(),
+	}
+	g.mu.Unlock()
+	return
+}
+
+// expire emits the groups whose window has elapsed (all of them if force is true)
+func (g *aggregator) expire(now time.Time, force bool) {
+	var expired []*alertGroup
+	g.mu.Lock()
+	for key, group := range g.groups {
+		if force || now.Sub(group.opened) >= g.window {
+			expired = append(expired, group)
+			delete(g.groups, key)
+		}
+	}
+	g.mu.Unlock()
+	for _, group := range expired {
+		alert := group.alert
+		if group.count > 1 {
+			summary := *alert
+			summary.Timestamp = group.first
+			summary.AlertDescription = fmt.Sprintf("%v;count=%v;first=%v;last=%v", alert.AlertDescription, group.count,
+				time.Unix(0, group.first*int64(time.Millisecond)).UTC().Format(aggregationTSLayout),
+				time.Unix(0, group.last*int64(time.Millisecond)).UTC().Format(aggregationTSLayout))
+			alert = &summary
+			atomic.AddUint64(&g.stats.AlertsAggregated, 1)
+		}
+		if err := g.emit(alert); err != nil {
+			log.Printf("aggregator error - aggregated alert (count=%v) not accepted: %v", group.count, err)
+		}
+	}
+}
+
+// open returns the number of groups currently open
+func (g *aggregator) open() (groups int) {
+	g.mu.Lock()
+	groups = len(g.groups)
+	g.mu.Unlock()
+	return
+}
+
+// close stops the aggregation goroutine and emits all open groups
+func (g *aggregator) close() {
+	g.done <- struct{}{}
+	g.expire(time.Now(), true)
+}
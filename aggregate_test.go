@@ -0,0 +1,110 @@
+package xdrgateway
+
+import (
+	"testing"
+	"time"
+
+	"github.com/xhoms/xdrgateway/xdrclient"
+)
+
+func aggregationTestAlert(dst string, timestamp int64) *xdrclient.Alert {
+	return &xdrclient.Alert{
+		LocalIP:          "10.0.0.1",
+		RemoteIP:         dst,
+		RemotePort:       443,
+		AlertName:        "threat",
+		AlertDescription: "misc;serial=0123456789",
+		Timestamp:        timestamp,
+	}
+}
+
+func TestAggregator(t *testing.T) {
+	for _, test := range []struct {
+		name         string
+		keys         []string
+		maxGroups    int
+		alerts       []*xdrclient.Alert
+		early        int
+		descriptions []string
+		timestamp    int64
+	}{
+		{
+			"folded", nil, 10,
+			[]*xdrclient.Alert{aggregationTestAlert("10.0.0.2", 2000), aggregationTestAlert("10.0.0.2", 1000), aggregationTestAlert("10.0.0.2", 3000)},
+			0,
+			[]string{"misc;serial=0123456789;count=3;first=1970-01-01T00:00:01.000Z;last=1970-01-01T00:00:03.000Z"},
+			1000,
+		},
+		{
+			"distinct keys", nil, 10,
+			[]*xdrclient.Alert{aggregationTestAlert("10.0.0.2", 1000), aggregationTestAlert("10.0.0.3", 1000)},
+			0,
+			[]string{"misc;serial=0123456789", "misc;serial=0123456789"},
+			1000,
+		},
+		{
+			"custom keys", []string{"name", "serial"}, 10,
+			[]*xdrclient.Alert{aggregationTestAlert("10.0.0.2", 1000), aggregationTestAlert("10.0.0.3", 2000)},
+			0,
+			[]string{"misc;serial=0123456789;count=2;first=1970-01-01T00:00:01.000Z;last=1970-01-01T00:00:02.000Z"},
+			1000,
+		},
+		{
+			"too many groups", nil, 1,
+			[]*xdrclient.Alert{aggregationTestAlert("10.0.0.2", 1000), aggregationTestAlert("10.0.0.3", 1000)},
+			1,
+			[]string{"misc;serial=0123456789", "misc;serial=0123456789"},
+			1000,
+		},
+	} {
+		var emitted []*xdrclient.Alert
+		stats := &APIStats{}
+		g := newAggregator(time.Hour, test.keys, func(alert *xdrclient.Alert) error {
+			emitted = append(emitted, alert)
+			return nil
+		}, stats)
+		g.maxGroups = test.maxGroups
+		for _, alert := range test.alerts {
+			g.add(alert)
+		}
+		if len(emitted) != test.early {
+			t.Errorf("%v: %v alerts emitted before the window", test.name, len(emitted))
+		}
+		g.close()
+		if len(emitted) != len(test.descriptions) {
+			t.Errorf("%v: %v alerts emitted", test.name, len(emitted))
+			continue
+		}
+		for idx, alert := range emitted {
+			if alert.AlertDescription != test.descriptions[idx] || alert.Timestamp != test.timestamp {
+				t.Errorf("%v: unexpected alert %+v", test.name, alert)
+			}
+		}
+		if folded := len(test.alerts) - len(emitted); stats.Snapshot().AlertsFolded != uint64(folded) {
+			t.Errorf("%v: unexpected stats %+v", test.name, stats.Snapshot())
+		}
+	}
+}
+
+func TestAggregatorWindow(t *testing.T) {
+	var emitted []*xdrclient.Alert
+	g := newAggregator(time.Hour, nil, func(alert *xdrclient.Alert) error {
+		emitted = append(emitted, alert)
+		return nil
+	}, &APIStats{})
+	defer g.close()
+	original := aggregationTestAlert("10.0.0.2", 1000)
+	g.add(original)
+	g.add(aggregationTestAlert("10.0.0.2", 1000))
+	now := time.Now()
+	if g.expire(now, false); len(emitted) != 0 || g.open() != 1 {
+		t.Errorf("group expired before the window (%v emitted)", len(emitted))
+	}
+	if g.expire(now.Add(time.Hour), false); len(emitted) != 1 || g.open() != 0 {
+		t.Errorf("group not expired after the window (%v emitted)", len(emitted))
+	}
+	// the summary is a copy of the first alert
+	if original.AlertDescription != "misc;serial=0123456789" {
+		t.Errorf("first alert modified %+v", original)
+	}
+}
@@ -2,21 +2,45 @@ package xdrgateway
 
 import (
 	"bytes"
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
+	"io"
 	"log"
+	"net"
 	"net/http"
+	"strconv"
+	"sync/atomic"
 
 	"github.com/xhoms/xdrgateway/xdrclient"
 )
 
+const (
+	// DefaultMaxPayloadSize is the largest ingestion request body accepted by default (see SetMaxPayloadSize)
+	DefaultMaxPayloadSize = 1 << 20
+	headerRequestID       = "X-Request-Id"
+)
+
+// APIError is the JSON document HandlerIngestion replies with when a request is not accepted
+type APIError struct {
+	// Code is a machine-readable error identifier (i.e. invalid_payload)
+	Code string `json:"code"`
+	// Message is a human-readable description of the error
+	Message string `json:"message"`
+	// RequestID identifies the request in the logs (taken from the X-Request-Id header if provided)
+	RequestID string `json:"request_id"`
+}
+
 // AppStats hold runtime statistics for the application
 type AppStats struct {
 	APIStats
 	xdrclient.Stats
 	PipeStats
+	// Tenants provides the statistics of each tenant in the routing table
+	Tenants map[string]*TenantStats `json:",omitempty"`
 }
 
-// APIStats provides counters for the PAN-OS facing API part
+// APIStats provides counters for the PAN-OS facing API part. They are updated atomically (use Snapshot to read them)
 type APIStats struct {
 	// ParseErrors is the number of received events that have failed to be parsed
 	ParseErrors int64
@@ -24,118 +48,442 @@ type APIStats struct {
 	EventsReceived int64
 	// PSKErrors is increased each time an event is rejected due to PSK mismatch
 	PSKErrors int64
+	// AlertsFiltered is the number of parsed alerts dropped by the filter chain
+	AlertsFiltered uint64
+	// FilterRules provides the hit counters of each filter rule
+	FilterRules []FilterRuleHits `json:",omitempty"`
+	// AlertsFolded is the number of alerts folded into another one by the aggregation stage
+	AlertsFolded uint64
+	// AlertsAggregated is the number of alerts emitted by the aggregation stage summarizing more than one alert
+	AlertsAggregated uint64
+	// AggregationGroups is the number of aggregation groups currently open
+	AggregationGroups int
+	// Parsers provides the counters of each parser
+	Parsers map[string]*ParserStats `json:",omitempty"`
+	// SyslogMessages is the number of messages received by the syslog listeners
+	SyslogMessages uint64
+	// SyslogErrors is the number of syslog connection or read errors
+	SyslogErrors uint64
+	// SyslogDenied is the number of syslog messages dropped as their source address is not allowed
+	SyslogDenied uint64
+	// ClientCertDenials provides the number of requests rejected by the client certificate authentication
+	ClientCertDenials ClientCertDenials
+	// Credentials provides the counters of each credential
+	Credentials map[string]*CredentialStats `json:",omitempty"`
+}
+
+// Snapshot returns a copy of the counters that is safe to read while the API is in use
+func (s *APIStats) Snapshot() (snapshot APIStats) {
+	snapshot = APIStats{
+		ParseErrors:       atomic.LoadInt64(&s.ParseErrors),
+		EventsReceived:    atomic.LoadInt64(&s.EventsReceived),
+		PSKErrors:         atomic.LoadInt64(&s.PSKErrors),
+		AlertsFiltered:    atomic.LoadUint64(&s.AlertsFiltered),
+		FilterRules:       s.FilterRules,
+		AlertsFolded:      atomic.LoadUint64(&s.AlertsFolded),
+		AlertsAggregated:  atomic.LoadUint64(&s.AlertsAggregated),
+		AggregationGroups: s.AggregationGroups,
+		SyslogMessages:    atomic.LoadUint64(&s.SyslogMessages),
+		SyslogErrors:      atomic.LoadUint64(&s.SyslogErrors),
+		SyslogDenied:      atomic.LoadUint64(&s.SyslogDenied),
+		ClientCertDenials: s.ClientCertDenials.Snapshot(),
+	}
+	if len(s.Parsers) > 0 {
+		snapshot.Parsers = make(map[string]*ParserStats, len(s.Parsers))
+		for name, parser := range s.Parsers {
+			parserStats := parser.Snapshot()
+			snapshot.Parsers[name] = &parserStats
+		}
+	}
+	return
 }
 
 // API provides HTTP methods to implement the PAN-OS facing ingestion API
 type API struct {
-	pipe   *alertPipe
-	parser Parser
-	stats  *APIStats
-	psk    string
-	debug  bool
+	route        *route
+	tenants      []*route
+	listeners    []*SyslogListener
+	syslogNets   []*net.IPNet
+	filter       *Filter
+	clientAuth   *ClientCertAuth
+	credentials  *Credentials
+	basicAuth    *BasicAuth
+	parser       *parserEntry
+	parsers      map[string]*parserEntry
+	syslog       *parserEntry
+	stats        *APIStats
+	psk          string
+	metricsToken string
+	maxPayload   int64
+	legacyStatus bool
+	debug        bool
 }
 
-// NewAPI creates and initializes a xdrgateway instance from values
-func NewAPI(parser Parser, xdrClient *xdrclient.Client, psk string, debug bool, pipe *AlertPipeOps) (api *API) {
+// NewAPI creates and initializes a xdrgateway instance from values. Alerts are delivered to sink (typically a
+// *xdrclient.Client) enforcing the XDR quota. Optional archive sinks get a best-effort copy of each delivered batch
+func NewAPI(parser Parser, sink Sink, psk string, debug bool, pipe *AlertPipeOps, archive ...Sink) (api *API) {
 	api = &API{
-		parser: parser,
-		pipe:   newAlertPipe(xdrClient, pipe),
-		psk:    psk,
-		debug:  debug,
-		stats:  &APIStats{},
+		parsers:    make(map[string]*parserEntry),
+		psk:        psk,
+		maxPayload: DefaultMaxPayloadSize,
+		debug:      debug,
+		stats:      &APIStats{Parsers: make(map[string]*ParserStats)},
 	}
+	api.parser = api.newParserEntry(defaultParserName, parser)
+	api.route = newRoute(defaultRouteName, append([]Sink{sink}, archive...), pipe, api.stats)
 	return
 }
 
-func (a *API) httpAuth(h http.Header) bool {
-	auth := h.Get("Authorization")
-	if auth == a.psk {
-		return true
-	}
-	a.stats.PSKErrors++
-	return false
+// SetMaxPayloadSize changes the largest request body (in bytes) accepted by HandlerIngestion (defaults to
+// DefaultMaxPayloadSize). Larger requests are rejected with 413
+func (a *API) SetMaxPayloadSize(size int64) {
+	a.maxPayload = size
+}
+
+// SetLegacyStatus makes HandlerIngestion reply 200 OK to every request like previous versions did (the APIError
+// document still describes the failure). Meant for PAN-OS versions that retry aggressively on non-2xx responses
+func (a *API) SetLegacyStatus(enabled bool) {
+	a.legacyStatus = enabled
+}
+
+// SetFilter installs a filter chain evaluated against each parsed alert before it enters the pipe
+func (a *API) SetFilter(filter *Filter) {
+	a.filter = filter
 }
 
 // Close attempts to gracefully shutdown the pipeline goroutines
 func (a *API) Close() {
-	a.pipe.stats = a.pipe.close()
+	for _, l := range a.listeners {
+		l.Close()
+	}
+	for _, r := range a.tenants {
+		r.close()
+	}
+	a.route.close()
 }
 
 // Ingest attempts to parse the provide payload and, if successful, ingests the resulting alert into the pipe
+// (through the aggregation stage if enabled). ErrPipeFull or ErrPipeClosed are returned if the pipe did not accept the alert.
+// Alerts are routed to tenants by serial number only (use HandlerIngestion for token and address routing)
 func (a *API) Ingest(payload []byte) (err error) {
+	return a.ingest(a.parser, payload, &origin{})
+}
+
+func (a *API) ingest(parser *parserEntry, payload []byte, src *origin) (err error) {
 	var alert *xdrclient.Alert
-	if alert, err = a.parser.Parse(payload); err == nil {
-		a.pipe.ingest(alert)
-		a.stats.EventsReceived++
+	atomic.AddInt64(&parser.stats.EventsReceived, 1)
+	if src.credential != nil {
+		atomic.AddUint64(&src.credential.stats.EventsReceived, 1)
+	}
+	if alert, err = parser.parser.Parse(payload); err == nil {
+		if err = a.authorize(alert, src); err != nil {
+			return
+		}
+		if a.filter != nil && !a.filter.Pass(alert) {
+			atomic.AddUint64(&a.stats.AlertsFiltered, 1)
+			atomic.AddInt64(&a.stats.EventsReceived, 1)
+			if a.debug {
+				log.Println("api - alert dropped by filter")
+			}
+			return
+		}
+		err = a.selectRoute(alert, src).ingest(alert)
+		atomic.AddInt64(&a.stats.EventsReceived, 1)
 	} else {
-		a.stats.ParseErrors++
+		atomic.AddInt64(&a.stats.ParseErrors, 1)
+		atomic.AddInt64(&parser.stats.ParseErrors, 1)
 	}
 	return
 }
 
 // HandlerIngestion http.HandleFunc compatible handler for PAN-OS alert ingestion
-// only POST method supported
+// only POST method supported. The last segment of a `/{prefix}/{name}` path selects a registered parser.
+// Rejected requests get an APIError document along with the status code: 400 (unparseable payload), 401 (invalid
+// PSK), 404 (unknown parser), 405 (non POST request), 413 (payload too large), 429 (pipe full) or 503 (pipe closed)
 func (a *API) HandlerIngestion(w http.ResponseWriter, r *http.Request) {
+	requestID := r.Header.Get(headerRequestID)
+	if requestID == "" {
+		requestID = newRequestID()
+	}
+	w.Header().Set(headerRequestID, requestID)
 	buff := new(bytes.Buffer)
-	if _, err := buff.ReadFrom(r.Body); err == nil {
-		if err = r.Body.Close(); err == nil {
-			a.stats.EventsReceived++
-			if a.httpAuth(r.Header) {
-				if r.Method == http.MethodPost {
-					if err = a.Ingest(buff.Bytes()); err == nil {
-						if a.debug {
-							log.Println("api - sucessfully parsed alert")
-						}
-					} else {
-						log.Println("api error - unparseable payload")
-					}
-				} else {
-					log.Println("api error - non POST request")
-				}
-			} else {
-				log.Println("api error - invalid PSK")
-			}
-		} else {
-			log.Println("api error -", err)
+	_, err := buff.ReadFrom(io.LimitReader(r.Body, a.maxPayload+1))
+	if cerr := r.Body.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		log.Printf("api error - %v (request %v)", err, requestID)
+		a.ingestionError(w, requestID, http.StatusBadRequest, "invalid_request", err.Error())
+		return
+	}
+	atomic.AddInt64(&a.stats.EventsReceived, 1)
+	src, denial := a.httpAuth(r)
+	if denial != "" {
+		log.Printf("api error - request not authenticated: %v (request %v)", denial, requestID)
+		a.ingestionError(w, requestID, http.StatusUnauthorized, denial, denialMessages[denial])
+		return
+	}
+	parser := a.parserByPath(r.URL.Path)
+	if parser == nil {
+		log.Printf("api error - unknown parser %v (request %v)", r.URL.Path, requestID)
+		a.ingestionError(w, requestID, http.StatusNotFound, "unknown_parser", "unknown parser")
+		return
+	}
+	if r.Method != http.MethodPost {
+		log.Printf("api error - non POST request (request %v)", requestID)
+		w.Header().Set("Allow", http.MethodPost)
+		a.ingestionError(w, requestID, http.StatusMethodNotAllowed, "method_not_allowed", "only POST is supported")
+		return
+	}
+	if r.ContentLength > a.maxPayload || int64(buff.Len()) > a.maxPayload {
+		log.Printf("api error - payload too large (request %v)", requestID)
+		a.ingestionError(w, requestID, http.StatusRequestEntityTooLarge, "payload_too_large", "payload too large")
+		return
+	}
+	switch err = a.ingest(parser, buff.Bytes(), src); err {
+	case nil:
+		if a.debug {
+			log.Println("api - sucessfully parsed alert")
 		}
-	} else {
-		log.Println("api error -", err)
+	case ErrPipeFull:
+		log.Printf("api error - alert not accepted (request %v): %v", requestID, err)
+		a.ingestionError(w, requestID, http.StatusTooManyRequests, "pipe_full", err.Error())
+		return
+	case ErrPipeClosed:
+		log.Printf("api error - alert not accepted (request %v): %v", requestID, err)
+		a.ingestionError(w, requestID, http.StatusServiceUnavailable, "pipe_closed", err.Error())
+		return
+	case ErrSerialMismatch:
+		log.Printf("api error - alert not accepted (request %v): %v (identity %v)", requestID, err, src.identity)
+		a.ingestionError(w, requestID, http.StatusForbidden, denialSerialMismatch, err.Error())
+		return
+	case ErrSerialNotAllowed:
+		log.Printf("api error - alert not accepted (request %v): %v (credential %v)", requestID, err, src.credential.name)
+		a.ingestionError(w, requestID, http.StatusForbidden, denialSerialNotAllowed, err.Error())
+		return
+	default:
+		log.Printf("api error - unparseable payload (request %v): %v", requestID, err)
+		a.ingestionError(w, requestID, http.StatusBadRequest, "invalid_payload", err.Error())
+		return
 	}
 	w.Write(nil)
 	return
 }
 
-// HandlerHint http.HandleFunc compatible handler that dumps the parser layout hint
+// ingestionError replies with the APIError document (always 200 OK in legacy mode)
+func (a *API) ingestionError(w http.ResponseWriter, requestID string, status int, code, message string) {
+	if a.legacyStatus {
+		status = http.StatusOK
+	}
+	jdata, _ := json.Marshal(&APIError{Code: code, Message: message, RequestID: requestID})
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(append(jdata, '\n'))
+}
+
+// newRequestID returns a random identifier for requests that do not provide one
+func newRequestID() string {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return "unknown"
+	}
+	return hex.EncodeToString(id)
+}
+
+// HandlerHint http.HandleFunc compatible handler that dumps the parser layout hint followed by the authentication
+// fields to fill in the PAN-OS HTTP server profile. The last segment of a `/{prefix}/{name}` path selects a registered
+// parser
 func (a *API) HandlerHint(w http.ResponseWriter, r *http.Request) {
+	parser := a.requestParser(w, r)
+	if parser == nil {
+		return
+	}
 	buff := new(bytes.Buffer)
 	if _, err := buff.ReadFrom(r.Body); err == nil {
 		r.Body.Close()
 	}
 	var response []byte
-	if a.httpAuth(r.Header) {
-		response = a.parser.DumpPayloadLayout()
+	if _, denial := a.httpAuth(r); denial == "" {
+		response = append(parser.parser.DumpPayloadLayout(), a.authHint()...)
 	}
 	w.Write(response)
 	return
 }
 
-// HandlerStats http.HandleFunc compatible handler that dumps runtime statistics
+// authHint describes the PAN-OS HTTP server profile fields to fill in for the enabled authentication modes
+func (a *API) authHint() []byte {
+	hint := new(bytes.Buffer)
+	hint.WriteString("\n--- PAN-OS HTTP server profile authentication ---\n")
+	if a.clientAuth != nil {
+		hint.WriteString("Servers (HTTPS): firewall client certificate issued by the trusted CA bundle")
+		if !a.clientAuth.Required {
+			hint.WriteString(" (or any of the following)")
+		}
+		hint.WriteString("\n")
+		if a.clientAuth.Required {
+			return hint.Bytes()
+		}
+	}
+	if a.basicAuth != nil {
+		hint.WriteString("Servers > Username and Password: a user of the Basic authentication list\n")
+	}
+	tenantTokens := false
+	for _, r := range a.tenants {
+		tenantTokens = tenantTokens || len(r.tokens) > 0
+	}
+	if a.credentials != nil || tenantTokens {
+		hint.WriteString("Payload Format > Headers: Authorization = the device or tenant token\n")
+	}
+	if a.psk != "" {
+		hint.WriteString("Payload Format > Headers: Authorization = the PSK\n")
+	} else {
+		hint.WriteString("None required (no PSK configured)\n")
+	}
+	return hint.Bytes()
+}
+
+// HandlerStats http.HandleFunc compatible handler that dumps runtime statistics (PSK only)
 func (a *API) HandlerStats(w http.ResponseWriter, r *http.Request) {
 	buff := new(bytes.Buffer)
 	if _, err := buff.ReadFrom(r.Body); err == nil {
 		r.Body.Close()
 	}
 	var response []byte
-	if a.httpAuth(r.Header) {
-		stats := &AppStats{
-			APIStats:  *a.stats,
-			Stats:     *a.pipe.client.Stats,
-			PipeStats: *a.pipe.stats,
-		}
-		if jdata, err := json.MarshalIndent(stats, "", "  "); err == nil {
+	if src, denial := a.httpAuth(r); denial == "" && src.admin {
+		if jdata, err := json.MarshalIndent(a.Stats(), "", "  "); err == nil {
 			response = jdata
 		}
 	}
 	w.Write(response)
 	return
 }
+
+// Stats returns a snapshot of the runtime statistics. It is safe to call while alerts are being ingested (each
+// counter is read atomically)
+func (a *API) Stats() (stats *AppStats) {
+	main := a.route.tenantStats()
+	stats = &AppStats{
+		APIStats:  a.stats.Snapshot(),
+		Stats:     main.Stats,
+		PipeStats: main.PipeStats,
+	}
+	if a.credentials != nil {
+		stats.Credentials = a.credentials.Snapshot()
+	}
+	if a.filter != nil {
+		stats.FilterRules = a.filter.Hits()
+	}
+	for _, route := range append([]*route{a.route}, a.tenants...) {
+		if route.aggregator != nil {
+			stats.AggregationGroups += route.aggregator.open()
+		}
+	}
+	if len(a.tenants) > 0 {
+		stats.Tenants = make(map[string]*TenantStats, len(a.tenants))
+		for _, route := range a.tenants {
+			stats.Tenants[route.name] = route.tenantStats()
+		}
+	}
+	return
+}
+
+// HandlerDeadLetter http.HandleFunc compatible handler to manage the alerts held in the dead-letter store
+//
+// - GET lists the dead letters (up to the `limit` query parameter, defaults to 100) or inspects the one provided in the `id` query parameter
+//
+// - DELETE purges the dead letters provided in the `id` query parameters (all of them if none is provided)
+//
+// - POST re-injects into the pipe the dead letters provided in the `id` query parameters (all of them if none is provided)
+//
+// The `tenant` query parameter selects the tenant pipe (defaults to the main one). Only the PSK is accepted
+func (a *API) HandlerDeadLetter(w http.ResponseWriter, r *http.Request) {
+	buff := new(bytes.Buffer)
+	if _, err := buff.ReadFrom(r.Body); err == nil {
+		r.Body.Close()
+	}
+	src, denial := a.httpAuth(r)
+	if denial != "" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	if !src.admin {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	tenant := a.routeByName(r.URL.Query().Get("tenant"))
+	if tenant == nil {
+		http.Error(w, "unknown tenant", http.StatusNotFound)
+		return
+	}
+	pipe := tenant.pipe
+	store := pipe.deadLetters
+	if store == nil {
+		http.Error(w, "dead-letter store not enabled", http.StatusNotFound)
+		return
+	}
+	var ids map[string]bool
+	if values, exists := r.URL.Query()["id"]; exists {
+		ids = make(map[string]bool, len(values))
+		for _, id := range values {
+			ids[id] = true
+		}
+	}
+	var response interface{}
+	switch r.Method {
+	case http.MethodGet:
+		if id := r.URL.Query().Get("id"); id != "" {
+			letter := store.get(id)
+			if letter == nil {
+				http.Error(w, "dead letter not found", http.StatusNotFound)
+				return
+			}
+			response = letter
+		} else {
+			limit := deadLetterListSize
+			if intval, err := strconv.Atoi(r.URL.Query().Get("limit")); err == nil {
+				limit = intval
+			}
+			response = store.list(limit)
+		}
+	case http.MethodDelete:
+		purged, err := store.purge(ids)
+		if err != nil {
+			log.Println("deadletter error -", err)
+		}
+		response = map[string]int64{"Purged": purged}
+	case http.MethodPost:
+		response = map[string]int64{"Reinjected": reinject(pipe, ids)}
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if jdata, err := json.MarshalIndent(response, "", "  "); err == nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(jdata)
+	}
+	return
+}
+
+// reinject pushes dead letters back into the pipe and removes from the store the ones that were accepted
+func reinject(pipe *alertPipe, ids map[string]bool) (reinjected int64) {
+	store := pipe.deadLetters
+	accepted := make(map[string]bool)
+	for _, letter := range store.list(0) {
+		if ids != nil && !ids[letter.ID] {
+			continue
+		}
+		if err := pipe.ingest(letter.Alert); err != nil {
+			break
+		}
+		accepted[letter.ID] = true
+	}
+	if len(accepted) > 0 {
+		var err error
+		if reinjected, err = store.purge(accepted); err != nil {
+			log.Println("deadletter error -", err)
+		}
+		atomic.AddUint64(&pipe.stats.DeadLetterReinjected, uint64(reinjected))
+		log.Printf("api - %v dead letters re-injected into the pipe", reinjected)
+	}
+	return
+}
@@ -0,0 +1,165 @@
+package xdrgateway
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/xhoms/xdrgateway/xdrclient"
+)
+
+// discardSink accepts and drops all batches
+type discardSink struct{}
+
+func (discardSink) SendMulti(alerts []*xdrclient.Alert) error {
+	return nil
+}
+
+func newTestAPI() (api *API) {
+	ops, _ := NewPipeOpsFromEnv()
+	ops.T1 = 1
+	ops.XDRMQuotaSize = 100000
+	ops.AlertBufferSize = 1 << 20
+	ops.ShutdownTimeout = 0
+	api = NewAPI(NewBasicParser(0, false), discardSink{}, "psk", false, ops)
+	return
+}
+
+// TestAPIConcurrentStats ingests alerts from many goroutines while reading the statistics (run with -race) and
+// checks that no counter update is lost
+func TestAPIConcurrentStats(t *testing.T) {
+	api := newTestAPI()
+	const workers, events = 8, 250
+	var wg sync.WaitGroup
+	done := make(chan struct{})
+	readers := new(sync.WaitGroup)
+	for reader := 0; reader < 2; reader++ {
+		readers.Add(1)
+		go func() {
+			defer readers.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				request := httptest.NewRequest(http.MethodGet, "/stats", nil)
+				request.Header.Set("Authorization", "psk")
+				api.HandlerStats(httptest.NewRecorder(), request)
+			}
+		}()
+	}
+	for worker := 0; worker < workers; worker++ {
+		wg.Add(1)
+		go func(worker int) {
+			defer wg.Done()
+			for n := 0; n < events; n++ {
+				payload := basicTestEvent(worker*events + n)
+				if n%10 == 0 {
+					payload = []byte("not a json payload")
+				}
+				request := httptest.NewRequest(http.MethodPost, "/in", bytes.NewReader(payload))
+				request.Header.Set("Authorization", "psk")
+				api.HandlerIngestion(httptest.NewRecorder(), request)
+			}
+		}(worker)
+	}
+	wg.Wait()
+	close(done)
+	readers.Wait()
+	stats := api.Stats()
+	api.Close()
+	total := int64(workers * events)
+	parseErrors := int64(workers * events / 10)
+	if parser := stats.Parsers[defaultParserName]; parser.EventsReceived != total || parser.ParseErrors != parseErrors {
+		t.Errorf("unexpected parser stats %+v", *parser)
+	}
+	if stats.ParseErrors != parseErrors {
+		t.Errorf("unexpected parse errors %v (want %v)", stats.ParseErrors, parseErrors)
+	}
+	if stats.PipeIn+stats.PipeInErr != uint64(total-parseErrors) {
+		t.Errorf("unexpected pipe stats in=%v err=%v (want %v)", stats.PipeIn, stats.PipeInErr, total-parseErrors)
+	}
+}
+
+func BenchmarkAPIIngestionParallel(b *testing.B) {
+	api := newTestAPI()
+	defer api.Close()
+	payload := basicTestEvent(1)
+	b.ReportAllocs()
+	b.SetBytes(int64(len(payload)))
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			request := httptest.NewRequest(http.MethodPost, "/in", bytes.NewReader(payload))
+			request.Header.Set("Authorization", "psk")
+			api.HandlerIngestion(httptest.NewRecorder(), request)
+		}
+	})
+}
+
+func TestHandlerIngestionStatus(t *testing.T) {
+	api := newTestAPI()
+	defer api.Close()
+	api.SetMaxPayloadSize(2048)
+	for _, test := range []struct {
+		name, method, path, psk string
+		payload                 []byte
+		status                  int
+		legacy                  int
+		code                    string
+	}{
+		{"accepted", http.MethodPost, "/in", "psk", basicTestEvent(1), http.StatusOK, http.StatusOK, ""},
+		{"invalid psk", http.MethodPost, "/in", "wrong", basicTestEvent(1), http.StatusUnauthorized, http.StatusOK, "invalid_psk"},
+		{"non post", http.MethodGet, "/in", "psk", nil, http.StatusMethodNotAllowed, http.StatusOK, "method_not_allowed"},
+		{"unparseable", http.MethodPost, "/in", "psk", []byte("not a payload"), http.StatusBadRequest, http.StatusOK, "invalid_payload"},
+		{"too large", http.MethodPost, "/in", "psk", bytes.Repeat([]byte("x"), 4096), http.StatusRequestEntityTooLarge, http.StatusOK, "payload_too_large"},
+		{"unknown parser", http.MethodPost, "/in/nope", "psk", basicTestEvent(1), http.StatusNotFound, http.StatusOK, "unknown_parser"},
+		{"unknown parser not authenticated", http.MethodPost, "/in/nope", "wrong", basicTestEvent(1), http.StatusUnauthorized, http.StatusOK, "invalid_psk"},
+		{"too large not authenticated", http.MethodPost, "/in", "wrong", bytes.Repeat([]byte("x"), 4096), http.StatusUnauthorized, http.StatusOK, "invalid_psk"},
+	} {
+		for _, legacy := range []bool{false, true} {
+			api.SetLegacyStatus(legacy)
+			request := httptest.NewRequest(test.method, test.path, bytes.NewReader(test.payload))
+			request.Header.Set("Authorization", test.psk)
+			request.Header.Set("X-Request-Id", "req-1")
+			recorder := httptest.NewRecorder()
+			api.HandlerIngestion(recorder, request)
+			want := test.status
+			if legacy {
+				want = test.legacy
+			}
+			if recorder.Code != want {
+				t.Errorf("%v (legacy %v): unexpected status %v (want %v)", test.name, legacy, recorder.Code, want)
+			}
+			if recorder.Header().Get("X-Request-Id") != "req-1" {
+				t.Errorf("%v: missing request ID header", test.name)
+			}
+			if test.code == "" {
+				continue
+			}
+			apiErr := &APIError{}
+			if err := json.Unmarshal(recorder.Body.Bytes(), apiErr); err != nil {
+				t.Errorf("%v: invalid error document: %v", test.name, err)
+			} else if apiErr.Code != test.code || apiErr.RequestID != "req-1" || apiErr.Message == "" {
+				t.Errorf("%v: unexpected error document %+v", test.name, apiErr)
+			}
+		}
+	}
+	// retryable errors are also reported as 200 OK in legacy mode
+	closed := newTestAPI()
+	closed.Close()
+	for legacy, want := range map[bool]int{false: http.StatusServiceUnavailable, true: http.StatusOK} {
+		closed.SetLegacyStatus(legacy)
+		request := httptest.NewRequest(http.MethodPost, "/in", bytes.NewReader(basicTestEvent(1)))
+		request.Header.Set("Authorization", "psk")
+		recorder := httptest.NewRecorder()
+		closed.HandlerIngestion(recorder, request)
+		if recorder.Code != want || !strings.Contains(recorder.Body.String(), "pipe_closed") {
+			t.Errorf("closed pipe (legacy %v): unexpected status %v (%v)", legacy, recorder.Code, recorder.Body.String())
+		}
+	}
+}
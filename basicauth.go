@@ -0,0 +1,175 @@
+package xdrgateway
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	denialInvalidCredentials = "invalid_credentials"
+)
+
+var (
+	errUnsupportedHash = errors.New("unsupported password hash (bcrypt or argon2 PHC string expected)")
+)
+
+// BasicAuth checks HTTP Basic authentication credentials (the Username and Password fields of the PAN-OS HTTP server
+// profile) against a list of users with bcrypt or argon2 hashed passwords. Successful verifications are remembered (as
+// an HMAC with a random per-process key) so the hash is not computed again for each alert
+type BasicAuth struct {
+	users    map[string]string
+	dummy    []byte
+	key      []byte
+	mu       sync.RWMutex
+	verified map[string][sha256.Size]byte
+}
+
+// NewBasicAuth validates the password hashes of users (user name to hash). Supported hashes are bcrypt ($2a$, $2b$
+// and $2y$, i.e. `htpasswd -nbB`) and argon2 PHC strings ($argon2id$v=19$m=65536,t=3,p=4$salt$hash)
+func NewBasicAuth(users map[string]string) (b *BasicAuth, err error) {
+	for user, hash := range users {
+		if user == "" || strings.Contains(user, ":") {
+			return nil, fmt.Errorf("invalid user name %q", user)
+		}
+		if strings.HasPrefix(hash, "$argon2") {
+			_, _, _, err = parseArgon2(hash)
+		} else {
+			_, err = bcrypt.Cost([]byte(hash))
+		}
+		if err != nil {
+			return nil, fmt.Errorf("user %v: %v", user, err)
+		}
+	}
+	b = &BasicAuth{
+		users:    users,
+		key:      make([]byte, sha256.Size),
+		verified: make(map[string][sha256.Size]byte),
+	}
+	if _, err = rand.Read(b.key); err != nil {
+		return nil, err
+	}
+	// unknown users are checked against a hash of a random password so they take as long as the known ones
+	password := make([]byte, 16)
+	if _, err = rand.Read(password); err == nil {
+		b.dummy, err = bcrypt.GenerateFromPassword(password, bcrypt.DefaultCost)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return
+}
+
+// NewBasicAuthFromFile loads the users from a JSON file. Example:
+//
+//	{
+//		"madrid": "$2y$10$Hk6Z0t0pX5m9c3VqkJpQk.8mC2YQk5j8m3J1a6p9v3w5q0cS1n2u6",
+//		"paris": "$argon2id$v=19$m=65536,t=3,p=4$c2FsdHNhbHQ$0nVq...Jw"
+//	}
+func NewBasicAuthFromFile(path string) (b *BasicAuth, err error) {
+	var data []byte
+	if data, err = ioutil.ReadFile(path); err != nil {
+		return
+	}
+	var users map[string]string
+	if err = json.Unmarshal(data, &users); err != nil {
+		return
+	}
+	return NewBasicAuth(users)
+}
+
+// verify returns true if the password matches the hash of the user
+func (b *BasicAuth) verify(user, password string) (valid bool) {
+	hash, exists := b.users[user]
+	if !exists {
+		bcrypt.CompareHashAndPassword(b.dummy, []byte(password))
+		return false
+	}
+	var digest [sha256.Size]byte
+	mac := hmac.New(sha256.New, b.key)
+	mac.Write([]byte(user + ":" + password))
+	copy(digest[:], mac.Sum(nil))
+	b.mu.RLock()
+	last, cached := b.verified[user]
+	b.mu.RUnlock()
+	if cached && subtle.ConstantTimeCompare(last[:], digest[:]) == 1 {
+		return true
+	}
+	if strings.HasPrefix(hash, "$argon2") {
+		valid = verifyArgon2(hash, password)
+	} else {
+		valid = bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+	}
+	if valid {
+		b.mu.Lock()
+		b.verified[user] = digest
+		b.mu.Unlock()
+	}
+	return
+}
+
+// argon2Params are the parameters of an argon2 PHC string
+type argon2Params struct {
+	variant string
+	memory  uint32
+	time    uint32
+	threads uint8
+}
+
+// parseArgon2 decodes a $argon2id$v=19$m=65536,t=3,p=4$salt$hash string
+func parseArgon2(encoded string) (params argon2Params, salt, key []byte, err error) {
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 6 || (parts[1] != "argon2id" && parts[1] != "argon2i") {
+		err = errUnsupportedHash
+		return
+	}
+	params.variant = parts[1]
+	var version int
+	if _, err = fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		err = fmt.Errorf("unsupported argon2 version %v", parts[2])
+		return
+	}
+	if _, err = fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &params.memory, &params.time, &params.threads); err != nil {
+		err = fmt.Errorf("invalid argon2 parameters %v", parts[3])
+		return
+	}
+	if salt, err = base64.RawStdEncoding.DecodeString(parts[4]); err != nil {
+		return
+	}
+	if key, err = base64.RawStdEncoding.DecodeString(parts[5]); err == nil && len(key) == 0 {
+		err = errUnsupportedHash
+	}
+	return
+}
+
+// verifyArgon2 returns true if the password matches the argon2 PHC string
+func verifyArgon2(encoded, password string) bool {
+	params, salt, key, err := parseArgon2(encoded)
+	if err != nil {
+		return false
+	}
+	var derived []byte
+	if params.variant == "argon2id" {
+		derived = argon2.IDKey([]byte(password), salt, params.time, params.memory, params.threads, uint32(len(key)))
+	} else {
+		derived = argon2.Key([]byte(password), salt, params.time, params.memory, params.threads, uint32(len(key)))
+	}
+	return subtle.ConstantTimeCompare(derived, key) == 1
+}
+
+// SetBasicAuth enables HTTP Basic authentication. Requests with an `Authorization: Basic` header are checked against
+// the users list while the rest keep using the PSK (raw Authorization header value)
+func (a *API) SetBasicAuth(b *BasicAuth) {
+	a.basicAuth = b
+}
@@ -0,0 +1,111 @@
+package xdrgateway
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestBasicAuth(t *testing.T) {
+	bcryptHash, err := bcrypt.GenerateFromPassword([]byte("madrid-pass"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	salt := []byte("0123456789abcdef")
+	argon2Hash := fmt.Sprintf("$argon2id$v=%d$m=1024,t=1,p=1$%v$%v", argon2.Version, base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(argon2.IDKey([]byte("paris-pass"), salt, 1, 1024, 1, 32)))
+	for _, bad := range []map[string]string{{"madrid": "plain"}, {"madrid": "$argon2d$v=19$m=1024,t=1,p=1$c2FsdA$aGFzaA"}, {"a:b": string(bcryptHash)}} {
+		if _, err = NewBasicAuth(bad); err == nil {
+			t.Errorf("expected error for %v", bad)
+		}
+	}
+	basicAuth, err := NewBasicAuth(map[string]string{"madrid": string(bcryptHash), "paris": argon2Hash})
+	if err != nil {
+		t.Fatal(err)
+	}
+	api := newTestAPI()
+	defer api.Close()
+	api.SetBasicAuth(basicAuth)
+	for _, test := range []struct {
+		name, user, password, psk string
+		status                    int
+	}{
+		{"bcrypt user", "madrid", "madrid-pass", "", http.StatusOK},
+		{"cached bcrypt user", "madrid", "madrid-pass", "", http.StatusOK},
+		{"argon2 user", "paris", "paris-pass", "", http.StatusOK},
+		{"wrong password", "madrid", "paris-pass", "", http.StatusUnauthorized},
+		{"unknown user", "rome", "madrid-pass", "", http.StatusUnauthorized},
+		{"raw psk", "", "", "psk", http.StatusOK},
+		{"wrong psk", "", "", "madrid-pass", http.StatusUnauthorized},
+	} {
+		request := httptest.NewRequest(http.MethodPost, "/in", bytes.NewReader(basicTestEvent(1)))
+		if test.user != "" {
+			request.SetBasicAuth(test.user, test.password)
+		} else {
+			request.Header.Set("Authorization", test.psk)
+		}
+		recorder := httptest.NewRecorder()
+		api.HandlerIngestion(recorder, request)
+		if recorder.Code != test.status {
+			t.Errorf("%v: unexpected response %v %s", test.name, recorder.Code, recorder.Body.Bytes())
+		}
+	}
+	if errors := api.Stats().PSKErrors; errors != 3 {
+		t.Errorf("unexpected authentication errors %v", errors)
+	}
+	request := httptest.NewRequest(http.MethodGet, "/dump", nil)
+	request.SetBasicAuth("paris", "paris-pass")
+	recorder := httptest.NewRecorder()
+	api.HandlerHint(recorder, request)
+	for _, hint := range []string{"---annex---", "Username and Password", "Authorization = the PSK"} {
+		if !bytes.Contains(recorder.Body.Bytes(), []byte(hint)) {
+			t.Errorf("hint %q not found in %s", hint, recorder.Body.Bytes())
+		}
+	}
+}
+
+func TestBasicAuthCache(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("madrid-pass"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var instances []*BasicAuth
+	for i := 0; i < 2; i++ {
+		basicAuth, err := NewBasicAuth(map[string]string{"madrid": string(hash)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cost, err := bcrypt.Cost(basicAuth.dummy); err != nil || cost != bcrypt.DefaultCost {
+			t.Errorf("unexpected dummy hash cost %v (%v)", cost, err)
+		}
+		for _, test := range []struct {
+			user, password string
+			valid          bool
+		}{
+			{"madrid", "madrid-pass", true},
+			{"madrid", "madrid-pass", true},
+			{"madrid", "paris-pass", false},
+			{"rome", "madrid-pass", false},
+		} {
+			if valid := basicAuth.verify(test.user, test.password); valid != test.valid {
+				t.Errorf("%v:%v: unexpected result %v", test.user, test.password, valid)
+			}
+		}
+		if _, cached := basicAuth.verified["rome"]; cached || len(basicAuth.verified) != 1 {
+			t.Errorf("unexpected cache %v", basicAuth.verified)
+		}
+		instances = append(instances, basicAuth)
+	}
+	// the cache keys are not plain password digests and differ between instances
+	if plain := sha256.Sum256([]byte("madrid:madrid-pass")); instances[0].verified["madrid"] == plain ||
+		instances[0].verified["madrid"] == instances[1].verified["madrid"] {
+		t.Error("predictable cache key")
+	}
+}
@@ -0,0 +1,353 @@
+package xdrgateway
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/xhoms/xdrgateway/xdrclient"
+)
+
+var (
+	cefPayloadLayout = []byte(`CEF:0|Palo Alto Networks|PAN-OS|$sender_sw_version|$subtype|$threatid|$severity|rt=$cef-formatted-receive_time start=$cef-formatted-time_generated deviceExternalId=$serial cat=$subtype src=$src dst=$dst spt=$sport dpt=$dport act=$action cs1Label=Rule cs1=$rule request=$misc
+`)
+	leefPayloadLayout = []byte(`LEEF:2.0|Palo Alto Networks|PAN-OS|$sender_sw_version|$threatid|^|devTime=$cef-formatted-time_generated^SerialNumber=$serial^cat=$subtype^src=$src^dst=$dst^srcPort=$sport^dstPort=$dport^action=$action^RuleName=$rule^Severity=$severity^Miscellaneous=$misc
+`)
+	// extensionTSLayouts are the timestamp formats supported in CEF/LEEF time fields (besides epoch milliseconds)
+	extensionTSLayouts = []string{
+		"Jan 02 2006 15:04:05 MST",
+		"Jan 02 2006 15:04:05.000 MST",
+		"Jan 02 2006 15:04:05",
+		"Jan 02 2006 15:04:05.000",
+		"Jan 02 15:04:05",
+		"Jan 02 15:04:05.000",
+		time.RFC3339,
+		panosTSLayout,
+	}
+)
+
+// CEFParser implements xdrgateway.Parser interface for ArcSight Common Event Format (CEF) lines
+//
+// Header vendor, product, version, name and severity (0-10 or a textual level) are mapped into the alert along with
+// the extension keys src, dst, spt, dpt, act, cs1 (rule), deviceExternalId (serial), cat (type) and request or msg
+// (first description part). Alert time is taken from start, rt or end (time of reception if none is provided)
+type CEFParser struct {
+	zones *TimeZones
+	debug bool
+}
+
+// NewCEFParser returns a CEF parser with TimeZone set to `offset`-hours (negative values supported) for timestamps
+// that do not include a time zone
+func NewCEFParser(offset int, debug bool) (c *CEFParser) {
+	c = &CEFParser{
+		zones: fixedTimeZones(offset),
+		debug: debug,
+	}
+	return
+}
+
+// Parse converts a CEF line (with or without a syslog header) into a XDR Alert. Return error if parsing fails
+func (c *CEFParser) Parse(data []byte) (alert *xdrclient.Alert, err error) {
+	if c.debug {
+		log.Println("cefParser - rx:", glimpse(data))
+	}
+	data = syslogMessage(data)
+	idx := bytes.Index(data, []byte("CEF:"))
+	if idx < 0 {
+		err = fmt.Errorf("cefParser - missing CEF header")
+		return
+	}
+	// CEF:Version|Device Vendor|Device Product|Device Version|Signature ID|Name|Severity|Extension
+	header, rest := splitHeader(string(data[idx+4:]), '|', 7)
+	if len(header) < 7 {
+		err = fmt.Errorf("cefParser - incomplete CEF header")
+		return
+	}
+	ext := parseExtension(rest)
+	event := &basicParserJSON{
+		Src:        ext["src"],
+		Dst:        ext["dst"],
+		Rule:       ext["cs1"],
+		Serial:     ext["deviceExternalId"],
+		SWVersion:  header[3],
+		Subtype:    ext["cat"],
+		Misc:       firstOf(ext, "request", "msg"),
+		ThreatName: header[5],
+		Severity:   severityLevel(header[6]),
+		Action:     ext["act"],
+	}
+	if event.Sport, event.Dport, err = extensionPorts(ext["spt"], ext["dpt"]); err != nil {
+		return
+	}
+	var t time.Time
+	if t, err = extensionTime(firstOf(ext, "start", "rt", "end"), c.zones.Location(event.Serial)); err == nil {
+		alert, err = panosAlert(event, t, header[2], header[1])
+	}
+	return
+}
+
+// SetTimeZones replaces the fixed offset provided to the constructor with a time zone table (IANA zones and per
+// device overrides)
+func (c *CEFParser) SetTimeZones(zones *TimeZones) {
+	c.zones = zones
+}
+
+// DumpPayloadLayout provides the PAN-OS custom log format (threat logs) for this parser
+func (c *CEFParser) DumpPayloadLayout() []byte {
+	return cefPayloadLayout
+}
+
+// LEEFParser implements xdrgateway.Parser interface for IBM QRadar Log Event Extended Format (LEEF 1.0 and 2.0) lines
+//
+// Header vendor, product, version and event id (alert name) are mapped into the alert along with the attributes
+// src, dst, srcPort, dstPort, action, sev or Severity, RuleName, SerialNumber, cat (type) and Miscellaneous or msg
+// (first description part). Alert time is taken from devTime (time of reception if not provided)
+type LEEFParser struct {
+	zones *TimeZones
+	debug bool
+}
+
+// NewLEEFParser returns a LEEF parser with TimeZone set to `offset`-hours (negative values supported) for timestamps
+// that do not include a time zone
+func NewLEEFParser(offset int, debug bool) (l *LEEFParser) {
+	l = &LEEFParser{
+		zones: fixedTimeZones(offset),
+		debug: debug,
+	}
+	return
+}
+
+// Parse converts a LEEF line (with or without a syslog header) into a XDR Alert. Return error if parsing fails
+func (l *LEEFParser) Parse(data []byte) (alert *xdrclient.Alert, err error) {
+	if l.debug {
+		log.Println("leefParser - rx:", glimpse(data))
+	}
+	data = syslogMessage(data)
+	idx := bytes.Index(data, []byte("LEEF:"))
+	if idx < 0 {
+		err = fmt.Errorf("leefParser - missing LEEF header")
+		return
+	}
+	line := string(data[idx+5:])
+	// LEEF:Version|Vendor|Product|Version|EventID|[DelimiterCharacter|]Attributes
+	fields := 5
+	if strings.HasPrefix(line, "2.") {
+		fields = 6
+	}
+	header, rest := splitHeader(line, '|', fields)
+	if len(header) < fields {
+		err = fmt.Errorf("leefParser - incomplete LEEF header")
+		return
+	}
+	delimiter := "\t"
+	if fields == 6 && header[5] != "" {
+		if delimiter, err = leefDelimiter(header[5]); err != nil {
+			return
+		}
+	} else if !strings.Contains(rest, "\t") && strings.Contains(rest, "|") {
+		// LEEF 1.0 as produced by some PAN-OS / QRadar integrations
+		delimiter = "|"
+	}
+	attrs := make(map[string]string)
+	for _, attr := range strings.Split(rest, delimiter) {
+		if eq := strings.Index(attr, "="); eq > 0 {
+			attrs[attr[:eq]] = strings.TrimSpace(attr[eq+1:])
+		}
+	}
+	event := &basicParserJSON{
+		Src:        attrs["src"],
+		Dst:        attrs["dst"],
+		Rule:       attrs["RuleName"],
+		Serial:     attrs["SerialNumber"],
+		SWVersion:  header[3],
+		Subtype:    attrs["cat"],
+		Misc:       firstOf(attrs, "Miscellaneous", "msg"),
+		ThreatName: header[4],
+		Severity:   severityLevel(firstOf(attrs, "Severity", "sev")),
+		Action:     firstOf(attrs, "action", "act"),
+	}
+	if event.Sport, event.Dport, err = extensionPorts(attrs["srcPort"], attrs["dstPort"]); err != nil {
+		return
+	}
+	var t time.Time
+	if t, err = extensionTime(attrs["devTime"], l.zones.Location(event.Serial)); err == nil {
+		alert, err = panosAlert(event, t, header[2], header[1])
+	}
+	return
+}
+
+// SetTimeZones replaces the fixed offset provided to the constructor with a time zone table (IANA zones and per
+// device overrides)
+func (l *LEEFParser) SetTimeZones(zones *TimeZones) {
+	l.zones = zones
+}
+
+// DumpPayloadLayout provides the PAN-OS custom log format (threat logs) for this parser
+func (l *LEEFParser) DumpPayloadLayout() []byte {
+	return leefPayloadLayout
+}
+
+// glimpse returns the beginning of data for debug logging
+func glimpse(data []byte) string {
+	if len(data) > 100 {
+		return string(data[:100]) + "..."
+	}
+	return string(data)
+}
+
+// splitHeader splits the first count sep-separated fields (honouring \| and \\ escapes) from the rest of the line
+func splitHeader(line string, sep byte, count int) (header []string, rest string) {
+	field := new(strings.Builder)
+	for idx := 0; idx < len(line); idx++ {
+		switch ch := line[idx]; {
+		case ch == '\\' && idx+1 < len(line) && (line[idx+1] == sep || line[idx+1] == '\\'):
+			idx++
+			field.WriteByte(line[idx])
+		case ch == sep:
+			header = append(header, field.String())
+			field.Reset()
+			if len(header) == count {
+				rest = line[idx+1:]
+				return
+			}
+		default:
+			field.WriteByte(ch)
+		}
+	}
+	return
+}
+
+// parseExtension parses the CEF extension (space-separated key=value pairs whose values may contain spaces)
+func parseExtension(ext string) (values map[string]string) {
+	values = make(map[string]string)
+	key, value := "", new(strings.Builder)
+	store := func() {
+		if key != "" {
+			values[key] = strings.TrimRight(value.String(), " ")
+		}
+		value.Reset()
+	}
+	for idx := 0; idx < len(ext); idx++ {
+		ch := ext[idx]
+		if idx == 0 || ext[idx-1] == ' ' {
+			if next := extensionKey(ext[idx:]); next != "" {
+				store()
+				key = next
+				idx += len(next)
+				continue
+			}
+		}
+		if ch == '\\' && idx+1 < len(ext) {
+			idx++
+			switch ext[idx] {
+			case 'n':
+				value.WriteByte('\n')
+			case 'r':
+				value.WriteByte('\r')
+			default:
+				value.WriteByte(ext[idx])
+			}
+			continue
+		}
+		value.WriteByte(ch)
+	}
+	store()
+	return
+}
+
+// extensionKey returns the key if s starts with a `key=` token
+func extensionKey(s string) string {
+	for idx := 0; idx < len(s); idx++ {
+		switch ch := s[idx]; {
+		case ch == '=':
+			return s[:idx]
+		case ch >= 'a' && ch <= 'z', ch >= 'A' && ch <= 'Z', ch >= '0' && ch <= '9', ch == '_', ch == '.', ch == '[', ch == ']':
+		default:
+			return ""
+		}
+	}
+	return ""
+}
+
+// leefDelimiter decodes the LEEF 2.0 delimiter (a single character or its hex representation like x09 or 0x5E)
+func leefDelimiter(value string) (delimiter string, err error) {
+	if len(value) == 1 {
+		return value, nil
+	}
+	hex := strings.TrimPrefix(strings.TrimPrefix(strings.ToLower(value), "0"), "x")
+	var code uint64
+	if code, err = strconv.ParseUint(hex, 16, 8); err != nil {
+		err = fmt.Errorf("leefParser - invalid delimiter %v", value)
+		return
+	}
+	delimiter = string(rune(code))
+	return
+}
+
+// firstOf returns the first non-empty value of the provided keys
+func firstOf(values map[string]string, keys ...string) string {
+	for _, key := range keys {
+		if value := values[key]; value != "" {
+			return value
+		}
+	}
+	return ""
+}
+
+// severityLevel maps CEF/LEEF numeric (0 informational, 1-3 low, 4-6 medium, 7-10 high) and textual severities to
+// the PAN-OS levels used by panosAlert
+func severityLevel(value string) string {
+	if number, err := strconv.Atoi(value); err == nil {
+		switch {
+		case number >= 7:
+			return "high"
+		case number >= 4:
+			return "medium"
+		case number >= 1:
+			return "low"
+		default:
+			return "informational"
+		}
+	}
+	switch level := strings.ToLower(value); level {
+	case "very-high":
+		return "high"
+	default:
+		return level
+	}
+}
+
+func extensionPorts(sport, dport string) (src, dst int, err error) {
+	if sport != "" {
+		if src, err = strconv.Atoi(sport); err != nil {
+			return
+		}
+	}
+	if dport != "" {
+		dst, err = strconv.Atoi(dport)
+	}
+	return
+}
+
+// extensionTime parses the CEF/LEEF timestamp (epoch milliseconds or any of extensionTSLayouts)
+func extensionTime(value string, location *time.Location) (t time.Time, err error) {
+	if value == "" {
+		return time.Now(), nil
+	}
+	if ms, perr := strconv.ParseInt(value, 10, 64); perr == nil {
+		return time.Unix(0, ms*int64(time.Millisecond)), nil
+	}
+	for _, layout := range extensionTSLayouts {
+		if t, err = time.ParseInLocation(layout, value, location); err == nil {
+			if t.Year() == 0 {
+				t = t.AddDate(time.Now().In(location).Year(), 0, 0)
+			}
+			return
+		}
+	}
+	err = fmt.Errorf("unsupported timestamp %v", value)
+	return
+}
@@ -0,0 +1,113 @@
+package xdrgateway
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/xhoms/xdrgateway/xdrclient"
+)
+
+func TestSplitHeader(t *testing.T) {
+	for _, test := range []struct {
+		line   string
+		count  int
+		header []string
+		rest   string
+	}{
+		{"0|Vendor|Product|1.0|100|Name|5|src=10.0.0.1", 7, []string{"0", "Vendor", "Product", "1.0", "100", "Name", "5"}, "src=10.0.0.1"},
+		{`0|Ven\|dor|Pro\\duct|1.0|100|Na\me|5|`, 7, []string{"0", "Ven|dor", `Pro\duct`, "1.0", "100", `Na\me`, "5"}, ""},
+		{"0|Vendor|Product", 7, []string{"0", "Vendor"}, ""},
+		{"2.0|Vendor|Product|1.0|id|^|a=1|b=2", 6, []string{"2.0", "Vendor", "Product", "1.0", "id", "^"}, "a=1|b=2"},
+	} {
+		header, rest := splitHeader(test.line, '|', test.count)
+		if !reflect.DeepEqual(header, test.header) || rest != test.rest {
+			t.Errorf("%q: unexpected header %q (rest %q)", test.line, header, rest)
+		}
+	}
+}
+
+func TestParseExtension(t *testing.T) {
+	for _, test := range []struct {
+		ext    string
+		values map[string]string
+	}{
+		{"", map[string]string{}},
+		{"src=10.0.0.1 dst=10.0.0.2", map[string]string{"src": "10.0.0.1", "dst": "10.0.0.2"}},
+		{"request=http://host/a b c act=reset both ", map[string]string{"request": "http://host/a b c", "act": "reset both"}},
+		{`msg=a\=b\\c\nd cs1=rule`, map[string]string{"msg": "a=b\\c\nd", "cs1": "rule"}},
+		{"msg=x=1 y.z=2", map[string]string{"msg": "x=1", "y.z": "2"}},
+		{"noise src=10.0.0.1", map[string]string{"src": "10.0.0.1"}},
+	} {
+		if values := parseExtension(test.ext); !reflect.DeepEqual(values, test.values) {
+			t.Errorf("%q: unexpected values %q", test.ext, values)
+		}
+	}
+}
+
+func TestLEEFDelimiter(t *testing.T) {
+	for _, test := range []struct {
+		value, delimiter string
+		fails            bool
+	}{
+		{"^", "^", false},
+		{"x09", "\t", false},
+		{"0x5E", "^", false},
+		{"xZZ", "", true},
+		{"0x100", "", true},
+	} {
+		if delimiter, err := leefDelimiter(test.value); delimiter != test.delimiter || (err != nil) != test.fails {
+			t.Errorf("%q: unexpected delimiter %q (%v)", test.value, delimiter, err)
+		}
+	}
+}
+
+func TestCEFLEEFParsers(t *testing.T) {
+	cef, leef := NewCEFParser(0, false), NewLEEFParser(0, false)
+	timestamp := time.Date(2021, 7, 1, 12, 0, 0, 0, time.UTC).UnixNano() / int64(time.Millisecond)
+	expected := xdrclient.Alert{
+		Product:          "PAN-OS",
+		Vendor:           "Palo Alto Networks",
+		LocalIP:          "10.0.0.1",
+		LocalPort:        50000,
+		RemoteIP:         "192.168.0.1",
+		RemotePort:       443,
+		Timestamp:        timestamp,
+		Severity:         xdrclient.SeverityHigh,
+		AlertName:        "Test Threat",
+		AlertDescription: "www.example.com/;serial=012345678901;version=10.1.3;action=reset-both;rule=outbound;type=vulnerability",
+		Action:           xdrclient.ActionBlocked,
+	}
+	for _, test := range []struct {
+		name   string
+		parser Parser
+		data   string
+		fails  bool
+	}{
+		{"cef", cef, "CEF:0|Palo Alto Networks|PAN-OS|10.1.3|vulnerability|Test Threat|8|rt=Jul 01 2021 12:00:05 GMT start=Jul 01 2021 12:00:00 GMT deviceExternalId=012345678901 cat=vulnerability src=10.0.0.1 dst=192.168.0.1 spt=50000 dpt=443 act=reset-both cs1Label=Rule cs1=outbound request=www.example.com/", false},
+		{"cef syslog", cef, "<14>Jul  1 12:00:05 fw01 CEF:0|Palo Alto Networks|PAN-OS|10.1.3|vulnerability|Test Threat|very-high|start=1625140800000 deviceExternalId=012345678901 cat=vulnerability src=10.0.0.1 dst=192.168.0.1 spt=50000 dpt=443 act=reset-both cs1=outbound msg=www.example.com/", false},
+		{"cef missing header", cef, "LEEF:1.0|Palo Alto Networks|PAN-OS|10.1.3|Test Threat|", true},
+		{"cef incomplete header", cef, "CEF:0|Palo Alto Networks|PAN-OS|10.1.3", true},
+		{"cef invalid port", cef, "CEF:0|Palo Alto Networks|PAN-OS|10.1.3|vulnerability|Test Threat|8|spt=http", true},
+		{"cef invalid time", cef, "CEF:0|Palo Alto Networks|PAN-OS|10.1.3|vulnerability|Test Threat|8|start=yesterday", true},
+		{"leef 2.0", leef, "LEEF:2.0|Palo Alto Networks|PAN-OS|10.1.3|Test Threat|^|devTime=Jul 01 2021 12:00:00 GMT^SerialNumber=012345678901^cat=vulnerability^src=10.0.0.1^dst=192.168.0.1^srcPort=50000^dstPort=443^action=reset-both^RuleName=outbound^Severity=critical^Miscellaneous=www.example.com/", false},
+		{"leef 1.0 tab", leef, "LEEF:1.0|Palo Alto Networks|PAN-OS|10.1.3|Test Threat|devTime=2021/07/01 12:00:00\tSerialNumber=012345678901\tcat=vulnerability\tsrc=10.0.0.1\tdst=192.168.0.1\tsrcPort=50000\tdstPort=443\tact=reset-both\tRuleName=outbound\tsev=9\tmsg=www.example.com/", false},
+		{"leef 1.0 pipe", leef, "LEEF:1.0|Palo Alto Networks|PAN-OS|10.1.3|Test Threat|devTime=2021/07/01 12:00:00|SerialNumber=012345678901|cat=vulnerability|src=10.0.0.1|dst=192.168.0.1|srcPort=50000|dstPort=443|action=reset-both|RuleName=outbound|Severity=high|Miscellaneous=www.example.com/", false},
+		{"leef missing header", leef, "CEF:0|Palo Alto Networks|PAN-OS|10.1.3|vulnerability|Test Threat|8|", true},
+		{"leef incomplete header", leef, "LEEF:2.0|Palo Alto Networks|PAN-OS|10.1.3|Test Threat", true},
+		{"leef invalid delimiter", leef, "LEEF:2.0|Palo Alto Networks|PAN-OS|10.1.3|Test Threat|xZZ|src=10.0.0.1", true},
+	} {
+		alert, err := test.parser.Parse([]byte(test.data))
+		if test.fails {
+			if err == nil {
+				t.Errorf("%v: expected error, got %+v", test.name, alert)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%v: unexpected error %v", test.name, err)
+		} else if *alert != expected {
+			t.Errorf("%v: unexpected alert %+v", test.name, alert)
+		}
+	}
+}
@@ -0,0 +1,218 @@
+package xdrgateway
+
+import (
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"sync/atomic"
+
+	"github.com/xhoms/xdrgateway/xdrclient"
+)
+
+const (
+	denialInvalidPSK           = "invalid_psk"
+	denialMissingCertificate   = "missing_certificate"
+	denialUntrustedCertificate = "untrusted_certificate"
+	denialUnknownIdentity      = "unknown_identity"
+	denialSerialMismatch       = "serial_mismatch"
+)
+
+var (
+	denialMessages = map[string]string{
+		denialInvalidPSK:           "invalid PSK",
+		denialMissingCertificate:   "client certificate required",
+		denialUntrustedCertificate: "client certificate not trusted",
+		denialUnknownIdentity:      "client certificate not mapped to a device identity",
+		denialInvalidCredentials:   "invalid user name or password",
+		denialExpiredToken:         "expired token",
+		denialSourceNotAllowed:     "source address not allowed for the token",
+	}
+	// ErrSerialMismatch is returned when the serial field of the alert does not match the device identity of the
+	// client certificate (see ClientCertAuth.MatchSerial)
+	ErrSerialMismatch = errors.New("device identity does not match the alert serial")
+)
+
+// ClientCertAuth configures the authentication of firewalls by TLS client certificate (mutual TLS). The TLS server
+// must request client certificates (tls.RequestClientCert) and leave their verification to the API so denials can be
+// counted. A verified certificate authenticates the request without PSK
+type ClientCertAuth struct {
+	// CAs verifies the client certificates
+	CAs *x509.CertPool
+	// Required rejects requests without client certificate (otherwise they fall back to the PSK)
+	Required bool
+	// Identities maps certificate subject common names or serial numbers (hexadecimal) to device identities
+	// (firewall serial numbers). If empty the subject common name is the device identity
+	Identities map[string]string
+	// MatchSerial rejects alerts whose serial does not match the device identity
+	MatchSerial bool
+}
+
+// ClientCertDenials provides the number of requests rejected by the client certificate authentication for each reason
+type ClientCertDenials struct {
+	// MissingCertificate requests without client certificate (only if the certificate is required)
+	MissingCertificate uint64
+	// UntrustedCertificate requests with a client certificate that failed to be verified against the CA bundle
+	UntrustedCertificate uint64
+	// UnknownIdentity requests with a verified client certificate not found in the identities table
+	UnknownIdentity uint64
+	// SerialMismatch alerts whose serial does not match the device identity
+	SerialMismatch uint64
+}
+
+// Snapshot returns a copy of the counters that is safe to read while the API is in use
+func (d *ClientCertDenials) Snapshot() ClientCertDenials {
+	return ClientCertDenials{
+		MissingCertificate:   atomic.LoadUint64(&d.MissingCertificate),
+		UntrustedCertificate: atomic.LoadUint64(&d.UntrustedCertificate),
+		UnknownIdentity:      atomic.LoadUint64(&d.UnknownIdentity),
+		SerialMismatch:       atomic.LoadUint64(&d.SerialMismatch),
+	}
+}
+
+func (d *ClientCertDenials) count(denial string) {
+	switch denial {
+	case denialMissingCertificate:
+		atomic.AddUint64(&d.MissingCertificate, 1)
+	case denialUntrustedCertificate:
+		atomic.AddUint64(&d.UntrustedCertificate, 1)
+	case denialUnknownIdentity:
+		atomic.AddUint64(&d.UnknownIdentity, 1)
+	case denialSerialMismatch:
+		atomic.AddUint64(&d.SerialMismatch, 1)
+	}
+}
+
+// NewClientCertAuthFromFiles loads the PEM CA bundle and, optionally, the JSON identities table. Example:
+//
+//	{
+//		"fw-madrid.example.com": "012345678901",
+//		"5f3a9c2e10b7d4e8": "012345678902"
+//	}
+func NewClientCertAuthFromFiles(caFile, identitiesFile string) (c *ClientCertAuth, err error) {
+	var data []byte
+	if data, err = ioutil.ReadFile(caFile); err != nil {
+		return
+	}
+	c = &ClientCertAuth{CAs: x509.NewCertPool()}
+	if !c.CAs.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no certificates found in %v", caFile)
+	}
+	if identitiesFile != "" {
+		if data, err = ioutil.ReadFile(identitiesFile); err != nil {
+			return nil, err
+		}
+		if err = json.Unmarshal(data, &c.Identities); err != nil {
+			return nil, err
+		}
+	}
+	return
+}
+
+// identity verifies the client certificate chain and returns the device identity. denial is not empty if the
+// certificate must be rejected
+func (c *ClientCertAuth) identity(chain []*x509.Certificate) (identity, denial string) {
+	leaf := chain[0]
+	intermediates := x509.NewCertPool()
+	for _, cert := range chain[1:] {
+		intermediates.AddCert(cert)
+	}
+	if _, err := leaf.Verify(x509.VerifyOptions{
+		Roots:         c.CAs,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}); err != nil {
+		return "", denialUntrustedCertificate
+	}
+	if len(c.Identities) == 0 {
+		return leaf.Subject.CommonName, ""
+	}
+	if identity, exists := c.Identities[leaf.Subject.CommonName]; exists {
+		return identity, ""
+	}
+	if identity, exists := c.Identities[strings.ToLower(leaf.SerialNumber.Text(16))]; exists {
+		return identity, ""
+	}
+	return "", denialUnknownIdentity
+}
+
+// SetClientCertAuth enables the authentication of firewalls by TLS client certificate
+func (a *API) SetClientCertAuth(auth *ClientCertAuth) {
+	a.clientAuth = auth
+}
+
+// origin describes the source of an event, used to authorize and route its alert
+type origin struct {
+	// token is the Authorization header of the request
+	token string
+	// remote is the firewall address
+	remote net.IP
+	// identity is the device identity of a verified client certificate
+	identity string
+	// credential is the credential matching the token
+	credential *credential
+	// admin is true if the request carries the PSK. Only admin requests can use the management endpoints (statistics
+	// and dead letters) as tenant tokens, credentials, Basic users and client certificates identify firewalls
+	admin bool
+}
+
+// httpAuth authenticates the request by client certificate, HTTP Basic credentials, PSK, tenant token or credential.
+// denial is not empty if the request is rejected
+func (a *API) httpAuth(r *http.Request) (src *origin, denial string) {
+	src = &origin{token: r.Header.Get("Authorization")}
+	src.admin = tokenEqual(src.token, a.psk)
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		src.remote = net.ParseIP(host)
+	}
+	if c := a.clientAuth; c != nil {
+		if r.TLS != nil && len(r.TLS.PeerCertificates) > 0 {
+			if src.identity, denial = c.identity(r.TLS.PeerCertificates); denial != "" {
+				a.stats.ClientCertDenials.count(denial)
+			}
+			return
+		}
+		if c.Required {
+			denial = denialMissingCertificate
+			a.stats.ClientCertDenials.count(denial)
+			return
+		}
+	}
+	if a.basicAuth != nil {
+		if user, password, ok := r.BasicAuth(); ok {
+			if !a.basicAuth.verify(user, password) {
+				denial = denialInvalidCredentials
+				atomic.AddInt64(&a.stats.PSKErrors, 1)
+			}
+			return
+		}
+	}
+	if a.credentials != nil {
+		if src.credential = a.credentials.lookup(src.token); src.credential != nil {
+			if denial = src.credential.check(src.remote); denial != "" {
+				atomic.AddUint64(&src.credential.stats.AuthFailures, 1)
+				atomic.AddInt64(&a.stats.PSKErrors, 1)
+			}
+			return
+		}
+	}
+	if !src.admin && !a.tenantToken(src.token) {
+		denial = denialInvalidPSK
+		atomic.AddInt64(&a.stats.PSKErrors, 1)
+	}
+	return
+}
+
+// authorize checks the alert against the origin of the event
+func (a *API) authorize(alert *xdrclient.Alert, src *origin) (err error) {
+	if src.identity != "" && a.clientAuth.MatchSerial && alertField(alert, "serial") != src.identity {
+		a.stats.ClientCertDenials.count(denialSerialMismatch)
+		err = ErrSerialMismatch
+	} else if src.credential != nil {
+		err = src.credential.authorize(alert)
+	}
+	return
+}
@@ -0,0 +1,105 @@
+package xdrgateway
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// testCertificate creates a certificate for commonName signed by parent (self-signed if nil)
+func testCertificate(t *testing.T, commonName string, serial int64, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	if parent == nil {
+		template.IsCA, template.BasicConstraintsValid = true, true
+		template.KeyUsage = x509.KeyUsageCertSign
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, key
+}
+
+func TestClientCertAuth(t *testing.T) {
+	ca, caKey := testCertificate(t, "ca", 1, nil, nil)
+	rogueCA, rogueKey := testCertificate(t, "rogue", 1, nil, nil)
+	known, _ := testCertificate(t, "fw-1", 2, ca, caKey)
+	bySerial, _ := testCertificate(t, "fw-2", 0x5f3a, ca, caKey)
+	unknown, _ := testCertificate(t, "fw-3", 4, ca, caKey)
+	rogue, _ := testCertificate(t, "fw-1", 2, rogueCA, rogueKey)
+	auth := &ClientCertAuth{
+		CAs:         x509.NewCertPool(),
+		Required:    true,
+		Identities:  map[string]string{"fw-1": "01234567891", "5f3a": "01234567892"},
+		MatchSerial: true,
+	}
+	auth.CAs.AddCert(ca)
+	api := newTestAPI()
+	defer api.Close()
+	api.SetClientCertAuth(auth)
+	for _, test := range []struct {
+		name   string
+		cert   *x509.Certificate
+		id     int
+		status int
+		code   string
+	}{
+		{"identity by name", known, 1, http.StatusOK, ""},
+		{"identity by serial number", bySerial, 2, http.StatusOK, ""},
+		{"missing certificate", nil, 1, http.StatusUnauthorized, "missing_certificate"},
+		{"untrusted certificate", rogue, 1, http.StatusUnauthorized, "untrusted_certificate"},
+		{"unknown identity", unknown, 1, http.StatusUnauthorized, "unknown_identity"},
+		{"serial mismatch", known, 2, http.StatusForbidden, "serial_mismatch"},
+	} {
+		request := httptest.NewRequest(http.MethodPost, "/in", bytes.NewReader(basicTestEvent(test.id)))
+		request.Header.Set("Authorization", "psk")
+		if test.cert != nil {
+			request.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{test.cert}}
+		}
+		recorder := httptest.NewRecorder()
+		api.HandlerIngestion(recorder, request)
+		if recorder.Code != test.status || (test.code != "" && !bytes.Contains(recorder.Body.Bytes(), []byte(`"`+test.code+`"`))) {
+			t.Errorf("%v: unexpected response %v %s", test.name, recorder.Code, recorder.Body.Bytes())
+		}
+	}
+	want := ClientCertDenials{MissingCertificate: 1, UntrustedCertificate: 1, UnknownIdentity: 1, SerialMismatch: 1}
+	if denials := api.Stats().ClientCertDenials; denials != want {
+		t.Errorf("unexpected denials %+v", denials)
+	}
+	// without the identities table the subject common name is the identity and the PSK is the fallback
+	auth.Identities, auth.Required, auth.MatchSerial = nil, false, false
+	if identity, denial := auth.identity([]*x509.Certificate{unknown}); identity != "fw-3" || denial != "" {
+		t.Errorf("unexpected identity %v (%v)", identity, denial)
+	}
+	request := httptest.NewRequest(http.MethodPost, "/in", bytes.NewReader(basicTestEvent(1)))
+	request.Header.Set("Authorization", "psk")
+	recorder := httptest.NewRecorder()
+	api.HandlerIngestion(recorder, request)
+	if recorder.Code != http.StatusOK {
+		t.Errorf("unexpected PSK fallback response %v %s", recorder.Code, recorder.Body.Bytes())
+	}
+}
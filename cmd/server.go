@@ -1,16 +1,26 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
 	"strconv"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/xhoms/xdrgateway"
 	"github.com/xhoms/xdrgateway/xdrclient"
 )
 
+const (
+	httpShutdownTimeout = 2 * time.Second
+)
+
 var (
 	build string
 )
@@ -20,30 +30,264 @@ func main() {
 	if envport, exists := os.LookupEnv("PORT"); exists {
 		port = envport
 	}
-	offset := 0
-	if envOffset, exists := os.LookupEnv("OFFSET"); exists {
-		if intval, err := strconv.Atoi(envOffset); err == nil {
-			offset = intval
-		}
-	}
 	debug := false
 	if _, exists := os.LookupEnv("DEBUG"); exists {
 		debug = true
 	}
-	parser := xdrgateway.NewBasicParser(offset, debug)
+	zones, err := xdrgateway.NewTimeZones(os.Getenv("OFFSET"), nil)
+	if tzFile, exists := os.LookupEnv("TZ_FILE"); exists {
+		zones, err = xdrgateway.NewTimeZonesFromFile(os.Getenv("OFFSET"), tzFile)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	parserSpec := "basic:" + os.Getenv("TIMESTAMP_FIELD")
+	if mappingFile, exists := os.LookupEnv("MAPPING_FILE"); exists {
+		parserSpec = "mapping:" + mappingFile
+	}
+	parser, err := xdrgateway.NewParserFromSpec(parserSpec, zones, debug)
+	if err != nil {
+		log.Fatal(err)
+	}
 	fmt.Println("PAN-OS to Cortex XDR alert ingestion Gateway")
 	fmt.Println("--------------------------------------------")
 	fmt.Println("version:", xdrgateway.Version, build)
 	fmt.Println("  - Send PAN_OS alerts to /in using HTTP POST")
 	fmt.Println("  - The endpoint /stats provides runtime statistics")
+	fmt.Println("  - The endpoint /metrics provides runtime statistics in Prometheus format")
+	fmt.Println("  - The endpoint /deadletter lists (GET), purges (DELETE) and re-injects (POST) undeliverable alerts")
 	fmt.Println("  - Use the following payload in the HTTP Log Forwarding feature")
 	fmt.Println(string(parser.DumpPayloadLayout()))
-	client := xdrclient.NewClientFromEnv()
-	pipeOps := xdrgateway.NewPipeOpsFromEnv()
-	api := xdrgateway.NewAPI(parser, client, os.Getenv("PSK"), debug, pipeOps)
+	var parserNames []string
+	parsers := make(map[string]xdrgateway.Parser)
+	if envParsers, exists := os.LookupEnv("PARSERS"); exists {
+		for _, spec := range strings.Split(envParsers, ",") {
+			if spec = strings.TrimSpace(spec); spec == "" {
+				continue
+			}
+			name := spec
+			if idx := strings.Index(spec, "="); idx >= 0 {
+				name, spec = spec[:idx], spec[idx+1:]
+			} else if idx := strings.Index(spec, ":"); idx >= 0 {
+				name = spec[:idx]
+			}
+			p, err := xdrgateway.NewParserFromSpec(spec, zones, debug)
+			if err != nil {
+				log.Fatal(err)
+			}
+			parserNames = append(parserNames, name)
+			parsers[name] = p
+			fmt.Printf("  - Send %v alerts to /in/%v using the following payload\n", name, name)
+			fmt.Println(string(p.DumpPayloadLayout()))
+		}
+	}
+	sinkSpecs := "xdr"
+	if envSinks, exists := os.LookupEnv("SINKS"); exists {
+		sinkSpecs = envSinks
+	}
+	var sinks []xdrgateway.Sink
+	for _, spec := range strings.Split(sinkSpecs, ",") {
+		if spec = strings.TrimSpace(spec); spec == "xdr" {
+			sinks = append(sinks, xdrclient.NewClientFromEnv())
+		} else if spec != "" {
+			sink, err := xdrgateway.NewSinkFromSpec(spec)
+			if err != nil {
+				log.Fatal(err)
+			}
+			sinks = append(sinks, sink)
+		}
+	}
+	if len(sinks) == 0 {
+		log.Fatal("no sinks configured")
+	}
+	pipeOps, err := xdrgateway.NewPipeOpsFromEnv()
+	if err != nil {
+		log.Fatal(err)
+	}
+	api := xdrgateway.NewAPI(parser, sinks[0], os.Getenv("PSK"), debug, pipeOps, sinks[1:]...)
+	api.SetMetricsToken(os.Getenv("METRICS_TOKEN"))
+	if maxPayload, exists := os.LookupEnv("MAX_PAYLOAD_SIZE"); exists {
+		size, err := strconv.ParseInt(maxPayload, 10, 64)
+		if err != nil || size <= 0 {
+			log.Fatal("invalid MAX_PAYLOAD_SIZE ", maxPayload)
+		}
+		api.SetMaxPayloadSize(size)
+	}
+	if _, exists := os.LookupEnv("LEGACY_STATUS"); exists {
+		api.SetLegacyStatus(true)
+	}
+	for _, name := range parserNames {
+		if err := api.RegisterParser(name, parsers[name]); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if filterFile, exists := os.LookupEnv("FILTER_FILE"); exists {
+		filter, err := xdrgateway.NewFilterFromFile(filterFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		api.SetFilter(filter)
+		log.Printf("loaded %v filter rules from %v", len(filter.Rules), filterFile)
+	}
+	if tenantsFile, exists := os.LookupEnv("TENANTS_FILE"); exists {
+		tenants, err := xdrgateway.NewTenantsFromFile(tenantsFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		for _, tenant := range tenants {
+			if err = api.AddTenant(tenant, pipeOps); err != nil {
+				log.Fatal(err)
+			}
+		}
+	}
+	if usersFile, exists := os.LookupEnv("BASIC_AUTH_FILE"); exists {
+		basicAuth, err := xdrgateway.NewBasicAuthFromFile(usersFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		api.SetBasicAuth(basicAuth)
+		log.Println("HTTP Basic authentication users loaded from", usersFile)
+	}
+	if credentialsFile, exists := os.LookupEnv("CREDENTIALS_FILE"); exists {
+		credentials, err := xdrgateway.NewCredentialsFromFile(credentialsFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err = api.SetCredentials(credentials); err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("loaded %v credentials from %v", len(credentials.Snapshot()), credentialsFile)
+		go func() {
+			reload := make(chan os.Signal, 1)
+			signal.Notify(reload, syscall.SIGHUP)
+			for range reload {
+				if err := credentials.Reload(); err != nil {
+					log.Println("credentials error - keeping the current credentials:", err)
+				} else {
+					log.Printf("reloaded %v credentials from %v", len(credentials.Snapshot()), credentialsFile)
+				}
+			}
+		}()
+	}
+	if caFile, exists := os.LookupEnv("TLS_CLIENT_CA"); exists {
+		clientAuth, err := xdrgateway.NewClientCertAuthFromFiles(caFile, os.Getenv("TLS_CLIENT_IDENTITIES"))
+		if err != nil {
+			log.Fatal(err)
+		}
+		if _, exists := os.LookupEnv("TLS_CLIENT_REQUIRED"); exists {
+			clientAuth.Required = true
+		}
+		if _, exists := os.LookupEnv("TLS_CLIENT_MATCH_SERIAL"); exists {
+			clientAuth.MatchSerial = true
+		}
+		api.SetClientCertAuth(clientAuth)
+		log.Printf("client certificates verified against %v (%v identities)", caFile, len(clientAuth.Identities))
+	}
+	if cidrs, exists := os.LookupEnv("SYSLOG_ALLOWED_CIDRS"); exists {
+		if err = api.SetSyslogAllowedCIDRs(strings.Split(cidrs, ",")); err != nil {
+			log.Fatal(err)
+		}
+	}
+	var csvParser xdrgateway.Parser
+	for _, network := range []string{"udp", "tcp", "tls"} {
+		address, exists := os.LookupEnv("SYSLOG_" + strings.ToUpper(network))
+		if !exists {
+			continue
+		}
+		if csvParser == nil {
+			if csvParser, err = xdrgateway.NewParserFromSpec("csv:"+os.Getenv("PANOS_VERSION"), zones, debug); err != nil {
+				log.Fatal(err)
+			}
+			fmt.Println("  - Syslog listeners expect the following PAN-OS configuration")
+			fmt.Print(string(csvParser.DumpPayloadLayout()))
+		}
+		var config *tls.Config
+		if network == "tls" {
+			config = newTLSConfig(os.Getenv("SYSLOG_TLS_CERT"), os.Getenv("SYSLOG_TLS_KEY"))
+		}
+		if _, err = api.ListenSyslog(network, address, csvParser, config); err != nil {
+			log.Fatal(err)
+		}
+	}
 	http.HandleFunc("/stats", api.HandlerStats)
+	http.HandleFunc("/metrics", api.HandlerMetrics)
 	http.HandleFunc("/dump", api.HandlerHint)
+	http.HandleFunc("/dump/", api.HandlerHint)
 	http.HandleFunc("/in", api.HandlerIngestion)
-	log.Println("starting http service on port", port)
-	log.Fatal(http.ListenAndServe(":"+port, nil))
+	http.HandleFunc("/in/", api.HandlerIngestion)
+	http.HandleFunc("/deadletter", api.HandlerDeadLetter)
+	var servers []*http.Server
+	if _, exists := os.LookupEnv("DISABLE_HTTP"); !exists {
+		servers = append(servers, &http.Server{Addr: ":" + port})
+	}
+	if certFile, exists := os.LookupEnv("TLS_CERT"); exists {
+		tlsPort := "8443"
+		if envport, exists := os.LookupEnv("TLS_PORT"); exists {
+			tlsPort = envport
+		}
+		config := newTLSConfig(certFile, os.Getenv("TLS_KEY"))
+		if _, exists := os.LookupEnv("TLS_CLIENT_CA"); exists {
+			// verification is left to the API so denials are counted
+			config.ClientAuth = tls.RequestClientCert
+		}
+		servers = append(servers, &http.Server{
+			Addr:      ":" + tlsPort,
+			TLSConfig: config,
+		})
+	}
+	if len(servers) == 0 {
+		log.Fatal("plain HTTP is disabled and no TLS_CERT has been provided")
+	}
+	closed := make(chan struct{})
+	go func() {
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+		log.Println("received signal", <-signals)
+		ctx, cancel := context.WithTimeout(context.Background(), httpShutdownTimeout)
+		for _, server := range servers {
+			if err := server.Shutdown(ctx); err != nil {
+				log.Println("http service shutdown error -", err)
+			}
+		}
+		cancel()
+		api.Close()
+		close(closed)
+	}()
+	failed := make(chan error, len(servers))
+	for _, server := range servers {
+		go func(server *http.Server) {
+			var err error
+			if server.TLSConfig != nil {
+				log.Println("starting https service on", server.Addr)
+				err = server.ListenAndServeTLS("", "")
+			} else {
+				log.Println("starting http service on", server.Addr)
+				err = server.ListenAndServe()
+			}
+			if err != http.ErrServerClosed {
+				failed <- err
+			}
+		}(server)
+	}
+	select {
+	case err := <-failed:
+		log.Fatal(err)
+	case <-closed:
+	}
+	log.Println("bye")
+}
+
+// newTLSConfig returns the server TLS configuration (TLS_MIN_VERSION and TLS_CIPHERS) serving the certificate and key
+// pair, reloaded when the files change
+func newTLSConfig(certFile, keyFile string) (config *tls.Config) {
+	var err error
+	if config, err = xdrgateway.NewTLSConfig(os.Getenv("TLS_MIN_VERSION"), os.Getenv("TLS_CIPHERS")); err != nil {
+		log.Fatal(err)
+	}
+	reloader, err := xdrgateway.NewCertificateReloader(certFile, keyFile, xdrgateway.DefaultCertificateReloadInterval)
+	if err != nil {
+		log.Fatal(err)
+	}
+	config.GetCertificate = reloader.GetCertificate
+	return
 }
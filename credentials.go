@@ -0,0 +1,231 @@
+package xdrgateway
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/xhoms/xdrgateway/xdrclient"
+)
+
+const (
+	denialExpiredToken     = "expired_token"
+	denialSourceNotAllowed = "source_not_allowed"
+	denialSerialNotAllowed = "serial_not_allowed"
+)
+
+var (
+	// ErrSerialNotAllowed is returned when the serial field of the alert is not in the serials allowed for the
+	// credential used to push it
+	ErrSerialNotAllowed = errors.New("serial not allowed for the credential")
+)
+
+// Credential is a named token a firewall (or a group of them) authenticates with in the Authorization header, so a
+// leaked token can be revoked without touching the rest of the devices
+type Credential struct {
+	// Name identifies the credential in statistics and logs
+	Name string `json:"name"`
+	// Token Authorization header value
+	Token string `json:"token"`
+	// Serials firewall serial numbers allowed to use the token (any if empty)
+	Serials []string `json:"serials,omitempty"`
+	// CIDRs firewall address ranges allowed to use the token (any if empty)
+	CIDRs []string `json:"cidrs,omitempty"`
+	// Expires is the time the token stops being accepted (never if not provided)
+	Expires time.Time `json:"expires,omitempty"`
+	// Tenant routes the alerts pushed with the token to the named tenant (see Tenant)
+	Tenant string `json:"tenant,omitempty"`
+}
+
+// CredentialStats provides the counters of a credential. They are updated atomically (use Snapshot to read them)
+type CredentialStats struct {
+	// EventsReceived is the number of events pushed with the credential
+	EventsReceived uint64
+	// AuthFailures is the number of requests or alerts rejected because of the credential restrictions (expiry,
+	// source address or serial number)
+	AuthFailures uint64
+}
+
+// Snapshot returns a copy of the counters that is safe to read while the API is in use
+func (s *CredentialStats) Snapshot() CredentialStats {
+	return CredentialStats{
+		EventsReceived: atomic.LoadUint64(&s.EventsReceived),
+		AuthFailures:   atomic.LoadUint64(&s.AuthFailures),
+	}
+}
+
+// credential is a loaded Credential
+type credential struct {
+	name    string
+	token   string
+	serials map[string]bool
+	nets    []*net.IPNet
+	expires time.Time
+	tenant  string
+	stats   *CredentialStats
+}
+
+// Credentials is the set of credentials loaded from a JSON file. It can be reloaded while the API is in use
+type Credentials struct {
+	path        string
+	mu          sync.RWMutex
+	entries     []*credential
+	validTenant func(name string) bool
+}
+
+// NewCredentialsFromFile loads the credentials from a JSON file. Example:
+//
+//	[
+//		{
+//			"name": "madrid",
+//			"token": "3kV9...pQ",
+//			"serials": ["012345678901"],
+//			"cidrs": ["198.51.100.0/24"],
+//			"expires": "2022-12-31T23:59:59Z",
+//			"tenant": "acme"
+//		}
+//	]
+func NewCredentialsFromFile(path string) (c *Credentials, err error) {
+	c = &Credentials{path: path}
+	if err = c.Reload(); err != nil {
+		c = nil
+	}
+	return
+}
+
+// Reload loads the file again. The current credentials are kept if it fails. Counters of the credentials still
+// present in the file are preserved
+func (c *Credentials) Reload() (err error) {
+	var data []byte
+	if data, err = ioutil.ReadFile(c.path); err != nil {
+		return
+	}
+	var list []*Credential
+	if err = json.Unmarshal(data, &list); err != nil {
+		return
+	}
+	c.mu.RLock()
+	current := make(map[string]*CredentialStats, len(c.entries))
+	for _, entry := range c.entries {
+		current[entry.name] = entry.stats
+	}
+	validTenant := c.validTenant
+	c.mu.RUnlock()
+	entries := make([]*credential, 0, len(list))
+	names := make(map[string]bool, len(list))
+	tokens := make(map[string]bool, len(list))
+	for _, cred := range list {
+		if cred.Name == "" || names[cred.Name] {
+			return fmt.Errorf("invalid or duplicated credential name %q", cred.Name)
+		}
+		if cred.Token == "" || tokens[cred.Token] {
+			return fmt.Errorf("empty or duplicated token in credential %v", cred.Name)
+		}
+		if validTenant != nil && cred.Tenant != "" && !validTenant(cred.Tenant) {
+			return fmt.Errorf("unknown tenant %v in credential %v", cred.Tenant, cred.Name)
+		}
+		names[cred.Name], tokens[cred.Token] = true, true
+		entry := &credential{
+			name:    cred.Name,
+			token:   cred.Token,
+			serials: make(map[string]bool, len(cred.Serials)),
+			expires: cred.Expires,
+			tenant:  cred.Tenant,
+			stats:   current[cred.Name],
+		}
+		if entry.stats == nil {
+			entry.stats = &CredentialStats{}
+		}
+		for _, serial := range cred.Serials {
+			entry.serials[serial] = true
+		}
+		for _, cidr := range cred.CIDRs {
+			var ipnet *net.IPNet
+			if _, ipnet, err = net.ParseCIDR(cidr); err != nil {
+				return
+			}
+			entry.nets = append(entry.nets, ipnet)
+		}
+		entries = append(entries, entry)
+	}
+	c.mu.Lock()
+	c.entries = entries
+	c.mu.Unlock()
+	return
+}
+
+// Snapshot returns the counters of each credential
+func (c *Credentials) Snapshot() (stats map[string]*CredentialStats) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	stats = make(map[string]*CredentialStats, len(c.entries))
+	for _, entry := range c.entries {
+		snapshot := entry.stats.Snapshot()
+		stats[entry.name] = &snapshot
+	}
+	return
+}
+
+// lookup returns the credential whose token matches. All tokens are compared in constant time
+func (c *Credentials) lookup(token string) (found *credential) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	for _, entry := range c.entries {
+		if tokenEqual(token, entry.token) && found == nil {
+			found = entry
+		}
+	}
+	return
+}
+
+// check returns the denial reason if the credential can't be used from the remote address
+func (cred *credential) check(remote net.IP) (denial string) {
+	if !cred.expires.IsZero() && time.Now().After(cred.expires) {
+		return denialExpiredToken
+	}
+	if len(cred.nets) == 0 {
+		return
+	}
+	if remote != nil {
+		for _, ipnet := range cred.nets {
+			if ipnet.Contains(remote) {
+				return
+			}
+		}
+	}
+	return denialSourceNotAllowed
+}
+
+// authorize checks the alert serial against the serials allowed for the credential
+func (cred *credential) authorize(alert *xdrclient.Alert) (err error) {
+	if len(cred.serials) > 0 && !cred.serials[alertField(alert, "serial")] {
+		atomic.AddUint64(&cred.stats.AuthFailures, 1)
+		err = ErrSerialNotAllowed
+	}
+	return
+}
+
+// tokenEqual compares the tokens in constant time
+func tokenEqual(token, expected string) bool {
+	return subtle.ConstantTimeCompare([]byte(token), []byte(expected)) == 1
+}
+
+// SetCredentials enables the per-device credentials. They are accepted besides the PSK and the tenant tokens. Tenants
+// referenced by the credentials must be added before
+func (a *API) SetCredentials(c *Credentials) (err error) {
+	c.mu.Lock()
+	c.validTenant = func(name string) bool {
+		return a.routeByName(name) != nil
+	}
+	c.mu.Unlock()
+	if err = c.Reload(); err == nil {
+		a.credentials = c
+	}
+	return
+}
@@ -0,0 +1,103 @@
+package xdrgateway
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const testCredentials = `[
+	{"name": "madrid", "token": "madrid-token", "serials": ["01234567891"], "cidrs": ["192.0.2.0/24"], "tenant": "acme"},
+	{"name": "expired", "token": "expired-token", "expires": "2020-01-01T00:00:00Z"},
+	{"name": "remote", "token": "remote-token", "cidrs": ["198.51.100.0/24"]}
+]`
+
+func TestCredentials(t *testing.T) {
+	dir, err := ioutil.TempDir("", "xdrgw-credentials")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "credentials.json")
+	if err = ioutil.WriteFile(path, []byte(testCredentials), 0600); err != nil {
+		t.Fatal(err)
+	}
+	credentials, err := NewCredentialsFromFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	api := newTestAPI()
+	defer api.Close()
+	if err = api.SetCredentials(credentials); err == nil {
+		t.Fatal("expected error for the unknown tenant")
+	}
+	if err = api.AddTenant(&Tenant{Name: "acme", Sink: discardSink{}}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err = api.SetCredentials(credentials); err != nil {
+		t.Fatal(err)
+	}
+	push := func(token string, id int) *httptest.ResponseRecorder {
+		// httptest requests come from 192.0.2.1
+		request := httptest.NewRequest(http.MethodPost, "/in", bytes.NewReader(basicTestEvent(id)))
+		request.Header.Set("Authorization", token)
+		recorder := httptest.NewRecorder()
+		api.HandlerIngestion(recorder, request)
+		return recorder
+	}
+	for _, test := range []struct {
+		name, token string
+		id          int
+		status      int
+		code        string
+	}{
+		{"valid token", "madrid-token", 1, http.StatusOK, ""},
+		{"psk still valid", "psk", 2, http.StatusOK, ""},
+		{"unknown token", "nope", 1, http.StatusUnauthorized, "invalid_psk"},
+		{"expired token", "expired-token", 1, http.StatusUnauthorized, "expired_token"},
+		{"source not allowed", "remote-token", 1, http.StatusUnauthorized, "source_not_allowed"},
+		{"serial not allowed", "madrid-token", 2, http.StatusForbidden, "serial_not_allowed"},
+	} {
+		recorder := push(test.token, test.id)
+		if recorder.Code != test.status || (test.code != "" && !bytes.Contains(recorder.Body.Bytes(), []byte(`"`+test.code+`"`))) {
+			t.Errorf("%v: unexpected response %v %s", test.name, recorder.Code, recorder.Body.Bytes())
+		}
+	}
+	stats := api.Stats()
+	if madrid := stats.Credentials["madrid"]; madrid.EventsReceived != 2 || madrid.AuthFailures != 1 {
+		t.Errorf("unexpected madrid stats %+v", madrid)
+	}
+	if stats.Credentials["expired"].AuthFailures != 1 || stats.Credentials["remote"].AuthFailures != 1 {
+		t.Errorf("unexpected stats %+v", stats.Credentials)
+	}
+	if routed := stats.Tenants["acme"].EventsRouted; routed != 1 {
+		t.Errorf("unexpected alerts routed to the credential tenant %v", routed)
+	}
+	// a broken file keeps the current credentials
+	ioutil.WriteFile(path, []byte("broken"), 0600)
+	if err = credentials.Reload(); err == nil {
+		t.Error("expected error reloading a broken file")
+	}
+	if recorder := push("madrid-token", 1); recorder.Code != http.StatusOK {
+		t.Errorf("unexpected response %v after a failed reload", recorder.Code)
+	}
+	// revoking a token keeps the counters of the rest
+	ioutil.WriteFile(path, []byte(`[{"name": "madrid", "token": "madrid-rotated"}]`), 0600)
+	if err = credentials.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if recorder := push("madrid-token", 1); recorder.Code != http.StatusUnauthorized {
+		t.Errorf("unexpected response %v for a revoked token", recorder.Code)
+	}
+	if recorder := push("madrid-rotated", 2); recorder.Code != http.StatusOK {
+		t.Errorf("unexpected response %v for a rotated token", recorder.Code)
+	}
+	stats = api.Stats()
+	if len(stats.Credentials) != 1 || stats.Credentials["madrid"].EventsReceived != 4 {
+		t.Errorf("unexpected stats after reload %+v", stats.Credentials)
+	}
+}
@@ -0,0 +1,182 @@
+package xdrgateway
+
+import (
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"log"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/xhoms/xdrgateway/xdrclient"
+)
+
+const (
+	// DefaultPANOSVersion is the threat log layout used when no PAN-OS version is provided
+	DefaultPANOSVersion = "10.1"
+	panosThreatType     = "THREAT"
+)
+
+// panosCSVLayout holds the (zero based) position of the threat log CSV fields mapped into the alert
+type panosCSVLayout struct {
+	serial, logType, subtype, timeGenerated int
+	src, dst, rule, sport, dport, action    int
+	misc, threatName, severity              int
+}
+
+var (
+	// panosThreatLayout80 is the threat log format of PAN-OS 8.0. Newer releases only append fields at the end so
+	// the positions of the mapped fields have not changed since
+	panosThreatLayout80 = &panosCSVLayout{
+		serial:        2,
+		logType:       3,
+		subtype:       4,
+		timeGenerated: 6,
+		src:           7,
+		dst:           8,
+		rule:          11,
+		sport:         24,
+		dport:         25,
+		action:        30,
+		misc:          31,
+		threatName:    32,
+		severity:      34,
+	}
+	// panosThreatLayouts maps PAN-OS releases (sorted) to their threat log format. A version gets the format of the
+	// newest release not newer than itself so maintenance and future releases are supported
+	panosThreatLayouts = []struct {
+		major, minor int
+		layout       *panosCSVLayout
+	}{
+		{8, 0, panosThreatLayout80},
+		{8, 1, panosThreatLayout80},
+		{9, 0, panosThreatLayout80},
+		{9, 1, panosThreatLayout80},
+		{10, 0, panosThreatLayout80},
+		{10, 1, panosThreatLayout80},
+		{10, 2, panosThreatLayout80},
+		{11, 0, panosThreatLayout80},
+		{11, 1, panosThreatLayout80},
+	}
+	panosVersion     = regexp.MustCompile(`^(\d+)\.(\d+)(\.\d+)?`)
+	csvPayloadLayout = `Syslog Server Profile (UDP, TCP or SSL transport, BSD or IETF format)
+Threat log type using the default CSV format of PAN-OS %v (no custom log format)
+`
+)
+
+// CSVParser implements xdrgateway.Parser interface for the default PAN-OS threat log CSV format (as sent by
+// syslog server profiles). A leading BSD (RFC 3164) or IETF (RFC 5424) syslog header is skipped
+type CSVParser struct {
+	zones           *TimeZones
+	layout          *panosCSVLayout
+	fields          int
+	version         string
+	tsLayout        string
+	product, vendor string
+	debug           bool
+}
+
+// NewCSVParser returns a parser for the default threat log CSV format with TimeZone set to `offset`-hours (negative
+// values supported). `version` is the PAN-OS version of the firewalls (major.minor[.patch], 8.0 or newer). Syslog
+// messages do not include it so it is reported as the sender software version of the alerts
+func NewCSVParser(offset int, version string, debug bool) (c *CSVParser, err error) {
+	if version == "" {
+		version = DefaultPANOSVersion
+	}
+	var layout *panosCSVLayout
+	if layout, err = panosLayout(version); err != nil {
+		return
+	}
+	c = &CSVParser{
+		zones:    fixedTimeZones(offset),
+		layout:   layout,
+		fields:   layout.severity + 1,
+		version:  version,
+		tsLayout: panosTSLayout,
+		product:  "PAN-OS",
+		vendor:   "Palo Alto Networks",
+		debug:    debug,
+	}
+	return
+}
+
+// panosLayout returns the threat log format of a PAN-OS version (major.minor[.patch])
+func panosLayout(version string) (layout *panosCSVLayout, err error) {
+	parts := panosVersion.FindStringSubmatch(version)
+	if parts == nil {
+		err = fmt.Errorf("invalid PAN-OS version %v", version)
+		return
+	}
+	major, _ := strconv.Atoi(parts[1])
+	minor, _ := strconv.Atoi(parts[2])
+	for _, entry := range panosThreatLayouts {
+		if entry.major > major || entry.major == major && entry.minor > minor {
+			break
+		}
+		layout = entry.layout
+	}
+	if layout == nil {
+		err = fmt.Errorf("unsupported PAN-OS version %v (8.0 or newer required)", version)
+	}
+	return
+}
+
+// Parse converts a PAN-OS threat log CSV line into a XDR Alert. Return error if parsing fails
+func (c *CSVParser) Parse(data []byte) (alert *xdrclient.Alert, err error) {
+	data = syslogMessage(data)
+	if c.debug {
+		log.Println("csvParser - rx:", glimpse(data))
+	}
+	reader := csv.NewReader(bytes.NewReader(data))
+	reader.FieldsPerRecord = -1
+	reader.LazyQuotes = true
+	var record []string
+	if record, err = reader.Read(); err != nil {
+		return
+	}
+	if len(record) < c.fields {
+		err = fmt.Errorf("csvParser - short record (%v fields)", len(record))
+		return
+	}
+	l := c.layout
+	if record[l.logType] != panosThreatType {
+		err = fmt.Errorf("csvParser - unsupported log type %v", record[l.logType])
+		return
+	}
+	event := &basicParserJSON{
+		Src:        record[l.src],
+		Dst:        record[l.dst],
+		Timestamp:  record[l.timeGenerated],
+		Rule:       record[l.rule],
+		Serial:     record[l.serial],
+		Subtype:    record[l.subtype],
+		Misc:       record[l.misc],
+		ThreatName: record[l.threatName],
+		Severity:   record[l.severity],
+		Action:     record[l.action],
+		SWVersion:  c.version,
+	}
+	if event.Sport, err = strconv.Atoi(record[l.sport]); err != nil {
+		return
+	}
+	if event.Dport, err = strconv.Atoi(record[l.dport]); err != nil {
+		return
+	}
+	var t time.Time
+	if t, err = time.ParseInLocation(c.tsLayout, event.Timestamp, c.zones.Location(event.Serial)); err == nil {
+		alert, err = panosAlert(event, t, c.product, c.vendor)
+	}
+	return
+}
+
+// SetTimeZones replaces the fixed offset provided to the constructor with a time zone table (IANA zones and per
+// device overrides)
+func (c *CSVParser) SetTimeZones(zones *TimeZones) {
+	c.zones = zones
+}
+
+// DumpPayloadLayout provides human-readable description of the PAN-OS configuration for this parser
+func (c *CSVParser) DumpPayloadLayout() []byte {
+	return []byte(fmt.Sprintf(csvPayloadLayout, c.version))
+}
@@ -0,0 +1,136 @@
+package xdrgateway
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/xhoms/xdrgateway/xdrclient"
+)
+
+// testThreatLog returns a default format threat log CSV line with the mapped fields set at their positions
+func testThreatLog(logType string, fields int) string {
+	record := make([]string, fields)
+	for idx, value := range map[int]string{
+		panosThreatLayout80.serial:        "012345678901",
+		panosThreatLayout80.logType:       logType,
+		panosThreatLayout80.subtype:       "vulnerability",
+		panosThreatLayout80.timeGenerated: "2021/07/01 12:00:00",
+		panosThreatLayout80.src:           "10.0.0.1",
+		panosThreatLayout80.dst:           "192.168.0.1",
+		panosThreatLayout80.rule:          "outbound",
+		panosThreatLayout80.sport:         "50000",
+		panosThreatLayout80.dport:         "443",
+		panosThreatLayout80.action:        "reset-both",
+		panosThreatLayout80.misc:          "\"www.example.com/\"",
+		panosThreatLayout80.threatName:    "Test Threat(12345)",
+		panosThreatLayout80.severity:      "critical",
+	} {
+		if idx < fields {
+			record[idx] = value
+		}
+	}
+	return strings.Join(record, ",")
+}
+
+func TestNewCSVParser(t *testing.T) {
+	for _, test := range []struct {
+		version, expected string
+		fails             bool
+	}{
+		{"", DefaultPANOSVersion, false},
+		{"10.1.3", "10.1.3", false},
+		{"9.1", "9.1", false},
+		{"8.0", "8.0", false},
+		{"7.1", "", true},
+		{"10", "", true},
+		{"abc", "", true},
+	} {
+		parser, err := NewCSVParser(0, test.version, false)
+		if test.fails {
+			if err == nil {
+				t.Errorf("%q: expected error", test.version)
+			}
+			continue
+		}
+		if err != nil || parser.version != test.expected {
+			t.Errorf("%q: unexpected parser %+v (%v)", test.version, parser, err)
+		}
+	}
+}
+
+func TestPanosLayout(t *testing.T) {
+	latest := panosThreatLayouts[len(panosThreatLayouts)-1].layout
+	for _, test := range []struct {
+		version  string
+		expected *panosCSVLayout
+		fails    bool
+	}{
+		{"8.0", panosThreatLayout80, false},
+		{"8.1.21", panosThreatLayout80, false},
+		{"10.1.3", panosThreatLayout80, false},
+		{"10.3", panosThreatLayout80, false},
+		{"99.0", latest, false},
+		{"7.1.26", nil, true},
+		{"10", nil, true},
+	} {
+		layout, err := panosLayout(test.version)
+		if test.fails != (err != nil) || layout != test.expected {
+			t.Errorf("%q: unexpected layout %+v (%v)", test.version, layout, err)
+		}
+	}
+	for idx := 1; idx < len(panosThreatLayouts); idx++ {
+		prev, entry := panosThreatLayouts[idx-1], panosThreatLayouts[idx]
+		if entry.major < prev.major || entry.major == prev.major && entry.minor <= prev.minor {
+			t.Errorf("layout table not sorted at %v.%v", entry.major, entry.minor)
+		}
+	}
+}
+
+func TestCSVParser(t *testing.T) {
+	parser, err := NewCSVParser(2, "10.1.3", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	timestamp := time.Date(2021, 7, 1, 10, 0, 0, 0, time.UTC).UnixNano() / int64(time.Millisecond)
+	fields := panosThreatLayout80.severity + 1
+	for _, test := range []struct {
+		name, data string
+		fails      bool
+	}{
+		{"plain", testThreatLog(panosThreatType, fields+10), false},
+		{"bsd header", "<14>Jul  1 12:00:00 fw01 " + testThreatLog(panosThreatType, fields), false},
+		{"ietf header", "<14>1 2021-07-01T12:00:00Z fw01 - - - - " + testThreatLog(panosThreatType, fields), false},
+		{"traffic log", testThreatLog("TRAFFIC", fields), true},
+		{"short record", testThreatLog(panosThreatType, fields-1), true},
+		{"empty", "", true},
+	} {
+		alert, err := parser.Parse([]byte(test.data))
+		if test.fails {
+			if err == nil {
+				t.Errorf("%v: expected error, got %+v", test.name, alert)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%v: unexpected error %v", test.name, err)
+			continue
+		}
+		expected := xdrclient.Alert{
+			Product:          "PAN-OS",
+			Vendor:           "Palo Alto Networks",
+			LocalIP:          "10.0.0.1",
+			LocalPort:        50000,
+			RemoteIP:         "192.168.0.1",
+			RemotePort:       443,
+			Timestamp:        timestamp,
+			Severity:         xdrclient.SeverityHigh,
+			AlertName:        "Test Threat(12345)",
+			AlertDescription: "www.example.com/;serial=012345678901;version=10.1.3;action=reset-both;rule=outbound;type=vulnerability",
+			Action:           xdrclient.ActionBlocked,
+		}
+		if *alert != expected {
+			t.Errorf("%v: unexpected alert %+v", test.name, alert)
+		}
+	}
+}
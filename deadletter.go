@@ -0,0 +1,315 @@
+package xdrgateway
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/xhoms/xdrgateway/xdrclient"
+)
+
+const (
+	deadLetterSize     = 64 << 20
+	deadLetterFileSize = 4 << 20
+	deadLetterPrefix   = "deadletter-"
+	deadLetterExt      = ".ndjson"
+	deadLetterListSize = 100
+)
+
+// DeadLetter is an alert that could not be delivered to XDR after exhausting all retries
+type DeadLetter struct {
+	// ID identifies the alert in the dead-letter store
+	ID string
+	// Alert is the original alert
+	Alert *xdrclient.Alert
+	// Error is the last error returned when trying to deliver the alert
+	Error string
+	// Attempts is the number of delivery attempts
+	Attempts int
+	// FirstAttempt is the time of the first delivery attempt
+	FirstAttempt time.Time
+	// LastAttempt is the time the alert was abandoned
+	LastAttempt time.Time
+}
+
+// deadLetterStore keeps undeliverable alerts in rotating NDJSON files. Oldest files are removed when
+// the store exceeds its max size
+type deadLetterStore struct {
+	dir      string
+	maxBytes int64
+	fileSize int64
+	mu       sync.Mutex
+	files    []uint64
+	sizes    map[uint64]int64
+	counts   map[uint64]int64
+	bytes    int64
+	writer   *os.File
+	lastID   int64
+	stats    *PipeStats
+}
+
+func newDeadLetterStore(dir string, maxBytes int64, stats *PipeStats) (d *deadLetterStore, err error) {
+	if maxBytes <= 0 {
+		maxBytes = deadLetterSize
+	}
+	fileSize := int64(deadLetterFileSize)
+	if fileSize > maxBytes/4 {
+		fileSize = maxBytes / 4
+	}
+	d = &deadLetterStore{
+		dir:      dir,
+		maxBytes: maxBytes,
+		fileSize: fileSize,
+		sizes:    make(map[uint64]int64),
+		counts:   make(map[uint64]int64),
+		stats:    stats,
+	}
+	if err = os.MkdirAll(dir, 0700); err != nil {
+		return
+	}
+	var files []os.FileInfo
+	if files, err = ioutil.ReadDir(dir); err != nil {
+		return
+	}
+	for _, file := range files {
+		name := file.Name()
+		if strings.HasPrefix(name, deadLetterPrefix) && strings.HasSuffix(name, deadLetterExt) {
+			name = strings.TrimSuffix(strings.TrimPrefix(name, deadLetterPrefix), deadLetterExt)
+			if id, perr := strconv.ParseUint(name, 10, 64); perr == nil {
+				d.files = append(d.files, id)
+				d.sizes[id] = file.Size()
+				d.bytes += file.Size()
+			}
+		}
+	}
+	sort.Slice(d.files, func(i, j int) bool { return d.files[i] < d.files[j] })
+	for _, id := range d.files {
+		d.read(id, func(letter *DeadLetter) bool {
+			d.counts[id]++
+			return true
+		})
+	}
+	d.updateStats()
+	return
+}
+
+func (d *deadLetterStore) path(id uint64) string {
+	return filepath.Join(d.dir, fmt.Sprintf("%v%020d%v", deadLetterPrefix, id, deadLetterExt))
+}
+
+func (d *deadLetterStore) updateStats() {
+	var count int64
+	for _, id := range d.files {
+		count += d.counts[id]
+	}
+	atomic.StoreInt64(&d.stats.DeadLetters, count)
+	atomic.StoreInt64(&d.stats.DeadLetterBytes, d.bytes)
+}
+
+// read calls fn for each record in the file until fn returns false
+func (d *deadLetterStore) read(id uint64, fn func(letter *DeadLetter) bool) (err error) {
+	var file *os.File
+	if file, err = os.Open(d.path(id)); err != nil {
+		return
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 0, 64*1024), int(d.fileSize)+1)
+	for scanner.Scan() {
+		letter := &DeadLetter{}
+		if jerr := json.Unmarshal(scanner.Bytes(), letter); jerr != nil {
+			continue
+		}
+		if !fn(letter) {
+			break
+		}
+	}
+	err = scanner.Err()
+	return
+}
+
+func (d *deadLetterStore) remove(id uint64) {
+	if err := os.Remove(d.path(id)); err != nil && !os.IsNotExist(err) {
+		log.Println("deadletter error - unable to remove file:", err)
+	}
+	d.bytes -= d.sizes[id]
+	delete(d.sizes, id)
+	delete(d.counts, id)
+	for idx := range d.files {
+		if d.files[idx] == id {
+			d.files = append(d.files[:idx], d.files[idx+1:]...)
+			break
+		}
+	}
+}
+
+func (d *deadLetterStore) closeWriter() {
+	if d.writer != nil {
+		if err := d.writer.Close(); err != nil {
+			log.Println("deadletter error - closing file:", err)
+		}
+		d.writer = nil
+	}
+}
+
+func (d *deadLetterStore) current() (id uint64, err error) {
+	if len(d.files) > 0 {
+		id = d.files[len(d.files)-1]
+	}
+	if d.writer == nil || d.sizes[id] >= d.fileSize {
+		d.closeWriter()
+		id++
+		if d.writer, err = os.OpenFile(d.path(id), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600); err == nil {
+			d.files = append(d.files, id)
+			d.sizes[id] = 0
+		}
+	}
+	return
+}
+
+// put stores all alerts in the batch
+func (d *deadLetterStore) put(batch *retryBatch, now time.Time) (err error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	errText := ""
+	if batch.err != nil {
+		errText = batch.err.Error()
+	}
+	for _, alert := range batch.alerts {
+		letterID := now.UnixNano()
+		if letterID <= d.lastID {
+			letterID = d.lastID + 1
+		}
+		d.lastID = letterID
+		var record []byte
+		if record, err = json.Marshal(&DeadLetter{
+			ID:           strconv.FormatInt(letterID, 36),
+			Alert:        alert,
+			Error:        errText,
+			Attempts:     batch.attempts,
+			FirstAttempt: batch.first,
+			LastAttempt:  now,
+		}); err != nil {
+			return
+		}
+		record = append(record, '\n')
+		var id uint64
+		if id, err = d.current(); err != nil {
+			return
+		}
+		var n int
+		n, err = d.writer.Write(record)
+		d.sizes[id] += int64(n)
+		d.bytes += int64(n)
+		if err != nil {
+			return
+		}
+		d.counts[id]++
+		for d.bytes > d.maxBytes && len(d.files) > 1 {
+			atomic.AddUint64(&d.stats.DeadLetterDropped, uint64(d.counts[d.files[0]]))
+			d.remove(d.files[0])
+		}
+	}
+	d.updateStats()
+	return
+}
+
+// list returns up to limit dead letters (all of them if limit <= 0) oldest first
+func (d *deadLetterStore) list(limit int) (letters []*DeadLetter) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	letters = []*DeadLetter{}
+	for _, id := range d.files {
+		d.read(id, func(letter *DeadLetter) bool {
+			letters = append(letters, letter)
+			return limit <= 0 || len(letters) < limit
+		})
+		if limit > 0 && len(letters) >= limit {
+			break
+		}
+	}
+	return
+}
+
+// get returns the dead letter with the provided id (nil if not found)
+func (d *deadLetterStore) get(letterID string) (letter *DeadLetter) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, id := range d.files {
+		d.read(id, func(candidate *DeadLetter) bool {
+			if candidate.ID == letterID {
+				letter = candidate
+			}
+			return letter == nil
+		})
+		if letter != nil {
+			break
+		}
+	}
+	return
+}
+
+// purge removes the dead letters with the provided ids (all of them if ids is nil) and returns how many were removed
+func (d *deadLetterStore) purge(ids map[string]bool) (purged int64, err error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.closeWriter()
+	defer d.updateStats()
+	files := make([]uint64, len(d.files))
+	copy(files, d.files)
+	for _, id := range files {
+		if ids == nil {
+			purged += d.counts[id]
+			d.remove(id)
+			continue
+		}
+		var kept []byte
+		var count, removed int64
+		if err = d.read(id, func(letter *DeadLetter) bool {
+			if ids[letter.ID] {
+				removed++
+			} else if record, jerr := json.Marshal(letter); jerr == nil {
+				kept = append(append(kept, record...), '\n')
+				count++
+			}
+			return true
+		}); err != nil {
+			return
+		}
+		if removed == 0 {
+			continue
+		}
+		purged += removed
+		if count == 0 {
+			d.remove(id)
+			continue
+		}
+		tmp := d.path(id) + ".tmp"
+		if err = ioutil.WriteFile(tmp, kept, 0600); err == nil {
+			err = os.Rename(tmp, d.path(id))
+		}
+		if err != nil {
+			return
+		}
+		d.bytes += int64(len(kept)) - d.sizes[id]
+		d.sizes[id] = int64(len(kept))
+		d.counts[id] = count
+	}
+	return
+}
+
+func (d *deadLetterStore) close() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.closeWriter()
+}
@@ -0,0 +1,142 @@
+package xdrgateway
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/xhoms/xdrgateway/xdrclient"
+)
+
+// testRetryBatch returns an abandoned batch with n alerts named after their position
+func testRetryBatch(n int) *retryBatch {
+	batch := &retryBatch{attempts: 3, first: time.Now().Add(-time.Minute), err: errors.New("bad gateway")}
+	for i := 0; i < n; i++ {
+		batch.alerts = append(batch.alerts, testAlert(strconv.Itoa(i), xdrclient.SeverityHigh))
+	}
+	return batch
+}
+
+func TestDeadLetterStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "xdrgw-deadletter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	stats := &PipeStats{}
+	store, err := newDeadLetterStore(dir, 0, stats)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = store.put(testRetryBatch(5), time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	letters := store.list(0)
+	if len(letters) != 5 || letters[0].Alert.AlertName != "0" || letters[0].Error != "bad gateway" || letters[0].Attempts != 3 {
+		t.Fatalf("unexpected dead letters %+v", letters)
+	}
+	for _, test := range []struct {
+		limit, listed int
+	}{
+		{-1, 5},
+		{2, 2},
+		{10, 5},
+	} {
+		if listed := len(store.list(test.limit)); listed != test.listed {
+			t.Errorf("limit %v: listed %v", test.limit, listed)
+		}
+	}
+	if letter := store.get(letters[3].ID); letter == nil || letter.Alert.AlertName != "3" {
+		t.Errorf("unexpected dead letter %+v", letter)
+	}
+	if letter := store.get("unknown"); letter != nil {
+		t.Errorf("unexpected dead letter %+v", letter)
+	}
+	if purged, err := store.purge(map[string]bool{letters[1].ID: true, "unknown": true}); purged != 1 || err != nil {
+		t.Errorf("purged %v (%v)", purged, err)
+	}
+	store.close()
+	// counters are restored when the store is opened again
+	stats = &PipeStats{}
+	if store, err = newDeadLetterStore(dir, 0, stats); err != nil {
+		t.Fatal(err)
+	}
+	defer store.close()
+	if count := stats.Snapshot().DeadLetters; count != 4 || store.get(letters[1].ID) != nil {
+		t.Errorf("unexpected dead letters after purge (%v)", count)
+	}
+	if purged, err := store.purge(nil); purged != 4 || err != nil {
+		t.Errorf("purged %v (%v)", purged, err)
+	}
+	if snapshot := stats.Snapshot(); snapshot.DeadLetters != 0 || snapshot.DeadLetterBytes != 0 {
+		t.Errorf("unexpected stats after purge %+v", snapshot)
+	}
+}
+
+func TestDeadLetterStoreRotation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "xdrgw-deadletter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	stats := &PipeStats{}
+	store, err := newDeadLetterStore(dir, 4096, stats)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.close()
+	store.put(testRetryBatch(50), time.Now())
+	snapshot := stats.Snapshot()
+	if snapshot.DeadLetterBytes > 4096 || snapshot.DeadLetterDropped == 0 ||
+		snapshot.DeadLetters+int64(snapshot.DeadLetterDropped) != 50 {
+		t.Errorf("unexpected stats %+v", snapshot)
+	}
+	// oldest dead letters are dropped first
+	if letters := store.list(0); len(letters) == 0 || letters[len(letters)-1].Alert.AlertName != "49" {
+		t.Errorf("unexpected dead letters %v", len(letters))
+	}
+}
+
+func TestReinject(t *testing.T) {
+	for _, test := range []struct {
+		name       string
+		buffer     int
+		selected   []int
+		reinjected int64
+		left       int
+	}{
+		{"all", 10, nil, 3, 0},
+		{"selected", 10, []int{0, 2}, 2, 1},
+		{"pipe full", 2, nil, 2, 1},
+	} {
+		dir, err := ioutil.TempDir("", "xdrgw-deadletter")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+		ops := testPipeOps(10, 0)
+		ops.AlertBufferSize, ops.DeadLetterDir = test.buffer, dir
+		pipe := newAlertPipe([]Sink{&recordingSink{}}, ops)
+		pipe.deadLetters.put(testRetryBatch(3), time.Now())
+		var ids map[string]bool
+		if test.selected != nil {
+			letters := pipe.deadLetters.list(0)
+			ids = make(map[string]bool)
+			for _, idx := range test.selected {
+				ids[letters[idx].ID] = true
+			}
+		}
+		reinjected := reinject(pipe, ids)
+		stats := pipe.stats.Snapshot()
+		if reinjected != test.reinjected || stats.DeadLetterReinjected != uint64(test.reinjected) || pipe.queue.len() != int(test.reinjected) {
+			t.Errorf("%v: reinjected %v (%+v)", test.name, reinjected, stats)
+		}
+		if left := len(pipe.deadLetters.list(0)); left != test.left {
+			t.Errorf("%v: %v dead letters left", test.name, left)
+		}
+		pipe.close()
+	}
+}
@@ -5,7 +5,7 @@ The API type provides methods to implement a HTTP API to ingest third party aler
 Not only provides HTTP handlers for receiving alerts sent using POST but also implements a synchonous ingestion pipeline that
 will enforce Cortex XDR ingestion quotas.
 
-The API requires a XDRClient and a Parser instances. The Parser interface defines the methods to convert
+The API requires a Sink (typically a *xdrclient.Client) and a Parser instances. The Parser interface defines the methods to convert
 the []byte data received by the API in its ingestion endpoint into a valid *Alert
 
 	type Parser interface {
@@ -0,0 +1,105 @@
+package xdrgateway
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/xhoms/xdrgateway/xdrclient"
+)
+
+// alertField returns the value of a named alert field as a string. Supported names (case insensitive) are
+//
+// - src (or localip), dst (or remoteip), sport (or localport), dport (or remoteport)
+//
+// - name (or alertname), description (or alertdescription), severity, action, product, vendor, timestamp
+//
+// Any other name is looked up in the trailing `key=value` parts of the alert description (i.e. serial, version, rule
+// or type as added by BasicParser). An empty string is returned if the field is not found
+func alertField(alert *xdrclient.Alert, name string) (value string) {
+	switch strings.ToLower(name) {
+	case "src", "localip":
+		value = alert.LocalIP
+	case "dst", "remoteip":
+		value = alert.RemoteIP
+	case "sport", "localport":
+		value = strconv.Itoa(int(alert.LocalPort))
+	case "dport", "remoteport":
+		value = strconv.Itoa(int(alert.RemotePort))
+	case "name", "alertname":
+		value = alert.AlertName
+	case "description", "alertdescription":
+		value = alert.AlertDescription
+	case "severity":
+		value = severityName(alert.Severity)
+	case "action":
+		if alert.Action == xdrclient.ActionBlocked {
+			value = "blocked"
+		} else {
+			value = "reported"
+		}
+	case "product":
+		value = alert.Product
+	case "vendor":
+		value = alert.Vendor
+	case "timestamp":
+		value = strconv.FormatInt(alert.Timestamp, 10)
+	default:
+		value = descriptionField(alert.AlertDescription, name)
+	}
+	return
+}
+
+// descriptionField looks for a `key=value` part in a `;` separated description. The first part of the description
+// is free text (i.e. the PAN-OS $misc field) that might contain `;` as well, so the search is anchored to the trailing
+// parts added by the parsers: it goes backwards and stops at the serial part (the first one they add) or at any part
+// that is not a `key=value` pair
+func descriptionField(description, key string) (value string) {
+	parts := strings.Split(description, ";")
+	prefix := key + "="
+	for idx := len(parts) - 1; idx > 0; idx-- {
+		if strings.HasPrefix(parts[idx], prefix) {
+			value = parts[idx][len(prefix):]
+			return
+		}
+		if strings.HasPrefix(parts[idx], "serial=") || !strings.Contains(parts[idx], "=") {
+			return
+		}
+	}
+	return
+}
+
+// severityName returns the lowercase name of a XDR severity as used in configuration files
+func severityName(severity xdrclient.Severities) string {
+	switch severity {
+	case xdrclient.SeverityInfo:
+		return "informational"
+	case xdrclient.SeverityLow:
+		return "low"
+	case xdrclient.SeverityMedium:
+		return "medium"
+	case xdrclient.SeverityHigh:
+		return "high"
+	default:
+		return "unknown"
+	}
+}
+
+// severityByName returns the XDR severity for a name as returned by severityName
+func severityByName(name string) (severity xdrclient.Severities, exists bool) {
+	exists = true
+	switch strings.ToLower(name) {
+	case "informational":
+		severity = xdrclient.SeverityInfo
+	case "low":
+		severity = xdrclient.SeverityLow
+	case "medium":
+		severity = xdrclient.SeverityMedium
+	case "high":
+		severity = xdrclient.SeverityHigh
+	case "unknown":
+		severity = xdrclient.SeverityUnknown
+	default:
+		exists = false
+	}
+	return
+}
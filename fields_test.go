@@ -0,0 +1,48 @@
+package xdrgateway
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDescriptionField(t *testing.T) {
+	for _, test := range []struct {
+		description, key, expected string
+	}{
+		{"misc;serial=012345678901;version=10.1.3", "serial", "012345678901"},
+		{"misc;serial=012345678901;version=10.1.3", "version", "10.1.3"},
+		{"serial=012345678901", "serial", ""},
+		{"www.example.com/;serial=012345678902;serial=012345678901;rule=outbound", "serial", "012345678901"},
+		{"www.example.com/;serial=012345678902;serial=;type=url", "serial", ""},
+		{"www.example.com/;zone=trust;serial=012345678901;type=url", "zone", ""},
+		{"misc;serial=012345678901;type=url;count=3;first=1;last=2", "count", "3"},
+		{"misc;serial=012345678901;type=url;count=3;first=1;last=2", "serial", "012345678901"},
+		{"misc;rule=outbound", "rule", "outbound"},
+		{"misc;rule=spoofed;free text;type=url", "rule", ""},
+	} {
+		if value := descriptionField(test.description, test.key); value != test.expected {
+			t.Errorf("%q (%v): unexpected value %q", test.description, test.key, value)
+		}
+	}
+}
+
+func TestAlertFieldSpoofing(t *testing.T) {
+	for _, test := range []struct {
+		name   string
+		event  basicParserJSON
+		serial string
+	}{
+		{"misc", basicParserJSON{Src: "10.0.0.1", Dst: "192.168.0.1", Misc: "www.example.com/;serial=012345678902", Serial: "012345678901"}, "012345678901"},
+		{"misc without serial", basicParserJSON{Src: "10.0.0.1", Dst: "192.168.0.1", Misc: "www.example.com/;serial=012345678902"}, ""},
+		{"rule", basicParserJSON{Src: "10.0.0.1", Dst: "192.168.0.1", Serial: "012345678901", Rule: "outbound;serial=012345678902"}, "012345678901"},
+		{"subtype", basicParserJSON{Src: "10.0.0.1", Dst: "192.168.0.1", Serial: "012345678901", Subtype: "url;serial=012345678902"}, "012345678901"},
+	} {
+		alert, err := panosAlert(&test.event, time.Now(), "PAN-OS", "Palo Alto Networks")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if serial := alertField(alert, "serial"); serial != test.serial {
+			t.Errorf("%v: unexpected serial %q (%v)", test.name, serial, alert.AlertDescription)
+		}
+	}
+}
@@ -0,0 +1,201 @@
+package xdrgateway
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"regexp"
+	"strings"
+	"sync/atomic"
+
+	"github.com/xhoms/xdrgateway/xdrclient"
+)
+
+const (
+	// FilterPass lets the alert continue into the pipe
+	FilterPass = "pass"
+	// FilterDrop discards the alert
+	FilterDrop = "drop"
+)
+
+// FilterCondition is a single check on an alert field. Supported operators are
+//
+// - eq the field value equals Value
+//
+// - in the field value equals any of Values
+//
+// - regex the field value matches the regular expression in Value
+//
+// - cidr the field value is an IP address contained in any of the networks in Values (or Value)
+//
+// Field names are the ones supported by the aggregation keys (src, dst, sport, dport, name, severity, action, ...)
+// and any `key=value` part of the alert description (serial, version, rule, type, ...)
+type FilterCondition struct {
+	Field  string   `json:"field"`
+	Op     string   `json:"op"`
+	Value  string   `json:"value,omitempty"`
+	Values []string `json:"values,omitempty"`
+	// Negate inverts the result of the condition
+	Negate bool `json:"negate,omitempty"`
+	re     *regexp.Regexp
+	nets   []*net.IPNet
+	set    map[string]bool
+}
+
+// FilterRule is a named list of conditions that must all match for the rule Action (pass or drop) to be applied
+type FilterRule struct {
+	Name   string             `json:"name"`
+	Action string             `json:"action"`
+	Match  []*FilterCondition `json:"match"`
+}
+
+// FilterRuleHits provides the hit counter of a filter rule
+type FilterRuleHits struct {
+	Name string
+	Hits uint64
+}
+
+// Filter is an ordered chain of rules evaluated against each parsed alert. The first matching rule decides whether
+// the alert is passed or dropped. Alerts not matching any rule get the Default action (pass if empty)
+type Filter struct {
+	Default string        `json:"default"`
+	Rules   []*FilterRule `json:"rules"`
+	hits    []FilterRuleHits
+}
+
+// NewFilterFromFile loads a filter chain from a JSON file. Example:
+//
+//	{
+//		"default": "pass",
+//		"rules": [
+//			{"name": "lab-info", "action": "drop", "match": [
+//				{"field": "serial", "op": "eq", "value": "012345678901"},
+//				{"field": "severity", "op": "eq", "value": "informational"}
+//			]},
+//			{"name": "guest", "action": "drop", "match": [{"field": "rule", "op": "regex", "value": "^guest-"}]},
+//			{"name": "scanners", "action": "drop", "match": [{"field": "src", "op": "cidr", "values": ["192.0.2.0/24"]}]}
+//		]
+//	}
+func NewFilterFromFile(path string) (f *Filter, err error) {
+	var data []byte
+	if data, err = ioutil.ReadFile(path); err != nil {
+		return
+	}
+	f = &Filter{}
+	if err = json.Unmarshal(data, f); err == nil {
+		err = f.Init()
+	}
+	return
+}
+
+// Init validates and compiles the filter rules. It must be called before the filter is used if the struct
+// is not created with NewFilterFromFile
+func (f *Filter) Init() (err error) {
+	if f.Default, err = filterAction(f.Default); err != nil {
+		return
+	}
+	f.hits = make([]FilterRuleHits, len(f.Rules))
+	for idx, rule := range f.Rules {
+		if rule.Name == "" {
+			rule.Name = fmt.Sprintf("rule-%v", idx)
+		}
+		f.hits[idx].Name = rule.Name
+		if rule.Action, err = filterAction(rule.Action); err != nil {
+			err = fmt.Errorf("filter rule %v: %v", rule.Name, err)
+			return
+		}
+		for _, cond := range rule.Match {
+			if err = cond.compile(); err != nil {
+				err = fmt.Errorf("filter rule %v: %v", rule.Name, err)
+				return
+			}
+		}
+	}
+	return
+}
+
+func filterAction(action string) (string, error) {
+	switch strings.ToLower(action) {
+	case "", FilterPass:
+		return FilterPass, nil
+	case FilterDrop:
+		return FilterDrop, nil
+	}
+	return "", fmt.Errorf("unknown filter action %v", action)
+}
+
+func (c *FilterCondition) compile() (err error) {
+	if c.Field == "" {
+		return fmt.Errorf("missing condition field")
+	}
+	values := c.Values
+	if c.Value != "" {
+		values = append([]string{c.Value}, values...)
+	}
+	switch strings.ToLower(c.Op) {
+	case "eq", "in":
+		c.set = make(map[string]bool, len(values))
+		for _, value := range values {
+			c.set[value] = true
+		}
+	case "regex":
+		c.re, err = regexp.Compile(c.Value)
+	case "cidr":
+		for _, value := range values {
+			var ipnet *net.IPNet
+			if _, ipnet, err = net.ParseCIDR(value); err != nil {
+				return
+			}
+			c.nets = append(c.nets, ipnet)
+		}
+	default:
+		err = fmt.Errorf("unknown condition operator %v", c.Op)
+	}
+	return
+}
+
+func (c *FilterCondition) match(alert *xdrclient.Alert) (matched bool) {
+	value := alertField(alert, c.Field)
+	switch {
+	case c.set != nil:
+		matched = c.set[value]
+	case c.re != nil:
+		matched = c.re.MatchString(value)
+	case c.nets != nil:
+		if ip := net.ParseIP(value); ip != nil {
+			for _, ipnet := range c.nets {
+				if ipnet.Contains(ip) {
+					matched = true
+					break
+				}
+			}
+		}
+	}
+	return matched != c.Negate
+}
+
+// Pass evaluates the filter chain. Returns false if the alert must be dropped
+func (f *Filter) Pass(alert *xdrclient.Alert) bool {
+RULES:
+	for idx, rule := range f.Rules {
+		for _, cond := range rule.Match {
+			if !cond.match(alert) {
+				continue RULES
+			}
+		}
+		atomic.AddUint64(&f.hits[idx].Hits, 1)
+		return rule.Action == FilterPass
+	}
+	return f.Default == FilterPass
+}
+
+// Hits returns a copy of the hit counters of the filter rules
+func (f *Filter) Hits() (hits []FilterRuleHits) {
+	hits = make([]FilterRuleHits, len(f.hits))
+	for idx := range f.hits {
+		hits[idx].Name = f.hits[idx].Name
+		hits[idx].Hits = atomic.LoadUint64(&f.hits[idx].Hits)
+	}
+	return
+}
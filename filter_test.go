@@ -0,0 +1,88 @@
+package xdrgateway
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/xhoms/xdrgateway/xdrclient"
+)
+
+const filterTestConfig = `{
+	"default": "drop",
+	"rules": [
+		{"name": "lab-info", "action": "drop", "match": [
+			{"field": "serial", "op": "eq", "value": "012345678901"},
+			{"field": "severity", "op": "eq", "value": "informational"}
+		]},
+		{"name": "guest", "action": "drop", "match": [{"field": "rule", "op": "regex", "value": "^guest-"}]},
+		{"name": "scanners", "action": "drop", "match": [{"field": "src", "op": "cidr", "values": ["192.0.2.0/24"]}]},
+		{"name": "web", "action": "pass", "match": [{"field": "dport", "op": "in", "values": ["80", "443"]}]},
+		{"action": "pass", "match": [{"field": "action", "op": "eq", "value": "blocked", "negate": true}]}
+	]
+}`
+
+func filterTestAlert(src string, dport uint16, severity xdrclient.Severities, action xdrclient.Actions, description string) *xdrclient.Alert {
+	return &xdrclient.Alert{LocalIP: src, RemotePort: dport, Severity: severity, Action: action, AlertDescription: description}
+}
+
+func TestFilter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "xdrgw-filter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "filter.json")
+	ioutil.WriteFile(path, []byte(filterTestConfig), 0600)
+	filter, err := NewFilterFromFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		name   string
+		alert  *xdrclient.Alert
+		passed bool
+	}{
+		{"lab info", filterTestAlert("10.0.0.1", 443, xdrclient.SeverityInfo, xdrclient.ActionBlocked, "misc;serial=012345678901"), false},
+		{"lab high", filterTestAlert("10.0.0.1", 443, xdrclient.SeverityHigh, xdrclient.ActionBlocked, "misc;serial=012345678901"), true},
+		{"guest rule", filterTestAlert("10.0.0.1", 443, xdrclient.SeverityHigh, xdrclient.ActionBlocked, "misc;rule=guest-wifi"), false},
+		{"free text is not a field", filterTestAlert("10.0.0.1", 443, xdrclient.SeverityHigh, xdrclient.ActionBlocked, "rule=guest-wifi"), true},
+		{"scanner", filterTestAlert("192.0.2.10", 443, xdrclient.SeverityHigh, xdrclient.ActionBlocked, "misc"), false},
+		{"reported", filterTestAlert("10.0.0.1", 22, xdrclient.SeverityHigh, xdrclient.ActionReported, "misc"), true},
+		{"default", filterTestAlert("10.0.0.1", 22, xdrclient.SeverityHigh, xdrclient.ActionBlocked, "misc"), false},
+	} {
+		if passed := filter.Pass(test.alert); passed != test.passed {
+			t.Errorf("%v: passed %v", test.name, passed)
+		}
+	}
+	expected := map[string]uint64{"lab-info": 1, "guest": 1, "scanners": 1, "web": 2, "rule-4": 1}
+	for _, hits := range filter.Hits() {
+		if hits.Hits != expected[hits.Name] {
+			t.Errorf("rule %v: %v hits", hits.Name, hits.Hits)
+		}
+	}
+}
+
+func TestFilterInit(t *testing.T) {
+	for _, test := range []struct {
+		name   string
+		filter *Filter
+		fails  bool
+	}{
+		{"empty", &Filter{}, false},
+		{"unknown default", &Filter{Default: "reject"}, true},
+		{"unknown action", &Filter{Rules: []*FilterRule{{Action: "reject"}}}, true},
+		{"missing field", &Filter{Rules: []*FilterRule{{Match: []*FilterCondition{{Op: "eq"}}}}}, true},
+		{"unknown operator", &Filter{Rules: []*FilterRule{{Match: []*FilterCondition{{Field: "src", Op: "gt"}}}}}, true},
+		{"invalid regex", &Filter{Rules: []*FilterRule{{Match: []*FilterCondition{{Field: "name", Op: "regex", Value: "("}}}}}, true},
+		{"invalid cidr", &Filter{Rules: []*FilterRule{{Match: []*FilterCondition{{Field: "src", Op: "cidr", Value: "10.0.0.0"}}}}}, true},
+	} {
+		if err := test.filter.Init(); (err != nil) != test.fails {
+			t.Errorf("%v: unexpected result %v", test.name, err)
+		}
+	}
+	if filter := (&Filter{}); filter.Init() != nil || !filter.Pass(&xdrclient.Alert{}) {
+		t.Error("empty filter must pass all alerts")
+	}
+}
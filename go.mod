@@ -1,3 +1,10 @@
 module github.com/xhoms/xdrgateway
 
-go 1.15
+go 1.17
+
+require (
+	golang.org/x/crypto v0.9.0
+	gopkg.in/yaml.v3 v3.0.1
+)
+
+require golang.org/x/sys v0.8.0 // indirect
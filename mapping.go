@@ -0,0 +1,400 @@
+package xdrgateway
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/xhoms/xdrgateway/xdrclient"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	annexSeparator = "---annex---"
+	// MappingUnixSeconds timestamp layout for epoch seconds values
+	MappingUnixSeconds = "unix"
+	// MappingUnixMilliseconds timestamp layout for epoch milliseconds values
+	MappingUnixMilliseconds = "unix_ms"
+	// MappingAutoTimestamp timestamp layout that detects epoch (seconds or milliseconds), RFC 3339 (i.e. PAN-OS
+	// $high_res_timestamp) and PAN-OS $time_generated or $receive_time values
+	MappingAutoTimestamp = "auto"
+)
+
+// MappingField is a field of the JSON payload pushed by PAN-OS
+type MappingField struct {
+	// Path of the field in the JSON payload (dot separated for nested objects)
+	Path string `json:"path" yaml:"path"`
+	// Variable is the PAN-OS log variable (i.e. $src) that fills the field
+	Variable string `json:"variable" yaml:"variable"`
+	// Annex moves the field after the `---annex---` separator (for values that may break the JSON document, like $misc)
+	Annex bool `json:"annex,omitempty" yaml:"annex,omitempty"`
+}
+
+// MappingConfig declares the PAN-OS payload and how its fields are mapped into the XDR alert. Mapping attributes
+// hold the Path of a Payload field
+type MappingConfig struct {
+	Product string `json:"product" yaml:"product"`
+	Vendor  string `json:"vendor" yaml:"vendor"`
+	// Payload fields in the order they are rendered in the PAN-OS payload layout
+	Payload    []*MappingField `json:"payload" yaml:"payload"`
+	LocalIP    string          `json:"local_ip" yaml:"local_ip"`
+	LocalPort  string          `json:"local_port" yaml:"local_port"`
+	RemoteIP   string          `json:"remote_ip" yaml:"remote_ip"`
+	RemotePort string          `json:"remote_port" yaml:"remote_port"`
+	Timestamp  string          `json:"timestamp" yaml:"timestamp"`
+	// Serial is the device serial number used to look up time zone overrides (see SetTimeZones)
+	Serial string `json:"serial" yaml:"serial"`
+	// TimestampLayout is a Go time layout, `unix` (epoch seconds), `unix_ms` (epoch milliseconds) or `auto`
+	TimestampLayout string `json:"timestamp_layout" yaml:"timestamp_layout"`
+	Name            string `json:"name" yaml:"name"`
+	// Description is a text/template executed with a map of payload paths to values (i.e. {{.misc}};rule={{.rule}}).
+	// Use the index function for nested paths: {{index . "threat.name"}}
+	Description string `json:"description" yaml:"description"`
+	Severity    string `json:"severity" yaml:"severity"`
+	// SeverityMap maps payload values to XDR severities (high, medium, low, informational or unknown)
+	SeverityMap map[string]string `json:"severity_map" yaml:"severity_map"`
+	// DefaultSeverity is used for values not in SeverityMap (defaults to unknown)
+	DefaultSeverity string `json:"default_severity" yaml:"default_severity"`
+	Action          string `json:"action" yaml:"action"`
+	// ActionMap maps payload values to XDR actions (reported or blocked)
+	ActionMap map[string]string `json:"action_map" yaml:"action_map"`
+	// DefaultAction is used for values not in ActionMap (defaults to blocked)
+	DefaultAction string `json:"default_action" yaml:"default_action"`
+}
+
+// MappingParser implements xdrgateway.Parser interface for JSON payloads declared in a MappingConfig. The payload
+// layout is generated from the same configuration so the PAN-OS payload and the parser can't drift apart
+type MappingParser struct {
+	config          *MappingConfig
+	zones           *TimeZones
+	description     *template.Template
+	severities      map[string]xdrclient.Severities
+	defaultSeverity xdrclient.Severities
+	actions         map[string]xdrclient.Actions
+	defaultAction   xdrclient.Actions
+	annex           string
+	payloadLayout   []byte
+	debug           bool
+}
+
+// NewMappingParserFromFile loads the mapping configuration from a YAML (.yaml or .yml extension) or JSON file and
+// returns a parser with TimeZone set to `offset`-hours (negative values supported). Example:
+//
+//	product: PAN-OS
+//	vendor: Palo Alto Networks
+//	payload:
+//	  - {path: src, variable: $src}
+//	  - {path: dst, variable: $dst}
+//	  - {path: sport, variable: $sport}
+//	  - {path: dport, variable: $dport}
+//	  - {path: time_generated, variable: $time_generated}
+//	  - {path: threat.name, variable: $threat_name}
+//	  - {path: threat.severity, variable: $severity}
+//	  - {path: action, variable: $action}
+//	  - {path: rule, variable: $rule}
+//	  - {path: misc, variable: $misc, annex: true}
+//	local_ip: src
+//	local_port: sport
+//	remote_ip: dst
+//	remote_port: dport
+//	timestamp: time_generated
+//	timestamp_layout: 2006/01/02 15:04:05
+//	name: threat.name
+//	description: "{{.misc}}{{with .rule}};rule={{.}}{{end}}"
+//	severity: threat.severity
+//	severity_map: {critical: high, high: high, medium: medium, low: low, informational: informational}
+//	action: action
+//	action_map: {alert: reported, allow: reported}
+func NewMappingParserFromFile(path string, offset int, debug bool) (m *MappingParser, err error) {
+	var data []byte
+	if data, err = ioutil.ReadFile(path); err != nil {
+		return
+	}
+	config := &MappingConfig{}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, config)
+	default:
+		err = json.Unmarshal(data, config)
+	}
+	if err == nil {
+		m, err = NewMappingParser(config, offset, debug)
+	}
+	return
+}
+
+// NewMappingParser validates the configuration and returns a parser with TimeZone set to `offset`-hours (negative
+// values supported). All mapping attributes must reference a declared payload field
+func NewMappingParser(config *MappingConfig, offset int, debug bool) (m *MappingParser, err error) {
+	m = &MappingParser{
+		config:          config,
+		zones:           fixedTimeZones(offset),
+		severities:      make(map[string]xdrclient.Severities, len(config.SeverityMap)),
+		defaultSeverity: xdrclient.SeverityUnknown,
+		actions:         make(map[string]xdrclient.Actions, len(config.ActionMap)),
+		defaultAction:   xdrclient.ActionBlocked,
+		debug:           debug,
+	}
+	paths := make(map[string]bool, len(config.Payload))
+	for _, field := range config.Payload {
+		if field.Path == "" || field.Variable == "" || paths[field.Path] {
+			return nil, fmt.Errorf("mappingParser - invalid or duplicated payload field %q", field.Path)
+		}
+		paths[field.Path] = true
+		if field.Annex {
+			if m.annex != "" {
+				return nil, fmt.Errorf("mappingParser - only one annex field is supported")
+			}
+			m.annex = field.Path
+		}
+	}
+	for attr, path := range map[string]string{
+		"local_ip":    config.LocalIP,
+		"local_port":  config.LocalPort,
+		"remote_ip":   config.RemoteIP,
+		"remote_port": config.RemotePort,
+		"timestamp":   config.Timestamp,
+		"serial":      config.Serial,
+		"name":        config.Name,
+		"severity":    config.Severity,
+		"action":      config.Action,
+	} {
+		if path != "" && !paths[path] {
+			return nil, fmt.Errorf("mappingParser - %v references undeclared payload field %q", attr, path)
+		}
+	}
+	if config.Timestamp == "" || config.TimestampLayout == "" {
+		return nil, fmt.Errorf("mappingParser - timestamp and timestamp_layout are mandatory")
+	}
+	if m.description, err = template.New("description").Option("missingkey=zero").Parse(config.Description); err != nil {
+		return nil, err
+	}
+	// the description template can only reference declared payload fields
+	check, _ := m.description.Clone()
+	empty := make(map[string]string, len(paths))
+	for path := range paths {
+		empty[path] = ""
+	}
+	if err = check.Option("missingkey=error").Execute(ioutil.Discard, empty); err != nil {
+		return nil, fmt.Errorf("mappingParser - description: %v", err)
+	}
+	for value, name := range config.SeverityMap {
+		severity, exists := severityByName(name)
+		if !exists {
+			return nil, fmt.Errorf("mappingParser - unknown severity %v", name)
+		}
+		m.severities[value] = severity
+	}
+	if config.DefaultSeverity != "" {
+		var exists bool
+		if m.defaultSeverity, exists = severityByName(config.DefaultSeverity); !exists {
+			return nil, fmt.Errorf("mappingParser - unknown severity %v", config.DefaultSeverity)
+		}
+	}
+	for value, name := range config.ActionMap {
+		if m.actions[value], err = actionByName(name); err != nil {
+			return nil, err
+		}
+	}
+	if config.DefaultAction != "" {
+		if m.defaultAction, err = actionByName(config.DefaultAction); err != nil {
+			return nil, err
+		}
+	}
+	m.payloadLayout = m.layout()
+	return
+}
+
+func actionByName(name string) (action xdrclient.Actions, err error) {
+	switch strings.ToLower(name) {
+	case "reported":
+		action = xdrclient.ActionReported
+	case "blocked":
+		action = xdrclient.ActionBlocked
+	default:
+		err = fmt.Errorf("mappingParser - unknown action %v", name)
+	}
+	return
+}
+
+// layout renders the PAN-OS payload from the declared fields. All values are quoted (ports included) so empty
+// variables still produce a valid JSON document
+func (m *MappingParser) layout() []byte {
+	type node struct {
+		keys     []string
+		children map[string]*node
+		variable string
+	}
+	root := &node{children: make(map[string]*node)}
+	var annex string
+	for _, field := range m.config.Payload {
+		if field.Annex {
+			annex = field.Variable
+			continue
+		}
+		current := root
+		for _, key := range strings.Split(field.Path, ".") {
+			child, exists := current.children[key]
+			if !exists {
+				child = &node{children: make(map[string]*node)}
+				current.children[key] = child
+				current.keys = append(current.keys, key)
+			}
+			current = child
+		}
+		current.variable = field.Variable
+	}
+	buff := new(bytes.Buffer)
+	var render func(n *node, indent string)
+	render = func(n *node, indent string) {
+		buff.WriteString("{\n")
+		for idx, key := range n.keys {
+			child := n.children[key]
+			fmt.Fprintf(buff, "%v\t%q: ", indent, key)
+			if len(child.keys) > 0 {
+				render(child, indent+"\t")
+			} else {
+				fmt.Fprintf(buff, "\"%v\"", child.variable)
+			}
+			if idx < len(n.keys)-1 {
+				buff.WriteByte(',')
+			}
+			buff.WriteByte('\n')
+		}
+		buff.WriteString(indent + "}")
+	}
+	render(root, "")
+	buff.WriteByte('\n')
+	if annex != "" {
+		buff.WriteString(annexSeparator + "\n" + annex + "\n")
+	}
+	return buff.Bytes()
+}
+
+// Parse converts data into a XDR Alert. Return error if parsing fails
+func (m *MappingParser) Parse(data []byte) (alert *xdrclient.Alert, err error) {
+	if m.debug {
+		log.Println("mappingParser - rx:", glimpse(data))
+	}
+	parts := strings.SplitN(string(data), annexSeparator, 2)
+	decoder := json.NewDecoder(strings.NewReader(parts[0]))
+	decoder.UseNumber()
+	var document interface{}
+	if err = decoder.Decode(&document); err != nil {
+		return
+	}
+	values := make(map[string]string, len(m.config.Payload))
+	for _, field := range m.config.Payload {
+		values[field.Path] = jsonPath(document, field.Path)
+	}
+	if m.annex != "" && len(parts) > 1 {
+		values[m.annex] = strings.Trim(parts[1], "\n\"")
+	}
+	c := m.config
+	var timestamp int64
+	if timestamp, err = m.timestamp(values[c.Timestamp], values[c.Serial]); err != nil {
+		return
+	}
+	severity, exists := m.severities[values[c.Severity]]
+	if !exists {
+		severity = m.defaultSeverity
+	}
+	action, exists := m.actions[values[c.Action]]
+	if !exists {
+		action = m.defaultAction
+	}
+	var sport, dport int
+	if values[c.LocalPort] != "" {
+		if sport, err = strconv.Atoi(values[c.LocalPort]); err != nil {
+			return
+		}
+	}
+	if values[c.RemotePort] != "" {
+		if dport, err = strconv.Atoi(values[c.RemotePort]); err != nil {
+			return
+		}
+	}
+	description := new(strings.Builder)
+	if err = m.description.Execute(description, values); err != nil {
+		return
+	}
+	alert = xdrclient.NewAlert(severity, timestamp)
+	alert.Product, alert.Vendor = c.Product, c.Vendor
+	if err = alert.NetData(values[c.LocalIP], values[c.RemoteIP], uint16(sport), uint16(dport)); err == nil {
+		alert.MetaData(values[c.Name], description.String(), action)
+	}
+	return
+}
+
+// timestamp converts the payload value into epoch milliseconds
+func (m *MappingParser) timestamp(value, serial string) (ms int64, err error) {
+	switch m.config.TimestampLayout {
+	case MappingUnixSeconds:
+		if ms, err = strconv.ParseInt(value, 10, 64); err == nil {
+			ms *= 1000
+		}
+	case MappingUnixMilliseconds:
+		ms, err = strconv.ParseInt(value, 10, 64)
+	case MappingAutoTimestamp:
+		var t time.Time
+		if t, err = parseTimestamp(value, panosTSLayout, m.zones.Location(serial)); err == nil {
+			ms = t.UnixNano() / int64(time.Millisecond)
+		}
+	default:
+		var t time.Time
+		if t, err = time.ParseInLocation(m.config.TimestampLayout, value, m.zones.Location(serial)); err == nil {
+			ms = t.UnixNano() / int64(time.Millisecond)
+		}
+	}
+	return
+}
+
+// SetTimeZones replaces the fixed offset provided to the constructor with a time zone table (IANA zones and per
+// device overrides)
+func (m *MappingParser) SetTimeZones(zones *TimeZones) {
+	m.zones = zones
+}
+
+// DumpPayloadLayout provides human-readable format of the PAN-OS payload generated from the mapping configuration
+func (m *MappingParser) DumpPayloadLayout() []byte {
+	return m.payloadLayout
+}
+
+// jsonPath returns the string representation of the value at the dot separated path (numeric parts index arrays)
+func jsonPath(document interface{}, path string) string {
+	current := document
+	for _, key := range strings.Split(path, ".") {
+		switch node := current.(type) {
+		case map[string]interface{}:
+			current = node[key]
+		case []interface{}:
+			idx, err := strconv.Atoi(key)
+			if err != nil || idx < 0 || idx >= len(node) {
+				return ""
+			}
+			current = node[idx]
+		default:
+			return ""
+		}
+	}
+	switch value := current.(type) {
+	case nil:
+		return ""
+	case string:
+		return value
+	case json.Number:
+		return value.String()
+	case bool:
+		return strconv.FormatBool(value)
+	default:
+		data, _ := json.Marshal(value)
+		return string(data)
+	}
+}
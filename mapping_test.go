@@ -0,0 +1,178 @@
+package xdrgateway
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/xhoms/xdrgateway/xdrclient"
+)
+
+const mappingTestConfig = `product: PAN-OS
+vendor: Palo Alto Networks
+payload:
+  - {path: src, variable: $src}
+  - {path: dst, variable: $dst}
+  - {path: sport, variable: $sport}
+  - {path: dport, variable: $dport}
+  - {path: time_generated, variable: $time_generated}
+  - {path: threat.name, variable: $threat_name}
+  - {path: threat.severity, variable: $severity}
+  - {path: action, variable: $action}
+  - {path: rule, variable: $rule}
+  - {path: misc, variable: $misc, annex: true}
+local_ip: src
+local_port: sport
+remote_ip: dst
+remote_port: dport
+timestamp: time_generated
+timestamp_layout: 2006/01/02 15:04:05
+name: threat.name
+description: "{{.misc}}{{with .rule}};rule={{.}}{{end}}"
+severity: threat.severity
+severity_map: {critical: high, high: high, medium: medium, low: low, informational: informational}
+action: action
+action_map: {alert: reported, allow: reported}
+`
+
+func newTestMappingParser(t *testing.T) *MappingParser {
+	dir, err := ioutil.TempDir("", "xdrgw-mapping")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "mapping.yaml")
+	ioutil.WriteFile(path, []byte(mappingTestConfig), 0600)
+	parser, err := NewMappingParserFromFile(path, 0, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return parser
+}
+
+func TestMappingParser(t *testing.T) {
+	parser := newTestMappingParser(t)
+	// the payload rendered by PAN-OS from the layout must be accepted by the parser
+	payload := strings.NewReplacer(
+		"$src", "10.0.0.1", "$dst", "192.168.0.1", "$sport", "50000", "$dport", "443",
+		"$time_generated", "2021/07/01 12:00:00", "$threat_name", "Test Threat", "$severity", "critical",
+		"$action", "alert", "$rule", "outbound", "$misc", `"www.example.com/a"b"`,
+	).Replace(string(parser.DumpPayloadLayout()))
+	alert, err := parser.Parse([]byte(payload))
+	if err != nil {
+		t.Fatalf("%v (payload %v)", err, payload)
+	}
+	expected := xdrclient.Alert{
+		Product:          "PAN-OS",
+		Vendor:           "Palo Alto Networks",
+		LocalIP:          "10.0.0.1",
+		LocalPort:        50000,
+		RemoteIP:         "192.168.0.1",
+		RemotePort:       443,
+		Timestamp:        time.Date(2021, 7, 1, 12, 0, 0, 0, time.UTC).UnixNano() / int64(time.Millisecond),
+		Severity:         xdrclient.SeverityHigh,
+		AlertName:        "Test Threat",
+		AlertDescription: `www.example.com/a"b;rule=outbound`,
+		Action:           xdrclient.ActionReported,
+	}
+	if *alert != expected {
+		t.Errorf("unexpected alert %+v", alert)
+	}
+	for _, test := range []struct {
+		name     string
+		payload  string
+		severity xdrclient.Severities
+		action   xdrclient.Actions
+		fails    bool
+	}{
+		{"defaults", `{"src": "10.0.0.1", "dst": "10.0.0.2", "time_generated": "2021/07/01 12:00:00", "threat": {"severity": "bogus"}, "action": "drop"}`, xdrclient.SeverityUnknown, xdrclient.ActionBlocked, false},
+		{"numeric ports", `{"src": "10.0.0.1", "dst": "10.0.0.2", "sport": 1, "dport": 2, "time_generated": "2021/07/01 12:00:00"}`, xdrclient.SeverityUnknown, xdrclient.ActionBlocked, false},
+		{"invalid json", `{"src": `, 0, 0, true},
+		{"invalid port", `{"src": "10.0.0.1", "dst": "10.0.0.2", "sport": "http", "time_generated": "2021/07/01 12:00:00"}`, 0, 0, true},
+		{"invalid timestamp", `{"src": "10.0.0.1", "dst": "10.0.0.2", "time_generated": "yesterday"}`, 0, 0, true},
+		{"invalid address", `{"src": "host", "dst": "10.0.0.2", "time_generated": "2021/07/01 12:00:00"}`, 0, 0, true},
+	} {
+		alert, err := parser.Parse([]byte(test.payload))
+		if test.fails {
+			if err == nil {
+				t.Errorf("%v: expected error, got %+v", test.name, alert)
+			}
+			continue
+		}
+		if err != nil || alert.Severity != test.severity || alert.Action != test.action {
+			t.Errorf("%v: unexpected alert %+v (%v)", test.name, alert, err)
+		}
+	}
+}
+
+func TestNewMappingParser(t *testing.T) {
+	valid := func() *MappingConfig {
+		return &MappingConfig{
+			Payload: []*MappingField{
+				{Path: "ts", Variable: "$time_generated"},
+				{Path: "src", Variable: "$src"},
+				{Path: "misc", Variable: "$misc", Annex: true},
+			},
+			Timestamp:       "ts",
+			TimestampLayout: MappingAutoTimestamp,
+			LocalIP:         "src",
+			Description:     "{{.misc}}",
+		}
+	}
+	for _, test := range []struct {
+		name   string
+		modify func(c *MappingConfig)
+		fails  bool
+	}{
+		{"valid", func(c *MappingConfig) {}, false},
+		{"duplicated path", func(c *MappingConfig) { c.Payload = append(c.Payload, &MappingField{Path: "src", Variable: "$dst"}) }, true},
+		{"missing variable", func(c *MappingConfig) { c.Payload = append(c.Payload, &MappingField{Path: "dst"}) }, true},
+		{"two annex fields", func(c *MappingConfig) {
+			c.Payload = append(c.Payload, &MappingField{Path: "rule", Variable: "$rule", Annex: true})
+		}, true},
+		{"undeclared mapping", func(c *MappingConfig) { c.RemoteIP = "dst" }, true},
+		{"missing timestamp", func(c *MappingConfig) { c.Timestamp = "" }, true},
+		{"missing layout", func(c *MappingConfig) { c.TimestampLayout = "" }, true},
+		{"invalid template", func(c *MappingConfig) { c.Description = "{{.misc" }, true},
+		{"undeclared template field", func(c *MappingConfig) { c.Description = "{{.rule}}" }, true},
+		{"unknown severity", func(c *MappingConfig) { c.SeverityMap = map[string]string{"critical": "urgent"} }, true},
+		{"unknown default severity", func(c *MappingConfig) { c.DefaultSeverity = "urgent" }, true},
+		{"unknown action", func(c *MappingConfig) { c.ActionMap = map[string]string{"alert": "ignored"} }, true},
+		{"unknown default action", func(c *MappingConfig) { c.DefaultAction = "ignored" }, true},
+	} {
+		config := valid()
+		test.modify(config)
+		if _, err := NewMappingParser(config, 0, false); (err != nil) != test.fails {
+			t.Errorf("%v: unexpected result %v", test.name, err)
+		}
+	}
+}
+
+func TestJSONPath(t *testing.T) {
+	var document interface{}
+	decoder := json.NewDecoder(strings.NewReader(`{"a": {"b": [10, {"c": "x"}], "t": true, "n": null}, "big": 1625140800000}`))
+	decoder.UseNumber()
+	if err := decoder.Decode(&document); err != nil {
+		t.Fatal(err)
+	}
+	for path, value := range map[string]string{
+		"a.b.0":   "10",
+		"a.b.1.c": "x",
+		"a.b.2":   "",
+		"a.b.x":   "",
+		"a.t":     "true",
+		"a.n":     "",
+		"a.b":     `[10,{"c":"x"}]`,
+		"big":     "1625140800000",
+		"a.t.x":   "",
+		"missing": "",
+	} {
+		if got := jsonPath(document, path); got != value {
+			t.Errorf("%v: unexpected value %q", path, got)
+		}
+	}
+}
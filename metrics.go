@@ -0,0 +1,370 @@
+package xdrgateway
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/xhoms/xdrgateway/xdrclient"
+)
+
+const (
+	metricsPrefix      = "xdrgw_"
+	outcomeSuccess     = "success"
+	outcomeFailure     = "failure"
+	outcomeThrottled   = "throttled"
+	metricsContentType = "text/plain; version=0.0.4; charset=utf-8"
+)
+
+var (
+	// sendOutcomes are the outcome label values of the XDR POST histograms
+	sendOutcomes = []string{outcomeSuccess, outcomeFailure, outcomeThrottled}
+	// postLatencyBuckets upper bounds (in seconds) of the XDR POST latency histogram
+	postLatencyBuckets = []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30}
+	// batchSizeBuckets upper bounds of the XDR POST batch size histogram (UPDATE_SIZE defaults to 60)
+	batchSizeBuckets = []float64{1, 5, 10, 20, 30, 40, 50, 60, 100}
+)
+
+// histogram is a Prometheus-like cumulative histogram safe for concurrent use. Observations are integers in the
+// unit of scale (i.e. nanoseconds with a 1e9 scale to report seconds)
+type histogram struct {
+	bounds  []float64
+	scale   float64
+	buckets []uint64
+	count   uint64
+	sum     uint64
+}
+
+func newHistogram(bounds []float64, scale float64) *histogram {
+	return &histogram{
+		bounds:  bounds,
+		scale:   scale,
+		buckets: make([]uint64, len(bounds)),
+	}
+}
+
+func (h *histogram) observe(value uint64) {
+	scaled := float64(value) / h.scale
+	for idx, bound := range h.bounds {
+		if scaled <= bound {
+			atomic.AddUint64(&h.buckets[idx], 1)
+			break
+		}
+	}
+	atomic.AddUint64(&h.sum, value)
+	atomic.AddUint64(&h.count, 1)
+}
+
+// sendHistograms holds the XDR POST latency and batch size histograms of a pipe by outcome
+type sendHistograms struct {
+	latency    map[string]*histogram
+	batchSizes map[string]*histogram
+}
+
+func newSendHistograms() (h *sendHistograms) {
+	h = &sendHistograms{
+		latency:    make(map[string]*histogram, len(sendOutcomes)),
+		batchSizes: make(map[string]*histogram, len(sendOutcomes)),
+	}
+	for _, outcome := range sendOutcomes {
+		h.latency[outcome] = newHistogram(postLatencyBuckets, float64(time.Second))
+		h.batchSizes[outcome] = newHistogram(batchSizeBuckets, 1)
+	}
+	return
+}
+
+func (h *sendHistograms) observe(elapsed time.Duration, size int, err error) {
+	outcome := outcomeSuccess
+	if err != nil {
+		outcome = outcomeFailure
+		var httpErr *xdrclient.HTTPError
+		if errors.As(err, &httpErr) && httpErr.Throttled() {
+			outcome = outcomeThrottled
+		}
+	}
+	h.latency[outcome].observe(uint64(elapsed))
+	h.batchSizes[outcome].observe(uint64(size))
+}
+
+// SetMetricsToken protects HandlerMetrics with a token (sent as `Authorization: Bearer <token>` or the raw value)
+// independent of the ingestion PSK. Metrics are public if token is empty
+func (a *API) SetMetricsToken(token string) {
+	a.metricsToken = token
+}
+
+func (a *API) metricsAuth(h http.Header) bool {
+	if a.metricsToken == "" {
+		return true
+	}
+	auth := h.Get("Authorization")
+	return tokenEqual(auth, a.metricsToken) || tokenEqual(auth, "Bearer "+a.metricsToken)
+}
+
+// HandlerMetrics http.HandleFunc compatible handler that exposes the runtime statistics in the Prometheus text
+// exposition format
+func (a *API) HandlerMetrics(w http.ResponseWriter, r *http.Request) {
+	buff := new(bytes.Buffer)
+	if _, err := buff.ReadFrom(r.Body); err == nil {
+		r.Body.Close()
+	}
+	if !a.metricsAuth(r.Header) {
+		log.Println("api error - invalid metrics token")
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	w.Header().Set("Content-Type", metricsContentType)
+	if err := a.writeMetrics(w); err != nil {
+		log.Println("api error -", err)
+	}
+	return
+}
+
+// metricsRoute is the snapshot of a delivery path labelled with its tenant name
+type metricsRoute struct {
+	tenant string
+	stats  *TenantStats
+	route  *route
+}
+
+func (a *API) writeMetrics(out io.Writer) error {
+	stats := a.Stats()
+	routes := []*metricsRoute{{tenant: defaultRouteName, stats: a.route.tenantStats(), route: a.route}}
+	for _, route := range a.tenants {
+		routes = append(routes, &metricsRoute{tenant: route.name, stats: stats.Tenants[route.name], route: route})
+	}
+	m := newMetricsWriter(out)
+
+	m.family("events_received_total", "counter", "Events received by the ingestion endpoints and listeners")
+	m.sample("events_received_total", stats.EventsReceived)
+	m.family("parse_errors_total", "counter", "Events that failed to be parsed")
+	m.sample("parse_errors_total", stats.ParseErrors)
+	m.family("psk_errors_total", "counter", "Requests rejected due to PSK mismatch")
+	m.sample("psk_errors_total", stats.PSKErrors)
+	m.family("client_cert_denials_total", "counter", "Requests rejected by the client certificate authentication by reason")
+	m.sample("client_cert_denials_total", stats.ClientCertDenials.MissingCertificate, "reason", denialMissingCertificate)
+	m.sample("client_cert_denials_total", stats.ClientCertDenials.UntrustedCertificate, "reason", denialUntrustedCertificate)
+	m.sample("client_cert_denials_total", stats.ClientCertDenials.UnknownIdentity, "reason", denialUnknownIdentity)
+	m.sample("client_cert_denials_total", stats.ClientCertDenials.SerialMismatch, "reason", denialSerialMismatch)
+	if len(stats.Credentials) > 0 {
+		credentials := make([]string, 0, len(stats.Credentials))
+		for name := range stats.Credentials {
+			credentials = append(credentials, name)
+		}
+		sort.Strings(credentials)
+		m.family("credential_events_total", "counter", "Events pushed with each credential")
+		for _, name := range credentials {
+			m.sample("credential_events_total", stats.Credentials[name].EventsReceived, "credential", name)
+		}
+		m.family("credential_auth_failures_total", "counter", "Requests or alerts rejected by the restrictions of each credential")
+		for _, name := range credentials {
+			m.sample("credential_auth_failures_total", stats.Credentials[name].AuthFailures, "credential", name)
+		}
+	}
+	names := make([]string, 0, len(stats.Parsers))
+	for name := range stats.Parsers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	m.family("parser_events_total", "counter", "Events received by each parser by outcome")
+	for _, name := range names {
+		parser := stats.Parsers[name]
+		m.sample("parser_events_total", parser.EventsReceived-parser.ParseErrors, "parser", name, "outcome", outcomeSuccess)
+		m.sample("parser_events_total", parser.ParseErrors, "parser", name, "outcome", outcomeFailure)
+	}
+	m.family("alerts_filtered_total", "counter", "Parsed alerts dropped by the filter chain")
+	m.sample("alerts_filtered_total", stats.AlertsFiltered)
+	if len(stats.FilterRules) > 0 {
+		m.family("filter_rule_hits_total", "counter", "Hits of each filter rule")
+		for _, rule := range stats.FilterRules {
+			m.sample("filter_rule_hits_total", rule.Hits, "rule", rule.Name)
+		}
+	}
+	m.family("alerts_folded_total", "counter", "Alerts folded into another one by the aggregation stage")
+	m.sample("alerts_folded_total", stats.AlertsFolded)
+	m.family("alerts_aggregated_total", "counter", "Alerts emitted by the aggregation stage summarizing more than one alert")
+	m.sample("alerts_aggregated_total", stats.AlertsAggregated)
+	m.family("aggregation_groups", "gauge", "Aggregation groups currently open")
+	m.sample("aggregation_groups", stats.AggregationGroups)
+	m.family("syslog_messages_total", "counter", "Messages received by the syslog listeners")
+	m.sample("syslog_messages_total", stats.SyslogMessages)
+	m.family("syslog_errors_total", "counter", "Syslog connection or read errors")
+	m.sample("syslog_errors_total", stats.SyslogErrors)
+	m.family("syslog_denied_total", "counter", "Syslog messages dropped as their source address is not allowed")
+	m.sample("syslog_denied_total", stats.SyslogDenied)
+
+	m.family("events_routed_total", "counter", "Alerts routed to each tenant")
+	m.each(routes, "events_routed_total", func(r *metricsRoute) interface{} { return r.stats.EventsRouted })
+	m.family("xdr_posts_total", "counter", "POSTs to the XDR alert ingestion API by outcome")
+	for _, r := range routes {
+		m.sample("xdr_posts_total", r.stats.POSTSend, "tenant", r.tenant, "outcome", outcomeSuccess)
+		m.sample("xdr_posts_total", r.stats.POSTFailures, "tenant", r.tenant, "outcome", outcomeFailure)
+	}
+	m.family("xdr_posts_throttled_total", "counter", "POSTs rejected by the XDR alert ingestion API due to rate limiting (included in the failures)")
+	m.each(routes, "xdr_posts_throttled_total", func(r *metricsRoute) interface{} { return r.stats.POSTThrottled })
+	m.family("pipe_in_total", "counter", "Alerts that entered the pipe (accepted) or were discarded (rejected)")
+	for _, r := range routes {
+		m.sample("pipe_in_total", r.stats.PipeIn, "tenant", r.tenant, "outcome", "accepted")
+		m.sample("pipe_in_total", r.stats.PipeInErr, "tenant", r.tenant, "outcome", "rejected")
+	}
+	m.family("pipe_out_total", "counter", "Alerts delivered by the pipe by outcome")
+	for _, r := range routes {
+		m.sample("pipe_out_total", r.stats.PipeOut, "tenant", r.tenant, "outcome", outcomeSuccess)
+		m.sample("pipe_out_total", r.stats.PipeOutErr, "tenant", r.tenant, "outcome", outcomeFailure)
+	}
+	for _, counter := range []struct {
+		name, help string
+		value      func(s *TenantStats) uint64
+	}{
+		{"throttle_events_total", "XDR updates rejected due to rate limiting", func(s *TenantStats) uint64 { return s.ThrottleEvents }},
+		{"pipe_flushed_total", "Alerts delivered while shutting down the pipe", func(s *TenantStats) uint64 { return s.PipeFlushed }},
+		{"pipe_retried_total", "Alerts sent again after a failed XDR update", func(s *TenantStats) uint64 { return s.PipeRetried }},
+		{"pipe_recovered_total", "Alerts delivered after being retried", func(s *TenantStats) uint64 { return s.PipeRecovered }},
+		{"pipe_abandoned_total", "Alerts dropped after exhausting all retries", func(s *TenantStats) uint64 { return s.PipeAbandoned }},
+		{"dead_letters_dropped_total", "Dead letters removed to keep the store within its max size", func(s *TenantStats) uint64 { return s.DeadLetterDropped }},
+		{"dead_letters_reinjected_total", "Dead letters injected back into the pipe", func(s *TenantStats) uint64 { return s.DeadLetterReinjected }},
+		{"blocked_ingestions_total", "Ingestions that had to wait for room in the buffer", func(s *TenantStats) uint64 { return s.BlockedIngestions }},
+		{"block_timeouts_total", "Alerts discarded after waiting too long for room in the buffer", func(s *TenantStats) uint64 { return s.BlockTimeouts }},
+		{"queue_replayed_total", "Alerts recovered from the persistent queue after a restart", func(s *TenantStats) uint64 { return s.QueueReplayed }},
+	} {
+		value := counter.value
+		m.family(counter.name, "counter", counter.help)
+		m.each(routes, counter.name, func(r *metricsRoute) interface{} { return value(r.stats) })
+	}
+	m.family("dropped_total", "counter", "Alerts discarded by the overflow policy")
+	for _, r := range routes {
+		m.sample("dropped_total", r.stats.DroppedNewest, "tenant", r.tenant, "policy", "newest")
+		m.sample("dropped_total", r.stats.DroppedOldest, "tenant", r.tenant, "policy", "oldest")
+		m.sample("dropped_total", r.stats.DroppedLowest, "tenant", r.tenant, "policy", "lowest")
+	}
+	m.family("queue_drops_total", "counter", "Alerts discarded from the buffer by severity")
+	for _, r := range routes {
+		m.severities("queue_drops_total", r.tenant, &r.stats.QueueDrops)
+	}
+	m.family("sink_batches_total", "counter", "Batches delivered to each sink by outcome")
+	for _, r := range routes {
+		for _, sink := range r.stats.Sinks {
+			m.sample("sink_batches_total", sink.Batches, "tenant", r.tenant, "sink", sink.Name, "outcome", outcomeSuccess)
+			m.sample("sink_batches_total", sink.Failures, "tenant", r.tenant, "sink", sink.Name, "outcome", outcomeFailure)
+			if sink != r.stats.Sinks[0] {
+				m.sample("sink_batches_total", sink.Dropped, "tenant", r.tenant, "sink", sink.Name, "outcome", "dropped")
+			}
+		}
+	}
+	m.family("archive_failures_total", "counter", "Batches that failed to be delivered to or were dropped by the archive sinks")
+	m.each(routes, "archive_failures_total", func(r *metricsRoute) interface{} { return r.stats.ArchiveFailures })
+	m.family("sink_alerts_total", "counter", "Alerts delivered to each sink")
+	for _, r := range routes {
+		for _, sink := range r.stats.Sinks {
+			m.sample("sink_alerts_total", sink.Alerts, "tenant", r.tenant, "sink", sink.Name)
+		}
+	}
+
+	m.family("queue_depth", "gauge", "Alerts waiting in the buffer by severity")
+	for _, r := range routes {
+		m.severities("queue_depth", r.tenant, &r.stats.QueueDepth)
+	}
+	m.family("quota_remaining", "gauge", "Alerts that can still be sent to XDR in the current quota period")
+	m.each(routes, "quota_remaining", func(r *metricsRoute) interface{} { return r.stats.QuotaRemaining })
+	m.family("effective_quota", "gauge", "Current size of the quota bucket (shrinks when XDR throttles the pipe)")
+	m.each(routes, "effective_quota", func(r *metricsRoute) interface{} { return r.stats.EffectiveQuota })
+	m.family("dead_letters", "gauge", "Undeliverable alerts held in the dead-letter store")
+	m.each(routes, "dead_letters", func(r *metricsRoute) interface{} { return r.stats.DeadLetters })
+	m.family("dead_letter_bytes", "gauge", "Bytes held on disk by the dead-letter store")
+	m.each(routes, "dead_letter_bytes", func(r *metricsRoute) interface{} { return r.stats.DeadLetterBytes })
+	m.family("queue_bytes", "gauge", "Bytes held on disk by the persistent queue")
+	m.each(routes, "queue_bytes", func(r *metricsRoute) interface{} { return r.stats.QueueBytes })
+	m.family("queue_segments", "gauge", "Segment files held on disk by the persistent queue")
+	m.each(routes, "queue_segments", func(r *metricsRoute) interface{} { return r.stats.QueueSegments })
+
+	m.family("xdr_post_duration_seconds", "histogram", "Latency of the batches delivered to the primary sink (XDR POST)")
+	for _, r := range routes {
+		for _, outcome := range sendOutcomes {
+			m.histogram("xdr_post_duration_seconds", r.route.pipe.histograms.latency[outcome], "tenant", r.tenant, "outcome", outcome)
+		}
+	}
+	m.family("xdr_post_batch_size", "histogram", "Alerts in each batch delivered to the primary sink (XDR POST)")
+	for _, r := range routes {
+		for _, outcome := range sendOutcomes {
+			m.histogram("xdr_post_batch_size", r.route.pipe.histograms.batchSizes[outcome], "tenant", r.tenant, "outcome", outcome)
+		}
+	}
+	return m.flush()
+}
+
+// metricsWriter renders metric families in the Prometheus text exposition format
+type metricsWriter struct {
+	out *bufio.Writer
+}
+
+func newMetricsWriter(out io.Writer) *metricsWriter {
+	return &metricsWriter{out: bufio.NewWriter(out)}
+}
+
+func (m *metricsWriter) family(name, kind, help string) {
+	fmt.Fprintf(m.out, "# HELP %v%v %v\n# TYPE %v%v %v\n", metricsPrefix, name, help, metricsPrefix, name, kind)
+}
+
+// sample writes a sample of the metric. labels are name and value pairs
+func (m *metricsWriter) sample(name string, value interface{}, labels ...string) {
+	m.out.WriteString(metricsPrefix + name)
+	if len(labels) > 1 {
+		pairs := make([]string, 0, len(labels)/2)
+		for idx := 0; idx+1 < len(labels); idx += 2 {
+			pairs = append(pairs, labels[idx]+"="+metricsLabelValue(labels[idx+1]))
+		}
+		m.out.WriteString("{" + strings.Join(pairs, ",") + "}")
+	}
+	fmt.Fprintf(m.out, " %v\n", value)
+}
+
+// each writes a sample labelled with the tenant for each route
+func (m *metricsWriter) each(routes []*metricsRoute, name string, value func(r *metricsRoute) interface{}) {
+	for _, r := range routes {
+		m.sample(name, value(r), "tenant", r.tenant)
+	}
+}
+
+func (m *metricsWriter) severities(name, tenant string, counters *SeverityCounters) {
+	for _, severity := range []struct {
+		label string
+		value uint64
+	}{
+		{"high", counters.High},
+		{"medium", counters.Medium},
+		{"low", counters.Low},
+		{"informational", counters.Informational},
+		{"unknown", counters.Unknown},
+	} {
+		m.sample(name, severity.value, "tenant", tenant, "severity", severity.label)
+	}
+}
+
+func (m *metricsWriter) histogram(name string, h *histogram, labels ...string) {
+	var cumulative uint64
+	for idx, bound := range h.bounds {
+		cumulative += atomic.LoadUint64(&h.buckets[idx])
+		m.sample(name+"_bucket", cumulative, append(labels, "le", strconv.FormatFloat(bound, 'g', -1, 64))...)
+	}
+	count := atomic.LoadUint64(&h.count)
+	m.sample(name+"_bucket", count, append(labels, "le", "+Inf")...)
+	m.sample(name+"_sum", strconv.FormatFloat(float64(atomic.LoadUint64(&h.sum))/h.scale, 'g', -1, 64), labels...)
+	m.sample(name+"_count", count, labels...)
+}
+
+func (m *metricsWriter) flush() error {
+	return m.out.Flush()
+}
+
+// metricsLabelValue quotes a label value escaping backslashes, double quotes and line feeds
+func metricsLabelValue(value string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value) + `"`
+}
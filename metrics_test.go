@@ -0,0 +1,129 @@
+package xdrgateway
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/xhoms/xdrgateway/xdrclient"
+)
+
+func TestHandlerMetrics(t *testing.T) {
+	api := newTestAPI()
+	defer api.Close()
+	api.SetMetricsToken("scraper")
+	for n := 0; n < 3; n++ {
+		request := httptest.NewRequest(http.MethodPost, "/in", bytes.NewReader(basicTestEvent(n)))
+		request.Header.Set("Authorization", "psk")
+		api.HandlerIngestion(httptest.NewRecorder(), request)
+	}
+	api.route.pipe.histograms.observe(300*time.Millisecond, 3, nil)
+	api.route.pipe.histograms.observe(time.Second, 60, &xdrclient.HTTPError{StatusCode: http.StatusTooManyRequests})
+
+	for _, auth := range []string{"", "psk", "Bearer psk", "scrape", "Bearer scraper2"} {
+		request := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+		request.Header.Set("Authorization", auth)
+		recorder := httptest.NewRecorder()
+		api.HandlerMetrics(recorder, request)
+		if recorder.Code != http.StatusUnauthorized {
+			t.Errorf("authorization %q: unexpected status %v", auth, recorder.Code)
+		}
+	}
+	request := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+	request.Header.Set("Authorization", "Bearer scraper")
+	recorder := httptest.NewRecorder()
+	api.HandlerMetrics(recorder, request)
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("unexpected status %v", recorder.Code)
+	}
+	body := recorder.Body.String()
+	for _, line := range []string{
+		`# TYPE xdrgw_events_received_total counter`,
+		`xdrgw_parser_events_total{parser="default",outcome="success"} 3`,
+		`xdrgw_parser_events_total{parser="default",outcome="failure"} 0`,
+		`xdrgw_events_routed_total{tenant="default"} 3`,
+		`# TYPE xdrgw_queue_depth gauge`,
+		`# TYPE xdrgw_quota_remaining gauge`,
+		`# TYPE xdrgw_xdr_post_duration_seconds histogram`,
+		`xdrgw_xdr_post_duration_seconds_bucket{tenant="default",outcome="success",le="0.25"} 0`,
+		`xdrgw_xdr_post_duration_seconds_bucket{tenant="default",outcome="success",le="0.5"} 1`,
+		`xdrgw_xdr_post_duration_seconds_bucket{tenant="default",outcome="success",le="+Inf"} 1`,
+		`xdrgw_xdr_post_duration_seconds_sum{tenant="default",outcome="success"} 0.3`,
+		`xdrgw_xdr_post_batch_size_bucket{tenant="default",outcome="throttled",le="50"} 0`,
+		`xdrgw_xdr_post_batch_size_bucket{tenant="default",outcome="throttled",le="60"} 1`,
+		`xdrgw_xdr_post_batch_size_count{tenant="default",outcome="throttled"} 1`,
+	} {
+		if !strings.Contains(body, line+"\n") {
+			t.Errorf("missing line %v", line)
+		}
+	}
+	// all the samples of a metric family must be grouped after its TYPE line
+	seen := make(map[string]bool)
+	var current string
+	for _, line := range strings.Split(strings.TrimSpace(body), "\n") {
+		if strings.HasPrefix(line, "# TYPE ") {
+			current = strings.Fields(line)[2]
+			if seen[current] {
+				t.Errorf("duplicated family %v", current)
+			}
+			seen[current] = true
+			continue
+		}
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+		if name := strings.FieldsFunc(line, func(r rune) bool { return r == '{' || r == ' ' })[0]; !strings.HasPrefix(name, current) {
+			t.Errorf("sample %v outside of its family (%v)", name, current)
+		}
+	}
+}
+
+func TestHandlerMetricsDiskQueue(t *testing.T) {
+	dir, err := ioutil.TempDir("", "xdrgw-queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ops := testPipeOps(100, 0)
+	ops.QueueDir = dir
+	api := NewAPI(NewBasicParser(0, false), discardSink{}, "psk", false, ops)
+	defer api.Close()
+	api.SetMetricsToken("scraper")
+	for n := 0; n < 3; n++ {
+		request := httptest.NewRequest(http.MethodPost, "/in", bytes.NewReader(basicTestEvent(n)))
+		request.Header.Set("Authorization", "psk")
+		api.HandlerIngestion(httptest.NewRecorder(), request)
+	}
+	for _, test := range []struct {
+		name  string
+		lines []string
+	}{
+		{"queued", []string{
+			`xdrgw_queue_depth{tenant="default",severity="high"} 2`,
+			`xdrgw_queue_depth{tenant="default",severity="low"} 1`,
+		}},
+		{"drained", []string{
+			`xdrgw_queue_depth{tenant="default",severity="high"} 0`,
+			`xdrgw_queue_depth{tenant="default",severity="low"} 0`,
+			`xdrgw_queue_drops_total{tenant="default",severity="high"} 0`,
+		}},
+	} {
+		if test.name == "drained" {
+			api.route.pipe.drain()
+		}
+		request := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+		request.Header.Set("Authorization", "Bearer scraper")
+		recorder := httptest.NewRecorder()
+		api.HandlerMetrics(recorder, request)
+		for _, line := range test.lines {
+			if !strings.Contains(recorder.Body.String(), line+"\n") {
+				t.Errorf("%v: missing line %v", test.name, line)
+			}
+		}
+	}
+}
@@ -0,0 +1,101 @@
+package xdrgateway
+
+import (
+	"errors"
+	"sync/atomic"
+	"time"
+
+	"github.com/xhoms/xdrgateway/xdrclient"
+)
+
+// OverflowPolicy defines what the pipe does with new alerts when its buffer is full
+type OverflowPolicy string
+
+const (
+	// OverflowDropNewest discards the new alert (default)
+	OverflowDropNewest OverflowPolicy = "drop-newest"
+	// OverflowDropOldest discards the alert that has been waiting the longest in the buffer to make room for the new one
+	OverflowDropOldest OverflowPolicy = "drop-oldest"
+	// OverflowDropLowest discards the oldest alert with the lowest severity in the buffer (or the new alert if it is the least severe one)
+	OverflowDropLowest OverflowPolicy = "drop-lowest-severity"
+	// OverflowBlock waits up to the overflow timeout for room in the buffer before discarding the new alert
+	OverflowBlock   OverflowPolicy = "block"
+	overflowTimeout                = 2
+)
+
+var (
+	// ErrPipeFull is returned when an alert is not accepted because the pipe buffer is full
+	ErrPipeFull = errors.New("pipe buffer full")
+	// ErrPipeClosed is returned when an alert is not accepted because the pipe is shutting down
+	ErrPipeClosed = errors.New("pipe closed")
+)
+
+// evict makes room in a full priorityQueue for the incoming alert according to the overflow policy.
+// Returns false if the incoming alert must be discarded instead. Must be called with the queue lock held
+func (q *priorityQueue) evict(incoming *xdrclient.Alert) bool {
+	var victim *alertFIFO
+	switch q.overflow {
+	case OverflowDropOldest:
+		var oldest time.Time
+		for _, severity := range severityPriority {
+			if tier := q.tiers[severity]; tier.len() > 0 && (victim == nil || tier.peek().since.Before(oldest)) {
+				victim, oldest = tier, tier.peek().since
+			}
+		}
+	case OverflowDropLowest:
+		for idx := len(severityPriority) - 1; idx >= 0; idx-- {
+			if tier := q.tiers[severityPriority[idx]]; tier.len() > 0 {
+				if priority(severityPriority[idx]) < priority(incoming.Severity) {
+					// incoming alert is less severe than anything in the buffer
+					atomic.AddUint64(&q.stats.DroppedLowest, 1)
+					return false
+				}
+				victim = tier
+				break
+			}
+		}
+	default:
+		return false
+	}
+	if victim == nil {
+		return false
+	}
+	alert := victim.pop().alert
+	q.size--
+	atomic.AddUint64(q.stats.QueueDepth.counter(alert.Severity), ^uint64(0))
+	atomic.AddUint64(q.stats.QueueDrops.counter(alert.Severity), 1)
+	atomic.AddUint64(&q.stats.PipeInErr, 1)
+	if q.overflow == OverflowDropOldest {
+		atomic.AddUint64(&q.stats.DroppedOldest, 1)
+	} else {
+		atomic.AddUint64(&q.stats.DroppedLowest, 1)
+	}
+	return true
+}
+
+// priority returns the position of the severity in severityPriority (lower is more urgent)
+func priority(severity xdrclient.Severities) int {
+	for idx, candidate := range severityPriority {
+		if candidate == severity {
+			return idx
+		}
+	}
+	return priority(xdrclient.SeverityUnknown)
+}
+
+// roomSignal returns a channel that will be closed the next time the sender goroutine frees room in the buffer and
+// whether the pipe has been closed
+func (a *alertPipe) roomSignal() (room chan struct{}, closed bool) {
+	a.roomMu.Lock()
+	room, closed = a.room, a.closed
+	a.roomMu.Unlock()
+	return
+}
+
+// notifyRoom wakes up all ingestions blocked waiting for room in the buffer
+func (a *alertPipe) notifyRoom() {
+	a.roomMu.Lock()
+	close(a.room)
+	a.room = make(chan struct{})
+	a.roomMu.Unlock()
+}
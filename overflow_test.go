@@ -0,0 +1,102 @@
+package xdrgateway
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/xhoms/xdrgateway/xdrclient"
+)
+
+func TestOverflowEvict(t *testing.T) {
+	high, medium, low, info := xdrclient.SeverityHigh, xdrclient.SeverityMedium, xdrclient.SeverityLow, xdrclient.SeverityInfo
+	for _, test := range []struct {
+		name     string
+		overflow OverflowPolicy
+		buffered []xdrclient.Severities
+		incoming xdrclient.Severities
+		pushed   bool
+		popped   string
+	}{
+		{"drop-newest", OverflowDropNewest, []xdrclient.Severities{high, low, medium}, high, false, "acb"},
+		{"block", OverflowBlock, []xdrclient.Severities{high, low, medium}, high, false, "acb"},
+		{"drop-oldest", OverflowDropOldest, []xdrclient.Severities{low, high, high}, medium, true, "bcd"},
+		{"drop-oldest regardless of severity", OverflowDropOldest, []xdrclient.Severities{high, low, high}, low, true, "cbd"},
+		{"drop-lowest", OverflowDropLowest, []xdrclient.Severities{low, info, high}, medium, true, "cda"},
+		{"drop-lowest same severity", OverflowDropLowest, []xdrclient.Severities{low, low, high}, low, true, "cbd"},
+		{"drop-lowest incoming", OverflowDropLowest, []xdrclient.Severities{medium, high, medium}, low, false, "bac"},
+	} {
+		stats := &PipeStats{}
+		queue := newPriorityQueue(len(test.buffered), 0, test.overflow, stats)
+		for idx, severity := range test.buffered {
+			queue.push(testAlert(string(rune('a'+idx)), severity))
+			// eviction by age needs distinct timestamps
+			time.Sleep(time.Millisecond)
+		}
+		if pushed := queue.push(testAlert("d", test.incoming)); pushed != test.pushed {
+			t.Errorf("%v: pushed %v", test.name, pushed)
+		}
+		popped := ""
+		for alert := queue.pop(); alert != nil; alert = queue.pop() {
+			popped += alert.AlertName
+		}
+		if popped != test.popped {
+			t.Errorf("%v: popped %q", test.name, popped)
+		}
+		snapshot := stats.Snapshot()
+		if dropped := snapshot.DroppedOldest + snapshot.DroppedLowest; (dropped == 1) != (test.overflow == OverflowDropOldest || test.overflow == OverflowDropLowest) {
+			t.Errorf("%v: unexpected drop counters %+v", test.name, snapshot)
+		}
+	}
+}
+
+func TestPipeOverflow(t *testing.T) {
+	dir, err := ioutil.TempDir("", "xdrgw-overflow")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, test := range []struct {
+		name      string
+		overflow  OverflowPolicy
+		queueDir  string
+		effective OverflowPolicy
+	}{
+		{"default", "", "", OverflowDropNewest},
+		{"unknown", "drop-random", "", OverflowDropNewest},
+		{"memory drop-oldest", OverflowDropOldest, "", OverflowDropOldest},
+		{"disk drop-oldest", OverflowDropOldest, dir, OverflowDropNewest},
+		{"disk drop-lowest", OverflowDropLowest, dir, OverflowDropNewest},
+		{"disk block", OverflowBlock, dir, OverflowBlock},
+	} {
+		ops := testPipeOps(10, 0)
+		ops.Overflow, ops.QueueDir = test.overflow, test.queueDir
+		pipe := newAlertPipe([]Sink{&recordingSink{}}, ops)
+		if pipe.overflow != test.effective {
+			t.Errorf("%v: effective policy %v", test.name, pipe.overflow)
+		}
+		pipe.close()
+	}
+}
+
+func TestPipeOpsOverflowFromEnv(t *testing.T) {
+	for _, test := range []struct {
+		overflow, queueDir string
+		fails              bool
+	}{
+		{"drop-oldest", "", false},
+		{"drop-lowest-severity", "", false},
+		{"drop-newest", "/var/lib/xdrgw", false},
+		{"block", "/var/lib/xdrgw", false},
+		{"drop-oldest", "/var/lib/xdrgw", true},
+		{"drop-lowest-severity", "/var/lib/xdrgw", true},
+	} {
+		t.Setenv("OVERFLOW_POLICY", test.overflow)
+		t.Setenv("QUEUE_DIR", test.queueDir)
+		ops, err := NewPipeOpsFromEnv()
+		if test.fails != (err != nil) || ops.Overflow != OverflowPolicy(test.overflow) {
+			t.Errorf("%v (%q): unexpected options %+v (%v)", test.overflow, test.queueDir, ops, err)
+		}
+	}
+}
@@ -1,9 +1,12 @@
 package xdrgateway
 
 import (
+	"bytes"
 	"encoding/json"
+	"fmt"
 	"log"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/xhoms/xdrgateway/xdrclient"
@@ -22,13 +25,20 @@ const (
 )
 
 var (
-	defaultLocation    = time.FixedZone("XGW", 0)
-	basicPayloadLayout = []byte(`{
+	defaultLocation = time.FixedZone("XGW", 0)
+	// basicEvents recycles the decoding structs of BasicParser (Parse is called from many goroutines at once)
+	basicEvents = sync.Pool{
+		New: func() interface{} { return new(basicParserJSON) },
+	}
+	annexSeparatorBytes = []byte(annexSeparator)
+	basicPayloadLayout  = []byte(`{
 	"src": "$src",
 	"sport": $sport,
 	"dst": "$dst",
 	"dport": $dport,
 	"time_generated": "$time_generated",
+	"high_res_timestamp": "$high_res_timestamp",
+	"receive_time": "$receive_time",
 	"rule": "$rule",
 	"serial": "$serial",
 	"sender_sw_version": "$sender_sw_version",
@@ -48,6 +58,8 @@ type basicParserJSON struct {
 	Dst        string `json:"dst"`
 	Dport      int    `json:"dport"`
 	Timestamp  string `json:"time_generated"`
+	HighRes    string `json:"high_res_timestamp"`
+	Received   string `json:"receive_time"`
 	Rule       string `json:"rule"`
 	Serial     string `json:"serial"`
 	SWVersion  string `json:"sender_sw_version"`
@@ -58,12 +70,13 @@ type basicParserJSON struct {
 	Action     string `json:"action"`
 }
 
-// BasicParser implements xdrgateway.Parser interface
+// BasicParser implements xdrgateway.Parser interface. Parse is safe for concurrent use (the setters must be called
+// before the parser starts receiving payloads)
 type BasicParser struct {
-	location        *time.Location
+	zones           *TimeZones
 	payloadLayout   []byte
 	tsLayout        string
-	event           *basicParserJSON
+	tsField         string
 	product, vendor string
 	debug           bool
 }
@@ -71,10 +84,10 @@ type BasicParser struct {
 // NewBasicParser returns a parser with TimeZone set to `offset`-hours (negative values supported)
 func NewBasicParser(offset int, debug bool) (b *BasicParser) {
 	b = &BasicParser{
-		location:      time.FixedZone("XGW", offset*60*60),
+		zones:         fixedTimeZones(offset),
 		payloadLayout: basicPayloadLayout,
 		tsLayout:      panosTSLayout,
-		event:         &basicParserJSON{},
+		tsField:       TimestampAuto,
 		product:       "PAN-OS",
 		vendor:        "Palo Alto Networks",
 		debug:         debug,
@@ -85,66 +98,122 @@ func NewBasicParser(offset int, debug bool) (b *BasicParser) {
 // Parse converts data into a XDR Alert. Return error if parsing fails
 func (b *BasicParser) Parse(data []byte) (alert *xdrclient.Alert, err error) {
 	if b.debug {
-		var glimpse string
-		if len(data) > 100 {
-			glimpse = string(data[:100]) + "..."
-		} else {
-			glimpse = string(data)
-		}
-		log.Println("basicParser - rx:", glimpse)
+		log.Println("basicParser - rx:", glimpse(data))
 	}
-	parts := strings.Split(string(data), "---annex---")
-	if err = json.Unmarshal([]byte(parts[0]), b.event); err == nil {
-		if len(parts) > 1 {
-			b.event.Misc = strings.Trim(parts[1], "\n\"")
+	document, annex := data, []byte(nil)
+	if idx := bytes.Index(data, annexSeparatorBytes); idx >= 0 {
+		document, annex = data[:idx], data[idx+len(annexSeparatorBytes):]
+	}
+	event := basicEvents.Get().(*basicParserJSON)
+	defer basicEvents.Put(event)
+	// optional fields must not keep the value of a previous payload
+	*event = basicParserJSON{}
+	if err = json.Unmarshal(document, event); err == nil {
+		if annex != nil {
+			event.Misc = string(bytes.Trim(annex, "\n\""))
 		}
 		var t time.Time
-		if t, err = time.ParseInLocation(b.tsLayout, b.event.Timestamp, b.location); err == nil {
-			var level xdrclient.Severities
-			switch b.event.Severity {
-			case "critical", "high":
-				level = xdrclient.SeverityHigh
-			case "medium":
-				level = xdrclient.SeverityMedium
-			case "informational":
-				level = xdrclient.SeverityInfo
-			case "low":
-				level = xdrclient.SeverityLow
-			default:
-				level = xdrclient.SeverityUnknown
-			}
-			alert = xdrclient.NewAlert(level, t.UnixNano()/int64(time.Millisecond))
-			alert.Product, alert.Vendor = b.product, b.vendor
-			if err = alert.NetData(b.event.Src, b.event.Dst, uint16(b.event.Sport), uint16(b.event.Dport)); err == nil {
-				var action xdrclient.Actions
-				switch b.event.Action {
-				case "alert", "allow":
-					action = xdrclient.ActionReported
-				default:
-					action = xdrclient.ActionBlocked
-				}
-				descParts := make([]string, 1, 4)
-				descParts[0] = b.event.Misc
-				if b.event.Serial != "" {
-					descParts = append(descParts, "serial="+b.event.Serial)
-				}
-				if b.event.SWVersion != "" {
-					descParts = append(descParts, "version="+b.event.SWVersion)
-				}
-				if b.event.Action != "" {
-					descParts = append(descParts, "action="+b.event.Action)
-				}
-				if b.event.Rule != "" {
-					descParts = append(descParts, "rule="+b.event.Rule)
-				}
-				if b.event.Subtype != "" {
-					descParts = append(descParts, "type="+b.event.Subtype)
-				}
-				description := strings.Join(descParts, ";")
-				name := b.event.ThreatName
-				alert.MetaData(name, description, action)
-			}
+		if t, err = b.timestamp(event); err == nil {
+			alert, err = panosAlert(event, t, b.product, b.vendor)
+		}
+	}
+	return
+}
+
+// timestamp returns the alert time from the configured field (the first one that can be parsed in auto mode)
+func (b *BasicParser) timestamp(event *basicParserJSON) (t time.Time, err error) {
+	location := b.zones.Location(event.Serial)
+	switch b.tsField {
+	case TimestampHighRes:
+		return parseTimestamp(event.HighRes, b.tsLayout, location)
+	case TimestampGenerated:
+		return parseTimestamp(event.Timestamp, b.tsLayout, location)
+	case TimestampReceived:
+		return parseTimestamp(event.Received, b.tsLayout, location)
+	}
+	err = fmt.Errorf("basicParser - missing timestamp")
+	for _, value := range []string{event.HighRes, event.Timestamp, event.Received} {
+		// unsupported PAN-OS variables (i.e. $high_res_timestamp before PAN-OS 10.0) are not replaced
+		if value == "" || strings.HasPrefix(value, "$") {
+			continue
+		}
+		if t, err = parseTimestamp(value, b.tsLayout, location); err == nil {
+			return
+		}
+	}
+	return
+}
+
+// SetTimestampField selects the payload field the alert time is taken from: TimestampAuto (default), TimestampHighRes,
+// TimestampGenerated or TimestampReceived. Epoch (seconds or milliseconds) values are supported in all of them
+func (b *BasicParser) SetTimestampField(field string) (err error) {
+	switch field {
+	case TimestampAuto, TimestampHighRes, TimestampGenerated, TimestampReceived:
+		b.tsField = field
+	default:
+		err = fmt.Errorf("unknown timestamp field %v", field)
+	}
+	return
+}
+
+// SetTimeZones replaces the fixed offset provided to the constructor with a time zone table (IANA zones and per
+// device overrides)
+func (b *BasicParser) SetTimeZones(zones *TimeZones) {
+	b.zones = zones
+}
+
+// descriptionValue replaces the `;` separators of a description part value
+func descriptionValue(value string) string {
+	return strings.Replace(value, ";", ",", -1)
+}
+
+// panosAlert maps a PAN-OS threat event into a XDR alert. Shared by all PAN-OS parsers so they produce the same
+// severity, action and description parts
+func panosAlert(event *basicParserJSON, t time.Time, product, vendor string) (alert *xdrclient.Alert, err error) {
+	var level xdrclient.Severities
+	switch event.Severity {
+	case "critical", "high":
+		level = xdrclient.SeverityHigh
+	case "medium":
+		level = xdrclient.SeverityMedium
+	case "informational":
+		level = xdrclient.SeverityInfo
+	case "low":
+		level = xdrclient.SeverityLow
+	default:
+		level = xdrclient.SeverityUnknown
+	}
+	alert = xdrclient.NewAlert(level, t.UnixNano()/int64(time.Millisecond))
+	alert.Product, alert.Vendor = product, vendor
+	if err = alert.NetData(event.Src, event.Dst, uint16(event.Sport), uint16(event.Dport)); err == nil {
+		var action xdrclient.Actions
+		switch event.Action {
+		// PAN-OS actions plus common third-party (CEF/LEEF) ones that do not block the traffic
+		case "alert", "allow", "allowed", "permit", "accept", "pass", "detect", "monitor":
+			action = xdrclient.ActionReported
+		default:
+			action = xdrclient.ActionBlocked
+		}
+		// the serial part is always added (even if empty) as it anchors the parts looked up by alertField. Their
+		// values can't contain `;` so that they can't add parts either
+		descParts := make([]string, 2, 6)
+		descParts[0] = event.Misc
+		descParts[1] = "serial=" + descriptionValue(event.Serial)
+		if event.SWVersion != "" {
+			descParts = append(descParts, "version="+descriptionValue(event.SWVersion))
+		}
+		if event.Action != "" {
+			descParts = append(descParts, "action="+descriptionValue(event.Action))
+		}
+		if event.Rule != "" {
+			descParts = append(descParts, "rule="+descriptionValue(event.Rule))
+		}
+		if event.Subtype != "" {
+			descParts = append(descParts, "type="+descriptionValue(event.Subtype))
 		}
+		description := strings.Join(descParts, ";")
+		name := event.ThreatName
+		alert.MetaData(name, description, action)
 	}
 	return
 }
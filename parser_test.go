@@ -0,0 +1,120 @@
+package xdrgateway
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+)
+
+const basicTestPayload = `{
+	"src": "%[5]v",
+	"sport": %[1]v,
+	"dst": "192.168.0.1",
+	"dport": 443,
+	"time_generated": "2021/06/01 10:00:%02[2]v",
+	"high_res_timestamp": "$high_res_timestamp",
+	"receive_time": "2021/06/01 10:00:%02[2]v",
+	"rule": "rule-%[1]v",
+	"serial": "0123456789%[1]v",
+	"sender_sw_version": "10.1.0",
+	"subtype": "vulnerability",
+	"threat_name": "threat-%[1]v",
+	"severity": "%[3]v",
+	"action": "%[4]v"
+}
+---annex---
+"misc-%[1]v"
+`
+
+func basicTestEvent(id int) []byte {
+	severity, action := "high", "alert"
+	if id%2 == 1 {
+		severity, action = "low", "drop"
+	}
+	return []byte(fmt.Sprintf(basicTestPayload, id, id%60, severity, action, basicTestIP(id)))
+}
+
+func basicTestIP(id int) string {
+	return fmt.Sprintf("10.0.%v.%v", id/256, id%256)
+}
+
+// TestBasicParserConcurrent parses distinct payloads from many goroutines with the same parser (run with -race) and
+// checks that no alert mixes fields from other payloads
+func TestBasicParserConcurrent(t *testing.T) {
+	parser := NewBasicParser(0, false)
+	var wg sync.WaitGroup
+	for worker := 0; worker < 16; worker++ {
+		wg.Add(1)
+		go func(worker int) {
+			defer wg.Done()
+			for n := 0; n < 200; n++ {
+				id := worker*200 + n
+				alert, err := parser.Parse(basicTestEvent(id))
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				if alert.LocalPort != uint16(id) || alert.LocalIP != basicTestIP(id) {
+					t.Errorf("event %v: unexpected network data %v:%v", id, alert.LocalIP, alert.LocalPort)
+				}
+				if alert.AlertName != fmt.Sprintf("threat-%v", id) {
+					t.Errorf("event %v: unexpected name %v", id, alert.AlertName)
+				}
+				if !strings.HasPrefix(alert.AlertDescription, fmt.Sprintf("misc-%v;serial=0123456789%v;", id, id)) ||
+					!strings.Contains(alert.AlertDescription, fmt.Sprintf(";rule=rule-%v;", id)) {
+					t.Errorf("event %v: unexpected description %v", id, alert.AlertDescription)
+				}
+				if want := int64(1622541600000 + (id%60)*1000); alert.Timestamp != want {
+					t.Errorf("event %v: unexpected timestamp %v (want %v)", id, alert.Timestamp, want)
+				}
+			}
+		}(worker)
+	}
+	wg.Wait()
+}
+
+// TestBasicParserOptionalFields checks that fields missing in a payload are not taken from a previous one
+func TestBasicParserOptionalFields(t *testing.T) {
+	parser := NewBasicParser(0, false)
+	if _, err := parser.Parse(basicTestEvent(1)); err != nil {
+		t.Fatal(err)
+	}
+	alert, err := parser.Parse([]byte(`{"src": "10.0.0.2", "sport": 1, "dst": "10.0.0.3", "dport": 2,
+		"time_generated": "2021/06/01 10:00:00", "threat_name": "partial"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(alert.AlertDescription, "rule-1") || strings.Contains(alert.AlertDescription, "misc-1") {
+		t.Errorf("description leaked from previous payload: %v", alert.AlertDescription)
+	}
+}
+
+func BenchmarkBasicParser(b *testing.B) {
+	parser := NewBasicParser(0, false)
+	payload := basicTestEvent(1)
+	b.ReportAllocs()
+	b.SetBytes(int64(len(payload)))
+	for n := 0; n < b.N; n++ {
+		if _, err := parser.Parse(payload); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkBasicParserParallel measures the throughput of a parser shared by concurrent ingestion requests (as
+// net/http does with HandlerIngestion)
+func BenchmarkBasicParserParallel(b *testing.B) {
+	parser := NewBasicParser(0, false)
+	payload := basicTestEvent(1)
+	b.ReportAllocs()
+	b.SetBytes(int64(len(payload)))
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			if _, err := parser.Parse(payload); err != nil {
+				b.Error(err)
+				return
+			}
+		}
+	})
+}
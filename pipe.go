@@ -1,9 +1,13 @@
 package xdrgateway
 
 import (
+	"fmt"
 	"log"
 	"os"
 	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/xhoms/xdrgateway/xdrclient"
@@ -11,13 +15,14 @@ import (
 
 const (
 	alertBufferSize  = 6000
+	shutdownTimeout  = 8
 	maxUpdate        = 60
 	t1BucketSize     = 600
 	t1BucketDuration = 60
 	t2Timeout        = 2
 )
 
-// PipeStats provides counters for the buffered Alert pipe
+// PipeStats provides counters for the buffered Alert pipe. They are updated atomically (use Snapshot to read them)
 type PipeStats struct {
 	// PipeIn is the amount of alerts that have traversed the pipe
 	PipeIn uint64
@@ -27,6 +32,89 @@ type PipeStats struct {
 	PipeOutErr uint64
 	// PipeOut is the number of valid XDR API payloads generated by the pipe
 	PipeOut uint64
+	// EffectiveQuota is the current size of the quota bucket. It shrinks when XDR throttles the pipe and grows back after successful updates
+	EffectiveQuota int64
+	// QuotaRemaining is the number of alerts that can still be sent to XDR in the current quota period
+	QuotaRemaining int64
+	// ThrottleEvents is the number of times XDR rejected an update due to rate limiting (429)
+	ThrottleEvents uint64
+	// PipeFlushed is the number of alerts delivered while shutting down the pipe
+	PipeFlushed uint64
+	// PipeRetried is the number of alerts sent again after a failed XDR update
+	PipeRetried uint64
+	// PipeRecovered is the number of alerts successfully delivered after being retried
+	PipeRecovered uint64
+	// PipeAbandoned is the number of alerts dropped after exhausting all retries
+	PipeAbandoned uint64
+	// DeadLetters is the number of undeliverable alerts held in the dead-letter store
+	DeadLetters int64
+	// DeadLetterBytes is the amount of bytes held on disk by the dead-letter store
+	DeadLetterBytes int64
+	// DeadLetterDropped is the number of dead letters removed from the store to keep it within its max size
+	DeadLetterDropped uint64
+	// DeadLetterReinjected is the number of dead letters injected back into the pipe
+	DeadLetterReinjected uint64
+	// QueueDepth is the number of alerts waiting in the buffer (in-memory or disk queue) for each severity
+	QueueDepth SeverityCounters
+	// QueueDrops is the number of alerts discarded from (or not accepted by) the buffer for each severity
+	QueueDrops SeverityCounters
+	// DroppedNewest is the number of new alerts discarded because the buffer was full (drop-newest policy)
+	DroppedNewest uint64
+	// DroppedOldest is the number of buffered alerts discarded to make room for new ones (drop-oldest policy)
+	DroppedOldest uint64
+	// DroppedLowest is the number of lowest-severity alerts discarded to make room for new ones (drop-lowest-severity policy)
+	DroppedLowest uint64
+	// BlockedIngestions is the number of ingestions that had to wait for room in the buffer (block policy)
+	BlockedIngestions uint64
+	// BlockTimeouts is the number of new alerts discarded after waiting too long for room in the buffer (block policy)
+	BlockTimeouts uint64
+	// Sinks provides counters for each sink the pipe delivers alerts to
+	Sinks []*SinkStats
+	// ArchiveFailures is the number of batches that failed to be delivered to (or were dropped by) the archive sinks
+	ArchiveFailures uint64
+	// QueueBytes is the amount of bytes held on disk by the persistent queue
+	QueueBytes int64
+	// QueueSegments is the number of segment files held on disk by the persistent queue
+	QueueSegments int64
+	// QueueReplayed is the number of alerts recovered from the persistent queue after a restart
+	QueueReplayed uint64
+}
+
+// Snapshot returns a copy of the counters that is safe to read while the pipe is in use
+func (s *PipeStats) Snapshot() (snapshot PipeStats) {
+	snapshot = PipeStats{
+		PipeIn:               atomic.LoadUint64(&s.PipeIn),
+		PipeInErr:            atomic.LoadUint64(&s.PipeInErr),
+		PipeOutErr:           atomic.LoadUint64(&s.PipeOutErr),
+		PipeOut:              atomic.LoadUint64(&s.PipeOut),
+		EffectiveQuota:       atomic.LoadInt64(&s.EffectiveQuota),
+		QuotaRemaining:       atomic.LoadInt64(&s.QuotaRemaining),
+		ThrottleEvents:       atomic.LoadUint64(&s.ThrottleEvents),
+		PipeFlushed:          atomic.LoadUint64(&s.PipeFlushed),
+		PipeRetried:          atomic.LoadUint64(&s.PipeRetried),
+		PipeRecovered:        atomic.LoadUint64(&s.PipeRecovered),
+		PipeAbandoned:        atomic.LoadUint64(&s.PipeAbandoned),
+		DeadLetters:          atomic.LoadInt64(&s.DeadLetters),
+		DeadLetterBytes:      atomic.LoadInt64(&s.DeadLetterBytes),
+		DeadLetterDropped:    atomic.LoadUint64(&s.DeadLetterDropped),
+		DeadLetterReinjected: atomic.LoadUint64(&s.DeadLetterReinjected),
+		QueueDepth:           s.QueueDepth.Snapshot(),
+		QueueDrops:           s.QueueDrops.Snapshot(),
+		DroppedNewest:        atomic.LoadUint64(&s.DroppedNewest),
+		DroppedOldest:        atomic.LoadUint64(&s.DroppedOldest),
+		DroppedLowest:        atomic.LoadUint64(&s.DroppedLowest),
+		BlockedIngestions:    atomic.LoadUint64(&s.BlockedIngestions),
+		BlockTimeouts:        atomic.LoadUint64(&s.BlockTimeouts),
+		QueueBytes:           atomic.LoadInt64(&s.QueueBytes),
+		QueueSegments:        atomic.LoadInt64(&s.QueueSegments),
+		QueueReplayed:        atomic.LoadUint64(&s.QueueReplayed),
+		ArchiveFailures:      atomic.LoadUint64(&s.ArchiveFailures),
+	}
+	for _, sink := range s.Sinks {
+		sinkStats := sink.Snapshot()
+		snapshot.Sinks = append(snapshot.Sinks, &sinkStats)
+	}
+	return
 }
 
 // AlertPipeOps options to fine-tune the pipe behavior
@@ -41,6 +129,36 @@ type AlertPipeOps struct {
 	AlertBufferSize int
 	// T1 controls how fast the pipe is polled to drain alerts (seconds)
 	T1 int
+	// Overflow policy applied to new alerts when the buffer is full (defaults to drop-newest). The persistent queue only
+	// supports drop-newest and block (NewPipeOpsFromEnv rejects the other ones)
+	Overflow OverflowPolicy
+	// OverflowTimeout max time a new alert waits for room in the buffer with the block policy (seconds)
+	OverflowTimeout int
+	// AgingSeconds time after which a buffered alert is sent ahead of more severe ones so that lower severities are not
+	// starved forever (seconds, 0 disables aging)
+	AgingSeconds int
+	// AggregationWindow time near-identical alerts are folded into a single one before entering the pipe (seconds, 0 disables aggregation)
+	AggregationWindow int
+	// AggregationKeys alert fields that identify near-identical alerts (defaults to src, dst, dport, name and action)
+	AggregationKeys []string
+	// RetryMaxAttempts max number of times a failed XDR update is attempted (0 or 1 disables retries)
+	RetryMaxAttempts int
+	// RetryMaxAge max time a failed XDR update is retried (seconds)
+	RetryMaxAge int
+	// RetryBaseDelay initial backoff between retries, doubled on each attempt (seconds)
+	RetryBaseDelay int
+	// RetryMaxDelay max backoff between retries (seconds)
+	RetryMaxDelay int
+	// QueueDir enables the persistent (disk-backed) queue using this directory to store its segment files
+	QueueDir string
+	// QueueMaxBytes max amount of disk space the persistent queue can use (defaults to 64 MiB)
+	QueueMaxBytes int64
+	// ShutdownTimeout max time the pipe keeps delivering buffered alerts when closed (seconds)
+	ShutdownTimeout int
+	// DeadLetterDir enables the dead-letter store for abandoned alerts using this directory
+	DeadLetterDir string
+	// DeadLetterMaxBytes max amount of disk space the dead-letter store can use (defaults to 64 MiB)
+	DeadLetterMaxBytes int64
 	// Debug to increase the verbosity of the pipe
 	Debug bool
 }
@@ -60,13 +178,52 @@ type AlertPipeOps struct {
 // - BUFFER_SIZE size of the pipe buffer (defaults to 6000 = 10 minutes)
 //
 // - T1 how often the pipe buffer is polled for new alerts (defaulst to 2 seconds)
-func NewPipeOpsFromEnv() (ops *AlertPipeOps) {
+//
+// - OVERFLOW_POLICY what to do with new alerts when the buffer is full: drop-newest, drop-oldest, drop-lowest-severity
+// or block (defaults to drop-newest)
+//
+// - OVERFLOW_TIMEOUT max time a new alert waits for room in the buffer with the block policy (defaults to 2 seconds)
+//
+// - AGING time after which buffered alerts are sent ahead of more severe ones (defaults to 0 = disabled)
+//
+// - AGGREGATION_WINDOW time near-identical alerts are folded into a single one (defaults to 0 = disabled)
+//
+// - AGGREGATION_KEYS comma-separated alert fields that identify near-identical alerts (defaults to src,dst,dport,name,action)
+//
+// - RETRY_MAX_ATTEMPTS max number of times a failed XDR update is attempted (defaults to 5, 1 disables retries)
+//
+// - RETRY_MAX_AGE max time a failed XDR update is retried (defaults to 600 seconds)
+//
+// - RETRY_BASE_DELAY initial backoff between retries (defaults to 2 seconds)
+//
+// - RETRY_MAX_DELAY max backoff between retries (defaults to 120 seconds)
+//
+// - SHUTDOWN_TIMEOUT max time buffered alerts keep being delivered on shutdown (defaults to 8 seconds)
+//
+// - QUEUE_DIR directory to store the persistent queue. Alerts survive restarts if set (defaults to in-memory queue)
+//
+// - QUEUE_MAX_BYTES max disk space used by the persistent queue (defaults to 64 MiB)
+//
+// - DEADLETTER_DIR directory to store alerts abandoned after exhausting all retries (defaults to none)
+//
+// - DEADLETTER_MAX_BYTES max disk space used by the dead-letter store (defaults to 64 MiB)
+//
+// Returns error if OVERFLOW_POLICY is drop-oldest or drop-lowest-severity along with QUEUE_DIR (the persistent queue
+// is strictly FIFO)
+func NewPipeOpsFromEnv() (ops *AlertPipeOps, err error) {
 	ops = &AlertPipeOps{
-		XDRUpdateSize:   maxUpdate,
-		XDRMQuotaSize:   t1BucketSize,
-		XDRQuotaSeconds: t1BucketDuration,
-		AlertBufferSize: alertBufferSize,
-		T1:              t2Timeout,
+		XDRUpdateSize:    maxUpdate,
+		XDRMQuotaSize:    t1BucketSize,
+		XDRQuotaSeconds:  t1BucketDuration,
+		AlertBufferSize:  alertBufferSize,
+		T1:               t2Timeout,
+		RetryMaxAttempts: retryMaxAttempts,
+		RetryMaxAge:      retryMaxAge,
+		RetryBaseDelay:   retryBaseDelay,
+		RetryMaxDelay:    retryMaxDelay,
+		ShutdownTimeout:  shutdownTimeout,
+		Overflow:         OverflowDropNewest,
+		OverflowTimeout:  overflowTimeout,
 	}
 	if t1, exists := os.LookupEnv("T1"); exists {
 		if intval, err := strconv.Atoi(t1); err == nil {
@@ -93,37 +250,132 @@ func NewPipeOpsFromEnv() (ops *AlertPipeOps) {
 			ops.AlertBufferSize = intval
 		}
 	}
+	if op, exists := os.LookupEnv("OVERFLOW_POLICY"); exists {
+		ops.Overflow = OverflowPolicy(op)
+	}
+	if ot, exists := os.LookupEnv("OVERFLOW_TIMEOUT"); exists {
+		if intval, err := strconv.Atoi(ot); err == nil {
+			ops.OverflowTimeout = intval
+		}
+	}
+	if ag, exists := os.LookupEnv("AGING"); exists {
+		if intval, err := strconv.Atoi(ag); err == nil {
+			ops.AgingSeconds = intval
+		}
+	}
+	if aw, exists := os.LookupEnv("AGGREGATION_WINDOW"); exists {
+		if intval, err := strconv.Atoi(aw); err == nil {
+			ops.AggregationWindow = intval
+		}
+	}
+	if ak, exists := os.LookupEnv("AGGREGATION_KEYS"); exists {
+		for _, key := range strings.Split(ak, ",") {
+			if key = strings.TrimSpace(key); key != "" {
+				ops.AggregationKeys = append(ops.AggregationKeys, key)
+			}
+		}
+	}
+	if ra, exists := os.LookupEnv("RETRY_MAX_ATTEMPTS"); exists {
+		if intval, err := strconv.Atoi(ra); err == nil {
+			ops.RetryMaxAttempts = intval
+		}
+	}
+	if ra, exists := os.LookupEnv("RETRY_MAX_AGE"); exists {
+		if intval, err := strconv.Atoi(ra); err == nil {
+			ops.RetryMaxAge = intval
+		}
+	}
+	if rd, exists := os.LookupEnv("RETRY_BASE_DELAY"); exists {
+		if intval, err := strconv.Atoi(rd); err == nil {
+			ops.RetryBaseDelay = intval
+		}
+	}
+	if rd, exists := os.LookupEnv("RETRY_MAX_DELAY"); exists {
+		if intval, err := strconv.Atoi(rd); err == nil {
+			ops.RetryMaxDelay = intval
+		}
+	}
+	if st, exists := os.LookupEnv("SHUTDOWN_TIMEOUT"); exists {
+		if intval, err := strconv.Atoi(st); err == nil {
+			ops.ShutdownTimeout = intval
+		}
+	}
+	if qd, exists := os.LookupEnv("QUEUE_DIR"); exists {
+		ops.QueueDir = qd
+	}
+	if qm, exists := os.LookupEnv("QUEUE_MAX_BYTES"); exists {
+		if intval, err := strconv.ParseInt(qm, 10, 64); err == nil {
+			ops.QueueMaxBytes = intval
+		}
+	}
+	if dd, exists := os.LookupEnv("DEADLETTER_DIR"); exists {
+		ops.DeadLetterDir = dd
+	}
+	if dm, exists := os.LookupEnv("DEADLETTER_MAX_BYTES"); exists {
+		if intval, err := strconv.ParseInt(dm, 10, 64); err == nil {
+			ops.DeadLetterMaxBytes = intval
+		}
+	}
 	if _, exists := os.LookupEnv("DEBUG"); exists {
 		ops.Debug = true
 	}
+	if ops.QueueDir != "" && (ops.Overflow == OverflowDropOldest || ops.Overflow == OverflowDropLowest) {
+		err = fmt.Errorf("overflow policy %v not supported by the persistent queue (QUEUE_DIR), use %v or %v", ops.Overflow, OverflowDropNewest, OverflowBlock)
+	}
 	return
 }
 
 type alertPipe struct {
-	client    *xdrclient.Client
-	pipe      chan *xdrclient.Alert
-	done      chan chan *PipeStats
-	doneChan  chan *PipeStats
-	buffer    []*xdrclient.Alert
-	bufferPtr int
-	t2Ticker  *time.Ticker
-	t1Ticker  *time.Ticker
-	t1Bucket  int
-	jsondata  []byte
-	err       error
-	alert     *xdrclient.Alert
-	stats     *PipeStats
-	closed    bool
-	debug     bool
+	sink            Sink
+	archives        []*archiveSink
+	archiveWG       sync.WaitGroup
+	sinkStats       []*SinkStats
+	queue           alertQueue
+	retries         *retryQueue
+	deadLetters     *deadLetterStore
+	done            chan chan *PipeStats
+	doneChan        chan *PipeStats
+	buffer          []*xdrclient.Alert
+	bufferPtr       int
+	t2Ticker        *time.Ticker
+	t1Ticker        *time.Ticker
+	t1Bucket        int
+	bucketSize      int
+	effectiveBucket int
+	overflow        OverflowPolicy
+	overflowTimeout time.Duration
+	room            chan struct{}
+	roomMu          sync.Mutex
+	pausedUntil     time.Time
+	shutdown        time.Duration
+	jsondata        []byte
+	err             error
+	alert           *xdrclient.Alert
+	stats           *PipeStats
+	histograms      *sendHistograms
+	closed          bool // guarded by roomMu
+	debug           bool
 }
 
-func newAlertPipe(xdrAPI *xdrclient.Client, ops *AlertPipeOps) (pipe *alertPipe) {
+// newAlertPipe creates a pipe delivering alerts to the sinks. Quota, retries and throttling are enforced on the first
+// (primary) sink. The rest of sinks (archives) get a best-effort copy of each batch the first time it is sent,
+// delivered from their own goroutines
+func newAlertPipe(sinks []Sink, ops *AlertPipeOps) (pipe *alertPipe) {
 	t1 := time.Duration(t1BucketDuration)
 	t2 := time.Duration(t2Timeout)
 	updateSize := maxUpdate
 	bufferSize := alertBufferSize
 	bucketSize := t1BucketSize
 	debug := false
+	shutdown := time.Duration(shutdownTimeout)
+	aging := time.Duration(0)
+	overflow := OverflowDropNewest
+	overflowWait := time.Duration(overflowTimeout)
+	queueDir := ""
+	var queueMaxBytes int64
+	deadLetterDir := ""
+	var deadLetterMaxBytes int64
+	retryAttempts, retryAge, retryBase, retryMax := retryMaxAttempts, retryMaxAge, retryBaseDelay, retryMaxDelay
 	if ops != nil {
 		t1 = time.Duration(ops.XDRQuotaSeconds)
 		t2 = time.Duration(ops.T1)
@@ -131,32 +383,87 @@ func newAlertPipe(xdrAPI *xdrclient.Client, ops *AlertPipeOps) (pipe *alertPipe)
 		bufferSize = ops.AlertBufferSize
 		bucketSize = ops.XDRMQuotaSize
 		debug = ops.Debug
+		shutdown = time.Duration(ops.ShutdownTimeout)
+		aging = time.Duration(ops.AgingSeconds)
+		overflowWait = time.Duration(ops.OverflowTimeout)
+		switch ops.Overflow {
+		case OverflowDropOldest, OverflowDropLowest, OverflowBlock:
+			overflow = ops.Overflow
+		case OverflowDropNewest, "":
+		default:
+			log.Printf("pipe error - unknown overflow policy %v (using %v)", ops.Overflow, overflow)
+		}
+		queueDir = ops.QueueDir
+		queueMaxBytes = ops.QueueMaxBytes
+		deadLetterDir = ops.DeadLetterDir
+		deadLetterMaxBytes = ops.DeadLetterMaxBytes
+		retryAttempts, retryAge, retryBase, retryMax = ops.RetryMaxAttempts, ops.RetryMaxAge, ops.RetryBaseDelay, ops.RetryMaxDelay
 	}
 	pipe = &alertPipe{
-		client:   xdrAPI,
-		done:     make(chan chan *PipeStats),
-		doneChan: make(chan *PipeStats),
-		buffer:   make([]*xdrclient.Alert, updateSize),
-		t1Bucket: t1BucketSize,
-		t1Ticker: time.NewTicker(time.Second * t1),
-		t2Ticker: time.NewTicker(time.Second * t2),
-		pipe:     make(chan *xdrclient.Alert, bufferSize),
-		stats:    &PipeStats{},
-		debug:    debug,
+		sink:            sinks[0],
+		done:            make(chan chan *PipeStats),
+		doneChan:        make(chan *PipeStats),
+		buffer:          make([]*xdrclient.Alert, updateSize),
+		t1Bucket:        bucketSize,
+		bucketSize:      bucketSize,
+		effectiveBucket: bucketSize,
+		overflow:        overflow,
+		overflowTimeout: time.Second * overflowWait,
+		room:            make(chan struct{}),
+		shutdown:        time.Second * shutdown,
+		t1Ticker:        time.NewTicker(time.Second * t1),
+		t2Ticker:        time.NewTicker(time.Second * t2),
+		stats:           &PipeStats{EffectiveQuota: int64(bucketSize), QuotaRemaining: int64(bucketSize)},
+		histograms:      newSendHistograms(),
+		debug:           debug,
+	}
+	for _, sink := range sinks {
+		pipe.sinkStats = append(pipe.sinkStats, &SinkStats{Name: sinkName(sink)})
+	}
+	pipe.stats.Sinks = pipe.sinkStats
+	for idx, sink := range sinks[1:] {
+		pipe.startArchive(sink, pipe.sinkStats[idx+1])
+	}
+	if queueDir != "" {
+		var err error
+		if pipe.queue, err = newDiskQueue(queueDir, queueMaxBytes, pipe.stats); err != nil {
+			log.Println("pipe error - unable to open disk queue (falling back to memory):", err)
+			pipe.queue = nil
+		} else if overflow == OverflowDropOldest || overflow == OverflowDropLowest {
+			// only reachable with options not created by NewPipeOpsFromEnv
+			log.Printf("pipe error - overflow policy %v not supported by the disk queue (using %v)", overflow, OverflowDropNewest)
+			pipe.overflow = OverflowDropNewest
+		}
+	}
+	if pipe.queue == nil {
+		pipe.queue = newPriorityQueue(bufferSize, time.Second*aging, overflow, pipe.stats)
+	}
+	if deadLetterDir != "" {
+		var err error
+		if pipe.deadLetters, err = newDeadLetterStore(deadLetterDir, deadLetterMaxBytes, pipe.stats); err != nil {
+			log.Println("pipe error - unable to open dead-letter store:", err)
+			pipe.deadLetters = nil
+		}
+	}
+	if retryAttempts > 1 {
+		pipe.retries = newRetryQueue(retryAttempts, retryAge, retryBase, retryMax, bufferSize)
 	}
 
 	// t2 alert sender
 	go func() {
 		log.Println("starting sender goroutine")
-		var ok bool
 		for {
 			select {
 			case done := <-pipe.done:
+				pipe.flush()
 				pipe.t1Ticker.Stop()
 				pipe.t2Ticker.Stop()
 				log.Println("tickers stopped")
-				for range pipe.pipe {
-					pipe.stats.PipeInErr++
+				pipe.abandonRetries()
+				pipe.closeArchives()
+				pipe.queue.close()
+				if pipe.deadLetters != nil {
+					pipe.deadLetters.close()
 				}
 				log.Println("pipe drained")
 				done <- pipe.stats
@@ -164,42 +471,102 @@ func newAlertPipe(xdrAPI *xdrclient.Client, ops *AlertPipeOps) (pipe *alertPipe)
 				log.Println("ending sender goroutine")
 				return
 			case <-pipe.t1Ticker.C:
-				pipe.t1Bucket = bucketSize
+				pipe.t1Bucket = pipe.effectiveBucket
 			case <-pipe.t2Ticker.C:
-			T2:
-				for pipe.t1Bucket > 0 {
-					select {
-					case pipe.alert, ok = <-pipe.pipe:
-						if ok {
-							pipe.buffer[pipe.bufferPtr] = pipe.alert
-							pipe.bufferPtr++
-							pipe.t1Bucket--
-							if pipe.bufferPtr >= maxUpdate {
-								pipe.encode()
-							}
-						} else {
-							break T2
-						}
-					default:
-						break T2
-					}
-				}
-				pipe.encode()
+				pipe.drain()
 			}
+			atomic.StoreInt64(&pipe.stats.QuotaRemaining, int64(pipe.t1Bucket))
 		}
 	}()
 	return
 }
 
+// drain sends pending retries and as many buffered alerts as the quota bucket allows.
+// Returns true if the pipe was left empty
+func (a *alertPipe) drain() (empty bool) {
+	if a.empty() {
+		return true
+	}
+	if a.paused() {
+		return
+	}
+	a.retry()
+	for a.t1Bucket > 0 && !a.paused() {
+		if a.alert = a.queue.pop(); a.alert == nil {
+			break
+		}
+		a.buffer[a.bufferPtr] = a.alert
+		a.bufferPtr++
+		a.t1Bucket--
+		if a.bufferPtr >= len(a.buffer) {
+			a.encode()
+		}
+	}
+	a.encode()
+	return a.empty()
+}
+
+// empty returns true if there are no buffered alerts nor retries pending
+func (a *alertPipe) empty() bool {
+	return a.queue.len() == 0 && (a.retries == nil || len(a.retries.batches) == 0)
+}
+
+// flush keeps draining the pipe, respecting the quota, until it is empty or the shutdown timeout expires
+func (a *alertPipe) flush() {
+	if a.shutdown <= 0 {
+		return
+	}
+	log.Println("flushing pipe")
+	deadline := time.NewTimer(a.shutdown)
+	defer deadline.Stop()
+	out := atomic.LoadUint64(&a.stats.PipeOut)
+	defer func() {
+		flushed := atomic.LoadUint64(&a.stats.PipeOut) - out
+		atomic.AddUint64(&a.stats.PipeFlushed, flushed)
+		log.Printf("pipe flushed %v alerts", flushed)
+	}()
+	for !a.drain() {
+		select {
+		case <-deadline.C:
+			log.Println("pipe error - shutdown timeout expired before the pipe was empty")
+			return
+		case <-a.t1Ticker.C:
+			a.t1Bucket = a.effectiveBucket
+		case <-a.t2Ticker.C:
+		}
+	}
+}
+
 func (a *alertPipe) encode() {
 	if a.bufferPtr > 0 {
-		if a.err = a.client.SendMulti(a.buffer[:a.bufferPtr]); a.err == nil {
-			a.stats.PipeOut += uint64(a.bufferPtr)
+		a.archive(a.buffer[:a.bufferPtr])
+		if a.err = a.send(a.buffer[:a.bufferPtr]); a.err == nil {
+			atomic.AddUint64(&a.stats.PipeOut, uint64(a.bufferPtr))
+			a.unthrottle()
 		} else {
-			a.stats.PipeOutErr += uint64(a.bufferPtr)
+			atomic.AddUint64(&a.stats.PipeOutErr, uint64(a.bufferPtr))
+			a.throttle(a.err)
+			batch := &retryBatch{
+				alerts: make([]*xdrclient.Alert, a.bufferPtr),
+				first:  time.Now(),
+				err:    a.err,
+			}
+			copy(batch.alerts, a.buffer[:a.bufferPtr])
+			a.fail(batch, batch.first)
 		}
 		a.bufferPtr = 0
+		a.commit()
+		a.notifyRoom()
+	}
+}
+
+// commit moves the queue cursor past the alerts popped so far unless some of them are waiting for a retry, as a
+// restart would lose them otherwise (delivered and abandoned alerts are done with)
+func (a *alertPipe) commit() {
+	if a.retries != nil && len(a.retries.batches) > 0 {
+		return
 	}
+	a.queue.commit()
 }
 
 func (a *alertPipe) getStats() (stats *PipeStats) {
@@ -207,22 +574,50 @@ func (a *alertPipe) getStats() (stats *PipeStats) {
 	return
 }
 
-func (a *alertPipe) ingest(alert *xdrclient.Alert) {
-	if a.closed {
-		a.stats.PipeInErr++
-		return
-	}
-	select {
-	case a.pipe <- alert:
-		a.stats.PipeIn++
-	default:
-		a.stats.PipeInErr++
+// ingest pushes the alert into the buffer applying the overflow policy. Returns ErrPipeFull or ErrPipeClosed
+// if the alert was not accepted
+func (a *alertPipe) ingest(alert *xdrclient.Alert) (err error) {
+	var timeout <-chan time.Time
+	for {
+		room, closed := a.roomSignal()
+		if closed {
+			err = ErrPipeClosed
+			break
+		}
+		if a.queue.push(alert) {
+			atomic.AddUint64(&a.stats.PipeIn, 1)
+			return
+		}
+		err = ErrPipeFull
+		if a.overflow != OverflowBlock {
+			if a.overflow != OverflowDropLowest {
+				atomic.AddUint64(&a.stats.DroppedNewest, 1)
+			}
+			break
+		}
+		if timeout == nil {
+			atomic.AddUint64(&a.stats.BlockedIngestions, 1)
+			timer := time.NewTimer(a.overflowTimeout)
+			defer timer.Stop()
+			timeout = timer.C
+		}
+		select {
+		case <-room:
+			continue
+		case <-timeout:
+			atomic.AddUint64(&a.stats.BlockTimeouts, 1)
+		}
+		break
 	}
+	atomic.AddUint64(&a.stats.PipeInErr, 1)
+	return
 }
 
 func (a *alertPipe) close() (stats *PipeStats) {
-	close(a.pipe)
+	a.roomMu.Lock()
 	a.closed = true
+	a.roomMu.Unlock()
+	a.notifyRoom()
 	a.done <- a.doneChan
 	close(a.done)
 	stats = <-a.doneChan
@@ -0,0 +1,106 @@
+package xdrgateway
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/xhoms/xdrgateway/xdrclient"
+)
+
+// recordingSink keeps the alerts of each accepted batch. The errors are returned (and the batch rejected) one per
+// call before accepting batches again
+type recordingSink struct {
+	mu      sync.Mutex
+	batches [][]*xdrclient.Alert
+	errors  []error
+	calls   int
+}
+
+func (s *recordingSink) SendMulti(alerts []*xdrclient.Alert) (err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.calls++
+	if len(s.errors) > 0 {
+		err, s.errors = s.errors[0], s.errors[1:]
+		return
+	}
+	s.batches = append(s.batches, append([]*xdrclient.Alert(nil), alerts...))
+	return
+}
+
+func (s *recordingSink) alerts() (alerts []*xdrclient.Alert) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, batch := range s.batches {
+		alerts = append(alerts, batch...)
+	}
+	return
+}
+
+func testAlert(name string, severity xdrclient.Severities) *xdrclient.Alert {
+	return &xdrclient.Alert{AlertName: name, Severity: severity}
+}
+
+// testPipeOps returns options that keep the tickers from draining the pipe during the test
+func testPipeOps(quota, shutdown int) *AlertPipeOps {
+	return &AlertPipeOps{
+		XDRUpdateSize:    10,
+		XDRMQuotaSize:    quota,
+		XDRQuotaSeconds:  3600,
+		AlertBufferSize:  100,
+		T1:               3600,
+		RetryMaxAttempts: 1,
+		ShutdownTimeout:  shutdown,
+	}
+}
+
+func TestPipeFlush(t *testing.T) {
+	for _, test := range []struct {
+		name      string
+		quota     int
+		alerts    int
+		delivered int
+		maxTime   time.Duration
+	}{
+		{"empty pipe", 10, 0, 0, time.Second},
+		{"all delivered", 100, 25, 25, time.Second},
+		{"quota exhausted by the flush", 5, 5, 5, time.Second},
+		{"deadline expires", 3, 6, 3, 3 * time.Second},
+	} {
+		sink := &recordingSink{}
+		pipe := newAlertPipe([]Sink{sink}, testPipeOps(test.quota, 2))
+		for i := 0; i < test.alerts; i++ {
+			if err := pipe.ingest(testAlert("flush", xdrclient.SeverityHigh)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		start := time.Now()
+		stats := pipe.close()
+		if elapsed := time.Since(start); elapsed > test.maxTime {
+			t.Errorf("%v: flush took %v", test.name, elapsed)
+		}
+		if delivered := len(sink.alerts()); delivered != test.delivered || stats.PipeFlushed != uint64(test.delivered) {
+			t.Errorf("%v: delivered %v alerts (flushed %v)", test.name, delivered, stats.PipeFlushed)
+		}
+	}
+}
+
+// TestPipeClosed closes the pipe while alerts are being ingested (run with -race)
+func TestPipeClosed(t *testing.T) {
+	pipe := newAlertPipe([]Sink{&recordingSink{}}, testPipeOps(10, 0))
+	var wg sync.WaitGroup
+	for worker := 0; worker < 4; worker++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for pipe.ingest(testAlert("concurrent", xdrclient.SeverityLow)) != ErrPipeClosed {
+			}
+		}()
+	}
+	pipe.close()
+	wg.Wait()
+	if err := pipe.ingest(testAlert("late", xdrclient.SeverityHigh)); err != ErrPipeClosed {
+		t.Errorf("unexpected error %v", err)
+	}
+}
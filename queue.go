@@ -0,0 +1,520 @@
+package xdrgateway
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/xhoms/xdrgateway/xdrclient"
+)
+
+const (
+	diskQueueSize    = 64 << 20
+	diskSegmentSize  = 4 << 20
+	diskSegmentExt   = ".seg"
+	diskCursorFile   = "cursor"
+	diskCursorLayout = "%d %d\n"
+)
+
+// alertQueue is the storage backing the alert pipe. push is called from the ingestion goroutines while
+// pop and commit are only called from the sender goroutine
+type alertQueue interface {
+	// push stores the alert at the tail of the queue. Returns false if there is no room for it (after applying
+	// the overflow policy, if supported)
+	push(alert *xdrclient.Alert) bool
+	// pop returns the alert at the head of the queue (nil if the queue is empty)
+	pop() *xdrclient.Alert
+	// commit acknowledges all alerts returned by pop so far
+	commit()
+	// len returns the number of alerts waiting to be returned by pop
+	len() int
+	// close releases the queue resources. Alerts not yet committed are either discarded or persisted
+	close()
+}
+
+// severityPriority lists the XDR severities from the most to the least urgent one
+var severityPriority = []xdrclient.Severities{
+	xdrclient.SeverityHigh,
+	xdrclient.SeverityMedium,
+	xdrclient.SeverityLow,
+	xdrclient.SeverityUnknown,
+	xdrclient.SeverityInfo,
+}
+
+// SeverityCounters holds a counter for each XDR alert severity
+type SeverityCounters struct {
+	High          uint64
+	Medium        uint64
+	Low           uint64
+	Informational uint64
+	Unknown       uint64
+}
+
+// Snapshot returns a copy of the counters that is safe to read while the pipe is in use
+func (s *SeverityCounters) Snapshot() SeverityCounters {
+	return SeverityCounters{
+		High:          atomic.LoadUint64(&s.High),
+		Medium:        atomic.LoadUint64(&s.Medium),
+		Low:           atomic.LoadUint64(&s.Low),
+		Informational: atomic.LoadUint64(&s.Informational),
+		Unknown:       atomic.LoadUint64(&s.Unknown),
+	}
+}
+
+func (s *SeverityCounters) counter(severity xdrclient.Severities) *uint64 {
+	switch severity {
+	case xdrclient.SeverityHigh:
+		return &s.High
+	case xdrclient.SeverityMedium:
+		return &s.Medium
+	case xdrclient.SeverityLow:
+		return &s.Low
+	case xdrclient.SeverityInfo:
+		return &s.Informational
+	default:
+		return &s.Unknown
+	}
+}
+
+type queuedAlert struct {
+	alert *xdrclient.Alert
+	since time.Time
+}
+
+// alertFIFO is a single-severity tier of the priorityQueue
+type alertFIFO struct {
+	items []queuedAlert
+	head  int
+}
+
+func (f *alertFIFO) len() int {
+	return len(f.items) - f.head
+}
+
+func (f *alertFIFO) push(item queuedAlert) {
+	f.items = append(f.items, item)
+}
+
+func (f *alertFIFO) peek() *queuedAlert {
+	return &f.items[f.head]
+}
+
+func (f *alertFIFO) pop() (item queuedAlert) {
+	item = f.items[f.head]
+	f.items[f.head] = queuedAlert{}
+	if f.head++; f.head == len(f.items) {
+		f.items, f.head = f.items[:0], 0
+	} else if f.head >= 64 && f.head > len(f.items)/2 {
+		f.items = append(f.items[:0], f.items[f.head:]...)
+		f.head = 0
+	}
+	return
+}
+
+// priorityQueue is the in-memory alertQueue implementation. It keeps a FIFO tier per severity and always pops
+// from the most urgent non-empty tier. If aging is enabled, alerts that have waited longer than the aging period
+// in a lower tier are popped first so that they are not starved forever
+type priorityQueue struct {
+	mu       sync.Mutex
+	tiers    map[xdrclient.Severities]*alertFIFO
+	size     int
+	limit    int
+	aging    time.Duration
+	overflow OverflowPolicy
+	stats    *PipeStats
+}
+
+func newPriorityQueue(size int, aging time.Duration, overflow OverflowPolicy, stats *PipeStats) (q *priorityQueue) {
+	q = &priorityQueue{
+		tiers:    make(map[xdrclient.Severities]*alertFIFO, len(severityPriority)),
+		limit:    size,
+		aging:    aging,
+		overflow: overflow,
+		stats:    stats,
+	}
+	for _, severity := range severityPriority {
+		q.tiers[severity] = &alertFIFO{}
+	}
+	return
+}
+
+func (q *priorityQueue) tier(severity xdrclient.Severities) *alertFIFO {
+	if tier, exists := q.tiers[severity]; exists {
+		return tier
+	}
+	return q.tiers[xdrclient.SeverityUnknown]
+}
+
+func (q *priorityQueue) push(alert *xdrclient.Alert) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.size >= q.limit && !q.evict(alert) {
+		atomic.AddUint64(q.stats.QueueDrops.counter(alert.Severity), 1)
+		return false
+	}
+	q.tier(alert.Severity).push(queuedAlert{alert: alert, since: time.Now()})
+	q.size++
+	atomic.AddUint64(q.stats.QueueDepth.counter(alert.Severity), 1)
+	return true
+}
+
+func (q *priorityQueue) pop() (alert *xdrclient.Alert) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	var selected *alertFIFO
+	var oldest time.Time
+	for _, severity := range severityPriority {
+		tier := q.tiers[severity]
+		if tier.len() == 0 {
+			continue
+		}
+		if selected == nil {
+			selected, oldest = tier, tier.peek().since
+			if q.aging <= 0 {
+				break
+			}
+			continue
+		}
+		// a lower tier wins only if its head has aged and waited longer than the current selection
+		if since := tier.peek().since; time.Since(since) > q.aging && since.Before(oldest) {
+			selected, oldest = tier, since
+		}
+	}
+	if selected != nil {
+		alert = selected.pop().alert
+		q.size--
+		atomic.AddUint64(q.stats.QueueDepth.counter(alert.Severity), ^uint64(0))
+	}
+	return
+}
+
+func (q *priorityQueue) commit() {}
+
+func (q *priorityQueue) len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.size
+}
+
+func (q *priorityQueue) close() {
+	for alert := q.pop(); alert != nil; alert = q.pop() {
+		atomic.AddUint64(&q.stats.PipeInErr, 1)
+		atomic.AddUint64(q.stats.QueueDrops.counter(alert.Severity), 1)
+	}
+}
+
+// diskQueue is a write-ahead alertQueue implementation. Alerts are appended as NDJSON records to segment files
+// in a directory and a cursor file tracks the position of the last committed alert. Alerts that were not
+// committed before a restart are replayed in order when the queue is opened again (at-least-once delivery)
+type diskQueue struct {
+	dir         string
+	maxBytes    int64
+	segmentSize int64
+	mu          sync.Mutex
+	segments    []uint64
+	sizes       map[uint64]int64
+	bytes       int64
+	writeSeg    uint64
+	writer      *os.File
+	readSeg     uint64
+	readOffset  int64
+	reader      *bufio.Reader
+	readFile    *os.File
+	consumed    []uint64
+	replay      int64
+	pending     int
+	stats       *PipeStats
+}
+
+func newDiskQueue(dir string, maxBytes int64, stats *PipeStats) (q *diskQueue, err error) {
+	if maxBytes <= 0 {
+		maxBytes = diskQueueSize
+	}
+	segmentSize := int64(diskSegmentSize)
+	if segmentSize > maxBytes/4 {
+		segmentSize = maxBytes / 4
+	}
+	q = &diskQueue{
+		dir:         dir,
+		maxBytes:    maxBytes,
+		segmentSize: segmentSize,
+		sizes:       make(map[uint64]int64),
+		stats:       stats,
+	}
+	if err = os.MkdirAll(dir, 0700); err != nil {
+		return
+	}
+	var files []os.FileInfo
+	if files, err = ioutil.ReadDir(dir); err != nil {
+		return
+	}
+	for _, file := range files {
+		if name := file.Name(); strings.HasSuffix(name, diskSegmentExt) {
+			if id, perr := strconv.ParseUint(strings.TrimSuffix(name, diskSegmentExt), 10, 64); perr == nil {
+				q.segments = append(q.segments, id)
+				q.sizes[id] = file.Size()
+				q.bytes += file.Size()
+			}
+		}
+	}
+	sort.Slice(q.segments, func(i, j int) bool { return q.segments[i] < q.segments[j] })
+	q.readCursor()
+	// segments older than the cursor were consumed before the last shutdown
+	for len(q.segments) > 0 && q.segments[0] < q.readSeg {
+		q.remove(q.segments[0])
+		q.segments = q.segments[1:]
+	}
+	if len(q.segments) > 0 {
+		if q.segments[0] > q.readSeg {
+			q.readSeg, q.readOffset = q.segments[0], 0
+		}
+		q.writeSeg = q.segments[len(q.segments)-1] + 1
+		q.replay = q.countPending()
+		q.pending = int(q.replay)
+	} else {
+		q.writeSeg = q.readSeg + 1
+		q.readSeg, q.readOffset = q.writeSeg, 0
+	}
+	if err = q.openWriter(); err == nil {
+		q.updateStats()
+		if q.replay > 0 {
+			log.Printf("pipe - %v alerts pending in disk queue %v will be replayed", q.replay, dir)
+		}
+	}
+	return
+}
+
+func (q *diskQueue) segmentPath(id uint64) string {
+	return filepath.Join(q.dir, fmt.Sprintf("%020d%v", id, diskSegmentExt))
+}
+
+func (q *diskQueue) readCursor() {
+	if data, err := ioutil.ReadFile(filepath.Join(q.dir, diskCursorFile)); err == nil {
+		if _, err = fmt.Sscanf(string(data), diskCursorLayout, &q.readSeg, &q.readOffset); err != nil {
+			log.Println("pipe error - ignoring corrupted disk queue cursor:", err)
+			q.readSeg, q.readOffset = 0, 0
+		}
+	}
+}
+
+func (q *diskQueue) writeCursor() (err error) {
+	tmp := filepath.Join(q.dir, diskCursorFile+".tmp")
+	cursor := fmt.Sprintf(diskCursorLayout, q.readSeg, q.readOffset)
+	if err = ioutil.WriteFile(tmp, []byte(cursor), 0600); err == nil {
+		err = os.Rename(tmp, filepath.Join(q.dir, diskCursorFile))
+	}
+	return
+}
+
+// countPending returns the number of records stored after the read cursor and adds them to the queue depth
+func (q *diskQueue) countPending() (count int64) {
+	var record struct {
+		Severity xdrclient.Severities
+	}
+	for _, id := range q.segments {
+		if file, err := os.Open(q.segmentPath(id)); err == nil {
+			if id == q.readSeg {
+				file.Seek(q.readOffset, io.SeekStart)
+			}
+			reader := bufio.NewReader(file)
+			for {
+				line, err := reader.ReadBytes('\n')
+				if err != nil {
+					break
+				}
+				count++
+				// corrupted records are skipped by pop so they are not part of the depth
+				if json.Unmarshal(bytes.TrimSpace(line), &record) == nil {
+					atomic.AddUint64(q.stats.QueueDepth.counter(record.Severity), 1)
+				}
+			}
+			file.Close()
+		}
+	}
+	return
+}
+
+func (q *diskQueue) openWriter() (err error) {
+	if q.writer, err = os.OpenFile(q.segmentPath(q.writeSeg), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600); err == nil {
+		if _, exists := q.sizes[q.writeSeg]; !exists {
+			q.segments = append(q.segments, q.writeSeg)
+			q.sizes[q.writeSeg] = 0
+		}
+	}
+	return
+}
+
+func (q *diskQueue) remove(id uint64) {
+	if err := os.Remove(q.segmentPath(id)); err != nil && !os.IsNotExist(err) {
+		log.Println("pipe error - unable to remove disk queue segment:", err)
+	}
+	q.bytes -= q.sizes[id]
+	delete(q.sizes, id)
+}
+
+func (q *diskQueue) updateStats() {
+	atomic.StoreInt64(&q.stats.QueueBytes, q.bytes)
+	atomic.StoreInt64(&q.stats.QueueSegments, int64(len(q.segments)))
+}
+
+func (q *diskQueue) push(alert *xdrclient.Alert) bool {
+	record, err := json.Marshal(alert)
+	if err != nil {
+		return false
+	}
+	record = append(record, '\n')
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.writer == nil || q.bytes+int64(len(record)) > q.maxBytes {
+		atomic.AddUint64(q.stats.QueueDrops.counter(alert.Severity), 1)
+		return false
+	}
+	if q.sizes[q.writeSeg] >= q.segmentSize {
+		if err = q.writer.Sync(); err == nil {
+			err = q.writer.Close()
+		}
+		if err != nil {
+			log.Println("pipe error - closing disk queue segment:", err)
+		}
+		q.writeSeg++
+		if err = q.openWriter(); err != nil {
+			log.Println("pipe error - opening disk queue segment:", err)
+			q.writer = nil
+			atomic.AddUint64(q.stats.QueueDrops.counter(alert.Severity), 1)
+			return false
+		}
+	}
+	var n int
+	n, err = q.writer.Write(record)
+	q.sizes[q.writeSeg] += int64(n)
+	q.bytes += int64(n)
+	q.updateStats()
+	if err != nil {
+		log.Println("pipe error - writing disk queue segment:", err)
+		atomic.AddUint64(q.stats.QueueDrops.counter(alert.Severity), 1)
+		return false
+	}
+	q.pending++
+	atomic.AddUint64(q.stats.QueueDepth.counter(alert.Severity), 1)
+	return true
+}
+
+func (q *diskQueue) pop() (alert *xdrclient.Alert) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for alert == nil {
+		if q.reader == nil {
+			var err error
+			if q.readFile, err = os.Open(q.segmentPath(q.readSeg)); err != nil {
+				return
+			}
+			if _, err = q.readFile.Seek(q.readOffset, io.SeekStart); err != nil {
+				q.readFile.Close()
+				return
+			}
+			q.reader = bufio.NewReader(q.readFile)
+		}
+		record, err := q.reader.ReadBytes('\n')
+		if err != nil {
+			if q.readSeg == q.writeSeg {
+				// nothing else to read. Rewind any partial read so that it is retried later
+				if len(record) > 0 {
+					q.readFile.Seek(q.readOffset, io.SeekStart)
+					q.reader.Reset(q.readFile)
+				}
+				return
+			}
+			if len(record) > 0 {
+				log.Println("pipe error - discarding truncated disk queue record")
+				atomic.AddUint64(&q.stats.PipeOutErr, 1)
+			}
+			// move on to the next segment. The consumed one is removed on commit
+			q.readFile.Close()
+			q.readFile, q.reader = nil, nil
+			q.consumed = append(q.consumed, q.readSeg)
+			q.readSeg, q.readOffset = q.nextSegment(q.readSeg), 0
+			continue
+		}
+		q.readOffset += int64(len(record))
+		q.pending--
+		alert = &xdrclient.Alert{}
+		if err = json.Unmarshal(bytes.TrimSpace(record), alert); err != nil {
+			log.Println("pipe error - discarding corrupted disk queue record:", err)
+			atomic.AddUint64(&q.stats.PipeOutErr, 1)
+			alert = nil
+			continue
+		}
+		atomic.AddUint64(q.stats.QueueDepth.counter(alert.Severity), ^uint64(0))
+		if q.replay > 0 {
+			q.replay--
+			atomic.AddUint64(&q.stats.QueueReplayed, 1)
+		}
+	}
+	return
+}
+
+func (q *diskQueue) len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.pending
+}
+
+func (q *diskQueue) nextSegment(id uint64) uint64 {
+	for _, seg := range q.segments {
+		if seg > id {
+			return seg
+		}
+	}
+	return q.writeSeg
+}
+
+func (q *diskQueue) commit() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if err := q.writeCursor(); err != nil {
+		log.Println("pipe error - unable to store disk queue cursor:", err)
+		return
+	}
+	if len(q.consumed) > 0 {
+		for _, id := range q.consumed {
+			q.remove(id)
+		}
+		q.consumed = q.consumed[:0]
+		segments := q.segments[:0]
+		for _, id := range q.segments {
+			if _, exists := q.sizes[id]; exists {
+				segments = append(segments, id)
+			}
+		}
+		q.segments = segments
+		q.updateStats()
+	}
+}
+
+func (q *diskQueue) close() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.readFile != nil {
+		q.readFile.Close()
+		q.readFile, q.reader = nil, nil
+	}
+	if q.writer != nil {
+		if err := q.writer.Sync(); err != nil {
+			log.Println("pipe error - syncing disk queue segment:", err)
+		}
+		q.writer.Close()
+		q.writer = nil
+	}
+}
@@ -0,0 +1,219 @@
+package xdrgateway
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/xhoms/xdrgateway/xdrclient"
+)
+
+// popNames pops all alerts from the queue returning their names
+func popNames(queue alertQueue) (names []string) {
+	for alert := queue.pop(); alert != nil; alert = queue.pop() {
+		names = append(names, alert.AlertName)
+	}
+	return
+}
+
+func TestDiskQueueReplay(t *testing.T) {
+	for _, test := range []struct {
+		name      string
+		popped    int
+		committed bool
+		cursor    string
+		replayed  []string
+	}{
+		{"committed", 2, true, "", []string{"2", "3", "4"}},
+		{"not committed", 2, false, "", []string{"0", "1", "2", "3", "4"}},
+		{"all committed", 5, true, "", nil},
+		{"corrupted cursor", 2, true, "garbage", []string{"0", "1", "2", "3", "4"}},
+	} {
+		dir, err := ioutil.TempDir("", "xdrgw-queue")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+		queue, err := newDiskQueue(dir, 0, &PipeStats{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 5; i++ {
+			if !queue.push(testAlert(strconv.Itoa(i), xdrclient.SeverityHigh)) {
+				t.Fatalf("%v: push %v failed", test.name, i)
+			}
+		}
+		for i := 0; i < test.popped; i++ {
+			queue.pop()
+		}
+		if test.committed {
+			queue.commit()
+		}
+		queue.close()
+		if test.cursor != "" {
+			ioutil.WriteFile(filepath.Join(dir, diskCursorFile), []byte(test.cursor), 0600)
+		}
+		stats := &PipeStats{}
+		if queue, err = newDiskQueue(dir, 0, stats); err != nil {
+			t.Fatal(err)
+		}
+		if depth := stats.Snapshot().QueueDepth; queue.len() != len(test.replayed) || depth.High != uint64(len(test.replayed)) {
+			t.Errorf("%v: %v alerts pending (depth %+v)", test.name, queue.len(), depth)
+		}
+		names := popNames(queue)
+		if len(names) != len(test.replayed) || stats.Snapshot().QueueReplayed != uint64(len(test.replayed)) {
+			t.Errorf("%v: replayed %v (%v)", test.name, names, stats.Snapshot().QueueReplayed)
+			queue.close()
+			continue
+		}
+		for idx, name := range names {
+			if name != test.replayed[idx] {
+				t.Errorf("%v: replayed %v", test.name, names)
+				break
+			}
+		}
+		queue.close()
+	}
+}
+
+func TestDiskQueueRotation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "xdrgw-queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	stats := &PipeStats{}
+	queue, err := newDiskQueue(dir, 4096, stats)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer queue.close()
+	pushed := 0
+	for ; queue.push(testAlert(strconv.Itoa(pushed), xdrclient.SeverityHigh)); pushed++ {
+	}
+	snapshot := stats.Snapshot()
+	if pushed == 0 || snapshot.QueueSegments < 2 || snapshot.QueueBytes > 4096 {
+		t.Fatalf("unexpected full queue (%v alerts) %+v", pushed, snapshot)
+	}
+	if snapshot.QueueDepth != (SeverityCounters{High: uint64(pushed)}) || snapshot.QueueDrops != (SeverityCounters{High: 1}) {
+		t.Errorf("unexpected counters of the full queue %+v %+v", snapshot.QueueDepth, snapshot.QueueDrops)
+	}
+	names := popNames(queue)
+	if len(names) != pushed || names[0] != "0" || names[pushed-1] != strconv.Itoa(pushed-1) {
+		t.Fatalf("unexpected pop order %v", names)
+	}
+	if depth := stats.Snapshot().QueueDepth; depth != (SeverityCounters{}) {
+		t.Errorf("unexpected depth of the empty queue %+v", depth)
+	}
+	// consumed segments are removed on commit only
+	if segments := stats.Snapshot().QueueSegments; segments != snapshot.QueueSegments {
+		t.Errorf("segments removed before commit (%v)", segments)
+	}
+	queue.commit()
+	if snapshot = stats.Snapshot(); snapshot.QueueSegments != 1 {
+		t.Errorf("unexpected segments after commit %+v", snapshot)
+	}
+	if files, _ := filepath.Glob(filepath.Join(dir, "*"+diskSegmentExt)); len(files) != 1 {
+		t.Errorf("unexpected segment files %v", files)
+	}
+	if !queue.push(testAlert("again", xdrclient.SeverityHigh)) {
+		t.Error("no room after commit")
+	}
+}
+
+func TestPriorityQueue(t *testing.T) {
+	high, medium, low, info, unknown := xdrclient.SeverityHigh, xdrclient.SeverityMedium, xdrclient.SeverityLow, xdrclient.SeverityInfo, xdrclient.SeverityUnknown
+	for _, test := range []struct {
+		name          string
+		aging         time.Duration
+		before, after []xdrclient.Severities
+		popped        string
+	}{
+		{"severity order", 0, []xdrclient.Severities{low, info, high, medium, unknown, high}, nil, "cfdaeb"},
+		{"aging disabled", 0, []xdrclient.Severities{low}, []xdrclient.Severities{high}, "ba"},
+		{"aged lower tier", 10 * time.Millisecond, []xdrclient.Severities{low}, []xdrclient.Severities{high, medium}, "abc"},
+		{"not aged yet", time.Hour, []xdrclient.Severities{low}, []xdrclient.Severities{high}, "ba"},
+		{"older urgent alert first", 10 * time.Millisecond, []xdrclient.Severities{high, low}, []xdrclient.Severities{high}, "abc"},
+	} {
+		stats := &PipeStats{}
+		queue := newPriorityQueue(10, test.aging, OverflowDropNewest, stats)
+		name := 'a'
+		for _, severity := range test.before {
+			queue.push(testAlert(string(name), severity))
+			name++
+		}
+		if test.after != nil {
+			time.Sleep(30 * time.Millisecond)
+			for _, severity := range test.after {
+				queue.push(testAlert(string(name), severity))
+				name++
+			}
+		}
+		if depth := stats.Snapshot().QueueDepth; queue.len() != len(test.before)+len(test.after) || depth.High == 0 {
+			t.Errorf("%v: unexpected depth %v (%+v)", test.name, queue.len(), depth)
+		}
+		if popped := strings.Join(popNames(queue), ""); popped != test.popped {
+			t.Errorf("%v: popped %q", test.name, popped)
+		}
+		if depth := stats.Snapshot().QueueDepth; queue.len() != 0 || depth != (SeverityCounters{}) {
+			t.Errorf("%v: unexpected depth after pop %+v", test.name, depth)
+		}
+	}
+}
+
+// TestDiskQueueFailedSend checks that alerts whose delivery failed are replayed after a restart unless they were
+// delivered by a retry or moved to the dead-letter store
+func TestDiskQueueFailedSend(t *testing.T) {
+	for _, test := range []struct {
+		name       string
+		err        error
+		drains     int
+		deadLetter bool
+		replayed   int
+	}{
+		{"delivered", nil, 1, false, 0},
+		{"pending retry", errors.New("connection reset"), 1, false, 5},
+		{"recovered by a retry", errors.New("connection reset"), 2, false, 0},
+		{"dead-lettered", &xdrclient.HTTPError{StatusCode: http.StatusBadRequest}, 1, true, 0},
+	} {
+		dir, err := ioutil.TempDir("", "xdrgw-queue")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+		sink := &recordingSink{}
+		if test.err != nil {
+			sink.errors = []error{test.err}
+		}
+		ops := testPipeOps(100, 0)
+		ops.QueueDir, ops.RetryMaxAttempts, ops.RetryMaxAge = filepath.Join(dir, "queue"), 3, 60
+		if test.deadLetter {
+			ops.DeadLetterDir = filepath.Join(dir, "deadletter")
+		}
+		pipe := newAlertPipe([]Sink{sink}, ops)
+		for i := 0; i < 5; i++ {
+			pipe.ingest(testAlert(strconv.Itoa(i), xdrclient.SeverityHigh))
+		}
+		for i := 0; i < test.drains; i++ {
+			pipe.drain()
+		}
+		stats := pipe.close().Snapshot()
+		if test.deadLetter && stats.DeadLetters != 5 {
+			t.Errorf("%v: %v dead letters", test.name, stats.DeadLetters)
+		}
+		queue, err := newDiskQueue(ops.QueueDir, 0, &PipeStats{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if names := popNames(queue); len(names) != test.replayed {
+			t.Errorf("%v: replayed %v", test.name, names)
+		}
+		queue.close()
+	}
+}
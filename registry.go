@@ -0,0 +1,117 @@
+package xdrgateway
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"sync/atomic"
+)
+
+const (
+	defaultParserName = "default"
+	syslogParserName  = "syslog"
+)
+
+// ParserStats provides counters for each registered parser
+type ParserStats struct {
+	// ParseErrors is the number of received events that have failed to be parsed
+	ParseErrors int64
+	// EventsReceived is the number of events received for this parser
+	EventsReceived int64
+}
+
+// Snapshot returns a copy of the counters that is safe to read while the parser is in use
+func (s *ParserStats) Snapshot() ParserStats {
+	return ParserStats{
+		ParseErrors:    atomic.LoadInt64(&s.ParseErrors),
+		EventsReceived: atomic.LoadInt64(&s.EventsReceived),
+	}
+}
+
+// parserEntry is a named parser with its own counters
+type parserEntry struct {
+	name   string
+	parser Parser
+	stats  *ParserStats
+}
+
+func (a *API) newParserEntry(name string, parser Parser) (entry *parserEntry) {
+	entry = &parserEntry{
+		name:   name,
+		parser: parser,
+		stats:  &ParserStats{},
+	}
+	a.stats.Parsers[name] = entry.stats
+	return
+}
+
+// RegisterParser makes parser available in the `/in/{name}` and `/dump/{name}` paths of HandlerIngestion and
+// HandlerHint (the parser provided to NewAPI serves the bare paths). The `default` and `syslog` names are reserved
+func (a *API) RegisterParser(name string, parser Parser) (err error) {
+	if name == "" || name == syslogParserName || strings.Contains(name, "/") || a.stats.Parsers[name] != nil {
+		err = fmt.Errorf("invalid or duplicated parser name %q", name)
+		return
+	}
+	a.parsers[name] = a.newParserEntry(name, parser)
+	return
+}
+
+// parserByPath returns the parser for the last segment of a `/{prefix}/{name}` path (the default one for `/{prefix}`)
+func (a *API) parserByPath(path string) *parserEntry {
+	segments := strings.Split(strings.Trim(path, "/"), "/")
+	if len(segments) < 2 {
+		return a.parser
+	}
+	return a.parsers[segments[len(segments)-1]]
+}
+
+// requestParser returns the parser for the request path replying 404 if not found
+func (a *API) requestParser(w http.ResponseWriter, r *http.Request) (entry *parserEntry) {
+	if entry = a.parserByPath(r.URL.Path); entry == nil {
+		http.Error(w, "unknown parser", http.StatusNotFound)
+	}
+	return
+}
+
+// NewParserFromSpec creates one of the built-in parsers from its textual specification
+//
+// - basic[:<timestamp field>] is the built-in JSON payload parser (BasicParser) taking the alert time from the field
+// (auto, high_res_timestamp, time_generated or receive_time)
+//
+// - csv[:<version>] is the PAN-OS threat log CSV parser. The PAN-OS version of the firewalls (defaults to
+// DefaultPANOSVersion) is reported as the sender software version
+//
+// - cef and leef are the CEF and LEEF parsers
+//
+// - mapping:<path> is a MappingParser loaded from the YAML or JSON file
+//
+// PAN-OS timestamps are interpreted using zones (UTC if nil)
+func NewParserFromSpec(spec string, zones *TimeZones, debug bool) (parser Parser, err error) {
+	offset := 0
+	kind, target := spec, ""
+	if idx := strings.Index(spec, ":"); idx >= 0 {
+		kind, target = spec[:idx], spec[idx+1:]
+	}
+	switch kind {
+	case "basic":
+		basic := NewBasicParser(offset, debug)
+		if target != "" {
+			err = basic.SetTimestampField(target)
+		}
+		parser = basic
+	case "csv":
+		parser, err = NewCSVParser(offset, target, debug)
+	case "cef":
+		parser = NewCEFParser(offset, debug)
+	case "leef":
+		parser = NewLEEFParser(offset, debug)
+	case "mapping":
+		parser, err = NewMappingParserFromFile(target, offset, debug)
+	default:
+		err = fmt.Errorf("unknown parser %v", spec)
+	}
+	if zoned, ok := parser.(interface{ SetTimeZones(*TimeZones) }); ok && err == nil && zones != nil {
+		zoned.SetTimeZones(zones)
+	}
+	return
+}
@@ -0,0 +1,75 @@
+package xdrgateway
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestParserByPath(t *testing.T) {
+	api := newTestAPI()
+	defer api.Close()
+	for _, name := range []string{"cef", "leef"} {
+		parser, err := NewParserFromSpec(name, nil, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = api.RegisterParser(name, parser); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, test := range []struct {
+		path, parser string
+	}{
+		{"/in", defaultParserName},
+		{"/in/", defaultParserName},
+		{"/", defaultParserName},
+		{"/in/cef", "cef"},
+		{"/dump/leef/", "leef"},
+		{"/gw/in/cef", "cef"},
+		{"/in/csv", ""},
+	} {
+		entry := api.parserByPath(test.path)
+		if (entry == nil && test.parser != "") || (entry != nil && entry.name != test.parser) {
+			t.Errorf("%v: unexpected parser %+v", test.path, entry)
+		}
+	}
+	for _, name := range []string{"", defaultParserName, syslogParserName, "cef", "a/b"} {
+		if err := api.RegisterParser(name, NewCEFParser(0, false)); err == nil {
+			t.Errorf("%q: expected error", name)
+		}
+	}
+	// each parser keeps its own counters
+	request := httptest.NewRequest(http.MethodPost, "/in/cef", bytes.NewReader([]byte("CEF:0|Vendor|Product|1.0|100|Name|5|src=10.0.0.1 dst=10.0.0.2")))
+	request.Header.Set("Authorization", "psk")
+	recorder := httptest.NewRecorder()
+	api.HandlerIngestion(recorder, request)
+	stats := api.Stats()
+	if recorder.Code != http.StatusOK || stats.Parsers["cef"].EventsReceived != 1 || stats.Parsers["leef"].EventsReceived != 0 ||
+		stats.Parsers[defaultParserName].EventsReceived != 0 {
+		t.Errorf("unexpected status %v (%v)", recorder.Code, recorder.Body.String())
+	}
+}
+
+func TestNewParserFromSpec(t *testing.T) {
+	for _, test := range []struct {
+		spec  string
+		fails bool
+	}{
+		{"basic", false},
+		{"basic:high_res_timestamp", false},
+		{"basic:start_time", true},
+		{"csv", false},
+		{"csv:9.1", false},
+		{"csv:7.1", true},
+		{"cef", false},
+		{"leef", false},
+		{"mapping:/nonexistent/mapping.yaml", true},
+		{"json", true},
+	} {
+		if parser, err := NewParserFromSpec(test.spec, fixedTimeZones(1), false); (err != nil) != test.fails || (err == nil && parser == nil) {
+			t.Errorf("%v: unexpected result %v", test.spec, err)
+		}
+	}
+}
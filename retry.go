@@ -0,0 +1,176 @@
+package xdrgateway
+
+import (
+	"errors"
+	"log"
+	"math/rand"
+	"sync/atomic"
+	"time"
+
+	"github.com/xhoms/xdrgateway/xdrclient"
+)
+
+const (
+	retryMaxAttempts = 5
+	retryMaxAge      = 600
+	retryBaseDelay   = 2
+	retryMaxDelay    = 120
+)
+
+// retryBatch is a XDR update that failed and is waiting to be sent again
+type retryBatch struct {
+	alerts   []*xdrclient.Alert
+	attempts int
+	first    time.Time
+	next     time.Time
+	err      error
+}
+
+// retryQueue holds failed updates and decides when they must be sent again using exponential backoff with jitter.
+// It is only used from the sender goroutine
+type retryQueue struct {
+	batches     []*retryBatch
+	size        int
+	maxSize     int
+	maxAttempts int
+	maxAge      time.Duration
+	baseDelay   time.Duration
+	maxDelay    time.Duration
+}
+
+func newRetryQueue(maxAttempts, maxAge, baseDelay, maxDelay, maxSize int) (r *retryQueue) {
+	r = &retryQueue{
+		maxSize:     maxSize,
+		maxAttempts: maxAttempts,
+		maxAge:      time.Duration(maxAge) * time.Second,
+		baseDelay:   time.Duration(baseDelay) * time.Second,
+		maxDelay:    time.Duration(maxDelay) * time.Second,
+	}
+	return
+}
+
+// backoff returns the delay before the next attempt (exponential growth with "equal jitter"). A zero base delay
+// retries on the next poll
+func (r *retryQueue) backoff(attempts int) time.Duration {
+	if r.baseDelay <= 0 {
+		return 0
+	}
+	delay := r.maxDelay
+	if attempts < 32 {
+		if exp := r.baseDelay << uint(attempts-1); exp > 0 && exp < r.maxDelay {
+			delay = exp
+		}
+	}
+	if delay <= 0 {
+		return 0
+	}
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
+
+// schedule queues a failed batch for a new attempt. Returns false if the batch must be abandoned because it
+// exceeded its max attempts, max age or there is no room left in the retry queue
+func (r *retryQueue) schedule(batch *retryBatch, now time.Time) bool {
+	if batch.attempts >= r.maxAttempts || now.Sub(batch.first) >= r.maxAge {
+		return false
+	}
+	if r.size+len(batch.alerts) > r.maxSize {
+		return false
+	}
+	batch.next = now.Add(r.backoff(batch.attempts))
+	r.batches = append(r.batches, batch)
+	r.size += len(batch.alerts)
+	return true
+}
+
+// due returns the first batch whose backoff has expired and fits in the available quota (nil if none)
+func (r *retryQueue) due(now time.Time, quota int) (batch *retryBatch) {
+	for idx, candidate := range r.batches {
+		if !candidate.next.After(now) && len(candidate.alerts) <= quota {
+			batch = candidate
+			r.batches = append(r.batches[:idx], r.batches[idx+1:]...)
+			r.size -= len(batch.alerts)
+			return
+		}
+	}
+	return
+}
+
+// retry sends the batches whose backoff has expired as long as there is quota left for them and XDR is not
+// throttling the pipe
+func (a *alertPipe) retry() {
+	if a.retries == nil {
+		return
+	}
+	now := time.Now()
+	retried := false
+	for !a.paused() {
+		batch := a.retries.due(now, a.t1Bucket)
+		if batch == nil {
+			break
+		}
+		retried = true
+		count := uint64(len(batch.alerts))
+		a.t1Bucket -= len(batch.alerts)
+		atomic.AddUint64(&a.stats.PipeRetried, count)
+		if batch.err = a.send(batch.alerts); batch.err == nil {
+			atomic.AddUint64(&a.stats.PipeOut, count)
+			atomic.AddUint64(&a.stats.PipeRecovered, count)
+			a.unthrottle()
+			if a.debug {
+				log.Printf("pipe - recovered %v alerts after %v attempts", count, batch.attempts+1)
+			}
+		} else {
+			atomic.AddUint64(&a.stats.PipeOutErr, count)
+			a.throttle(batch.err)
+			a.fail(batch, now)
+		}
+	}
+	if retried {
+		a.commit()
+	}
+}
+
+// fail schedules a failed batch for retry or abandons it. Batches rejected with a permanent error (XDR answers other
+// than 429 and 5xx) are abandoned at once as they would fail again
+func (a *alertPipe) fail(batch *retryBatch, now time.Time) {
+	batch.attempts++
+	var httpErr *xdrclient.HTTPError
+	if errors.As(batch.err, &httpErr) && !httpErr.Temporary() {
+		a.abandon(batch, now)
+		return
+	}
+	if a.retries != nil && a.retries.schedule(batch, now) {
+		return
+	}
+	a.abandon(batch, now)
+}
+
+// abandon drops the batch, moving it to the dead-letter store if available
+func (a *alertPipe) abandon(batch *retryBatch, now time.Time) {
+	atomic.AddUint64(&a.stats.PipeAbandoned, uint64(len(batch.alerts)))
+	log.Printf("pipe error - abandoning %v alerts after %v attempts (%v)", len(batch.alerts), batch.attempts, batch.err)
+	if a.deadLetters != nil {
+		if err := a.deadLetters.put(batch, now); err != nil {
+			log.Println("deadletter error - unable to store abandoned alerts:", err)
+		}
+	}
+}
+
+// abandonRetries gives up on all pending retries (used when the pipe is closed). The disk queue cursor was not
+// committed past them so, with the persistent queue, they are kept to be replayed on the next start instead
+func (a *alertPipe) abandonRetries() {
+	if a.retries == nil {
+		return
+	}
+	if _, persistent := a.queue.(*diskQueue); persistent {
+		if a.retries.size > 0 {
+			log.Printf("pipe - %v alerts pending retry will be replayed from the disk queue", a.retries.size)
+		}
+		return
+	}
+	now := time.Now()
+	for _, batch := range a.retries.batches {
+		a.abandon(batch, now)
+	}
+	a.retries.batches, a.retries.size = nil, 0
+}
@@ -0,0 +1,91 @@
+package xdrgateway
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/xhoms/xdrgateway/xdrclient"
+)
+
+func TestRetryBackoff(t *testing.T) {
+	for _, test := range []struct {
+		name          string
+		base, max     int
+		attempts      int
+		minimum, most time.Duration
+	}{
+		{"zero base delay", 0, 120, 3, 0, 0},
+		{"first attempt", 2, 120, 1, time.Second, 2 * time.Second},
+		{"third attempt", 2, 120, 3, 4 * time.Second, 8 * time.Second},
+		{"capped", 2, 10, 5, 5 * time.Second, 10 * time.Second},
+		{"shift overflow", 2, 10, 40, 5 * time.Second, 10 * time.Second},
+	} {
+		queue := newRetryQueue(5, 600, test.base, test.max, 100)
+		for i := 0; i < 20; i++ {
+			if delay := queue.backoff(test.attempts); delay < test.minimum || delay > test.most {
+				t.Errorf("%v: delay %v out of [%v, %v]", test.name, delay, test.minimum, test.most)
+				break
+			}
+		}
+	}
+}
+
+func TestRetrySchedule(t *testing.T) {
+	now := time.Now()
+	batch := func(size, attempts int, age time.Duration) *retryBatch {
+		return &retryBatch{alerts: make([]*xdrclient.Alert, size), attempts: attempts, first: now.Add(-age)}
+	}
+	for _, test := range []struct {
+		name      string
+		batch     *retryBatch
+		scheduled bool
+	}{
+		{"scheduled", batch(5, 1, 0), true},
+		{"max attempts", batch(5, 3, 0), false},
+		{"max age", batch(5, 1, time.Hour), false},
+		{"no room", batch(11, 1, 0), false},
+	} {
+		queue := newRetryQueue(3, 60, 0, 10, 10)
+		if scheduled := queue.schedule(test.batch, now); scheduled != test.scheduled {
+			t.Errorf("%v: scheduled %v", test.name, scheduled)
+		}
+	}
+	queue := newRetryQueue(3, 60, 0, 10, 10)
+	queue.schedule(batch(6, 1, 0), now)
+	queue.schedule(batch(3, 1, 0), now)
+	if due := queue.due(now, 4); due == nil || len(due.alerts) != 3 || queue.size != 6 {
+		t.Errorf("expected the batch fitting in the quota, got %+v (size %v)", due, queue.size)
+	}
+	if due := queue.due(now, 4); due != nil {
+		t.Errorf("unexpected batch exceeding the quota %+v", due)
+	}
+}
+
+func TestPipeRetry(t *testing.T) {
+	for _, test := range []struct {
+		name      string
+		err       error
+		abandoned uint64
+		recovered uint64
+	}{
+		{"server error", &xdrclient.HTTPError{StatusCode: http.StatusBadGateway}, 0, 3},
+		{"network error", errors.New("connection reset"), 0, 3},
+		{"permanent error", &xdrclient.HTTPError{StatusCode: http.StatusBadRequest}, 3, 0},
+	} {
+		sink := &recordingSink{errors: []error{test.err}}
+		ops := testPipeOps(100, 0)
+		ops.RetryMaxAttempts, ops.RetryMaxAge, ops.RetryMaxDelay = 3, 60, 10
+		pipe := newAlertPipe([]Sink{sink}, ops)
+		for i := 0; i < 3; i++ {
+			pipe.ingest(testAlert("retry", xdrclient.SeverityHigh))
+		}
+		pipe.drain()
+		pipe.drain()
+		stats := pipe.close()
+		if stats.PipeAbandoned != test.abandoned || stats.PipeRecovered != test.recovered {
+			t.Errorf("%v: abandoned %v, recovered %v", test.name, stats.PipeAbandoned, stats.PipeRecovered)
+		}
+	}
+}
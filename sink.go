@@ -0,0 +1,347 @@
+package xdrgateway
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/xhoms/xdrgateway/xdrclient"
+)
+
+const (
+	sinkTimeout    = 10 * time.Second
+	archiveBacklog = 64
+	syslogFacility = 1 // user-level messages
+	syslogSeverity = 5 // notice
+	syslogAppName  = "xdrgateway"
+)
+
+// Sink receives the batches of alerts delivered by the pipe. *xdrclient.Client is the main implementation but the
+// package provides sinks for NDJSON files, stdout, HTTP webhooks and syslog servers as well
+type Sink interface {
+	// SendMulti delivers a batch of alerts. An error means the batch was not accepted
+	SendMulti(alerts []*xdrclient.Alert) error
+}
+
+// SinkStats provides counters for each sink the pipe delivers alerts to
+type SinkStats struct {
+	// Name identifies the sink
+	Name string
+	// Batches is the number of batches successfully delivered
+	Batches uint64
+	// Alerts is the number of alerts successfully delivered
+	Alerts uint64
+	// Failures is the number of batches that failed to be delivered
+	Failures uint64
+	// Dropped is the number of batches discarded because the sink was not keeping up (archive sinks only)
+	Dropped uint64
+}
+
+// Snapshot returns a copy of the counters that is safe to read while the pipe is in use
+func (s *SinkStats) Snapshot() SinkStats {
+	return SinkStats{
+		Name:     s.Name,
+		Batches:  atomic.LoadUint64(&s.Batches),
+		Alerts:   atomic.LoadUint64(&s.Alerts),
+		Failures: atomic.LoadUint64(&s.Failures),
+		Dropped:  atomic.LoadUint64(&s.Dropped),
+	}
+}
+
+// sinkName returns a human-readable name for the sink
+func sinkName(sink Sink) string {
+	switch s := sink.(type) {
+	case *xdrclient.Client:
+		if s != nil {
+			return "xdr:" + s.FQDN
+		}
+	case fmt.Stringer:
+		return s.String()
+	}
+	return fmt.Sprintf("%T", sink)
+}
+
+// NewSinkFromSpec creates one of the built-in sinks from its textual specification
+//
+// - stdout writes each alert as a NDJSON line to the standard output
+//
+// - file:<path> appends each alert as a NDJSON line to the file
+//
+// - webhook:<url> POSTs each batch to the URL using the XDR insert_parsed_alerts payload format
+//
+// - syslog:<udp|tcp>://<host>:<port> sends each alert as a RFC 5424 message with a JSON body
+//
+// The XDR sink is not supported here as it requires API credentials (use xdrclient.NewClientFromEnv instead)
+func NewSinkFromSpec(spec string) (sink Sink, err error) {
+	kind, target := spec, ""
+	if idx := strings.Index(spec, ":"); idx >= 0 {
+		kind, target = spec[:idx], spec[idx+1:]
+	}
+	switch kind {
+	case "stdout":
+		sink = NewStdoutSink()
+	case "file":
+		sink, err = NewFileSink(target)
+	case "webhook":
+		sink, err = NewWebhookSink(target, nil)
+	case "syslog":
+		var u *url.URL
+		if u, err = url.Parse(target); err == nil {
+			sink, err = NewSyslogSink(u.Scheme, u.Host)
+		}
+	default:
+		err = fmt.Errorf("unknown sink %v", spec)
+	}
+	return
+}
+
+// WriterSink writes each alert as a NDJSON line (XDR JSON representation) to an io.Writer
+type WriterSink struct {
+	name string
+	mu   sync.Mutex
+	w    io.Writer
+}
+
+// NewWriterSink creates a sink that writes NDJSON lines to w
+func NewWriterSink(name string, w io.Writer) (s *WriterSink) {
+	s = &WriterSink{name: name, w: w}
+	return
+}
+
+// NewStdoutSink creates a sink that writes NDJSON lines to the standard output (dry-run or lab deployments)
+func NewStdoutSink() *WriterSink {
+	return NewWriterSink("stdout", os.Stdout)
+}
+
+// NewFileSink creates a sink that appends NDJSON lines to the file at path
+func NewFileSink(path string) (s *WriterSink, err error) {
+	var file *os.File
+	if file, err = os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600); err == nil {
+		s = NewWriterSink("file:"+path, file)
+	}
+	return
+}
+
+// SendMulti implements the Sink interface
+func (s *WriterSink) SendMulti(alerts []*xdrclient.Alert) (err error) {
+	buff := new(bytes.Buffer)
+	for _, alert := range alerts {
+		var line []byte
+		if line, err = xdrclient.EncodeAlert(alert); err != nil {
+			return
+		}
+		buff.Write(line)
+		buff.WriteByte('\n')
+	}
+	s.mu.Lock()
+	_, err = s.w.Write(buff.Bytes())
+	s.mu.Unlock()
+	return
+}
+
+func (s *WriterSink) String() string {
+	return s.name
+}
+
+// WebhookSink POSTs each batch to a HTTP endpoint using the XDR insert_parsed_alerts payload format
+type WebhookSink struct {
+	url     string
+	headers http.Header
+	client  *http.Client
+}
+
+// NewWebhookSink creates a webhook sink. Optional headers (i.e. Authorization) are added to each request
+func NewWebhookSink(endpoint string, headers http.Header) (s *WebhookSink, err error) {
+	var u *url.URL
+	if u, err = url.Parse(endpoint); err != nil {
+		return
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		err = fmt.Errorf("unsupported webhook url %v", endpoint)
+		return
+	}
+	s = &WebhookSink{
+		url:     endpoint,
+		headers: headers,
+		client:  &http.Client{Timeout: sinkTimeout},
+	}
+	return
+}
+
+// SendMulti implements the Sink interface. Any non 2xx response is considered an error
+func (s *WebhookSink) SendMulti(alerts []*xdrclient.Alert) (err error) {
+	var payload []byte
+	if payload, err = xdrclient.EncodePayload(alerts); err != nil {
+		return
+	}
+	var request *http.Request
+	if request, err = http.NewRequest(http.MethodPost, s.url, bytes.NewReader(payload)); err != nil {
+		return
+	}
+	for key, values := range s.headers {
+		request.Header[key] = values
+	}
+	request.Header.Set("Content-Type", "application/json")
+	var resp *http.Response
+	if resp, err = s.client.Do(request); err == nil {
+		io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode < 200 || resp.StatusCode > 299 {
+			err = fmt.Errorf("webhook - unexpected response status %v", resp.Status)
+		}
+	}
+	return
+}
+
+func (s *WebhookSink) String() string {
+	return "webhook:" + s.url
+}
+
+// SyslogSink sends each alert as a RFC 5424 message (JSON body) to a syslog server over UDP or TCP
+type SyslogSink struct {
+	network  string
+	address  string
+	hostname string
+	mu       sync.Mutex
+	conn     net.Conn
+}
+
+// NewSyslogSink creates a syslog sink. The connection is established on first use and re-established after errors
+func NewSyslogSink(network, address string) (s *SyslogSink, err error) {
+	if network != "udp" && network != "tcp" {
+		err = fmt.Errorf("unsupported syslog network %v", network)
+		return
+	}
+	hostname, _ := os.Hostname()
+	if hostname == "" {
+		hostname = "-"
+	}
+	s = &SyslogSink{
+		network:  network,
+		address:  address,
+		hostname: hostname,
+	}
+	return
+}
+
+// SendMulti implements the Sink interface
+func (s *SyslogSink) SendMulti(alerts []*xdrclient.Alert) (err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conn == nil {
+		if s.conn, err = net.DialTimeout(s.network, s.address, sinkTimeout); err != nil {
+			s.conn = nil
+			return
+		}
+	}
+	for _, alert := range alerts {
+		var body []byte
+		if body, err = xdrclient.EncodeAlert(alert); err != nil {
+			return
+		}
+		msg := fmt.Sprintf("<%d>1 %v %v %v - - - %s\n", syslogFacility*8+syslogSeverity,
+			time.Now().UTC().Format(time.RFC3339Nano), s.hostname, syslogAppName, body)
+		s.conn.SetWriteDeadline(time.Now().Add(sinkTimeout))
+		if _, err = io.WriteString(s.conn, msg); err != nil {
+			s.conn.Close()
+			s.conn = nil
+			return
+		}
+	}
+	return
+}
+
+func (s *SyslogSink) String() string {
+	return "syslog:" + s.network + "://" + s.address
+}
+
+// send delivers the batch to the primary sink
+func (a *alertPipe) send(alerts []*xdrclient.Alert) (err error) {
+	stats := a.sinkStats[0]
+	start := time.Now()
+	err = a.sink.SendMulti(alerts)
+	a.histograms.observe(time.Since(start), len(alerts), err)
+	if err == nil {
+		atomic.AddUint64(&stats.Batches, 1)
+		atomic.AddUint64(&stats.Alerts, uint64(len(alerts)))
+	} else {
+		atomic.AddUint64(&stats.Failures, 1)
+	}
+	return
+}
+
+// archiveSink delivers batches to a secondary sink from its own goroutine so a slow or unreachable archive does
+// not stall the delivery to the primary sink
+type archiveSink struct {
+	sink    Sink
+	stats   *SinkStats
+	batches chan []*xdrclient.Alert
+}
+
+func (a *alertPipe) startArchive(sink Sink, stats *SinkStats) {
+	archive := &archiveSink{
+		sink:    sink,
+		stats:   stats,
+		batches: make(chan []*xdrclient.Alert, archiveBacklog),
+	}
+	a.archives = append(a.archives, archive)
+	a.archiveWG.Add(1)
+	go func() {
+		defer a.archiveWG.Done()
+		for alerts := range archive.batches {
+			if err := archive.sink.SendMulti(alerts); err == nil {
+				atomic.AddUint64(&archive.stats.Batches, 1)
+				atomic.AddUint64(&archive.stats.Alerts, uint64(len(alerts)))
+			} else {
+				atomic.AddUint64(&archive.stats.Failures, 1)
+				atomic.AddUint64(&a.stats.ArchiveFailures, 1)
+				log.Printf("pipe error - sink %v: %v", archive.stats.Name, err)
+			}
+		}
+	}()
+}
+
+// archive queues a best-effort copy of the batch for the secondary sinks. The batch is dropped for the sinks whose
+// backlog is full
+func (a *alertPipe) archive(alerts []*xdrclient.Alert) {
+	if len(a.archives) == 0 {
+		return
+	}
+	batch := make([]*xdrclient.Alert, len(alerts))
+	copy(batch, alerts)
+	for _, archive := range a.archives {
+		select {
+		case archive.batches <- batch:
+		default:
+			atomic.AddUint64(&archive.stats.Dropped, 1)
+			atomic.AddUint64(&a.stats.ArchiveFailures, 1)
+		}
+	}
+}
+
+// closeArchives waits (up to the sink timeout) for the secondary sinks to deliver their backlog
+func (a *alertPipe) closeArchives() {
+	for _, archive := range a.archives {
+		close(archive.batches)
+	}
+	done := make(chan struct{})
+	go func() {
+		a.archiveWG.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(sinkTimeout):
+		log.Println("pipe error - archive sinks did not deliver their backlog before the timeout")
+	}
+}
@@ -0,0 +1,160 @@
+package xdrgateway
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/xhoms/xdrgateway/xdrclient"
+)
+
+// blockingSink blocks each batch until release is closed
+type blockingSink struct {
+	release chan struct{}
+}
+
+func (s *blockingSink) SendMulti(alerts []*xdrclient.Alert) error {
+	<-s.release
+	return nil
+}
+
+func TestNewSinkFromSpec(t *testing.T) {
+	for _, test := range []struct {
+		spec, name string
+		fails      bool
+	}{
+		{"stdout", "stdout", false},
+		{"webhook:http://127.0.0.1:9/alerts", "webhook:http://127.0.0.1:9/alerts", false},
+		{"syslog:udp://127.0.0.1:514", "syslog:udp://127.0.0.1:514", false},
+		{"webhook:ftp://host/alerts", "", true},
+		{"syslog:icmp://host", "", true},
+		{"xdr", "", true},
+	} {
+		sink, err := NewSinkFromSpec(test.spec)
+		if (err != nil) != test.fails || (err == nil && sinkName(sink) != test.name) {
+			t.Errorf("%v: unexpected sink %v (%v)", test.spec, sink, err)
+		}
+	}
+}
+
+func TestWriterSink(t *testing.T) {
+	out := new(bytes.Buffer)
+	sink := NewWriterSink("test", out)
+	if err := sink.SendMulti([]*xdrclient.Alert{testAlert("one", xdrclient.SeverityHigh), testAlert("two", xdrclient.SeverityLow)}); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 2 || !strings.Contains(lines[1], `"two"`) {
+		t.Errorf("unexpected NDJSON output %q", out.String())
+	}
+}
+
+func TestWebhookSink(t *testing.T) {
+	status := http.StatusOK
+	var received map[string]interface{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "secret" || r.Header.Get("Content-Type") != "application/json" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		json.Unmarshal(body, &received)
+		w.WriteHeader(status)
+	}))
+	defer server.Close()
+	sink, err := NewWebhookSink(server.URL, http.Header{"Authorization": []string{"secret"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	alerts := []*xdrclient.Alert{testAlert("hook", xdrclient.SeverityHigh)}
+	if err = sink.SendMulti(alerts); err != nil || received["request_data"] == nil {
+		t.Errorf("unexpected result %v (payload %v)", err, received)
+	}
+	status = http.StatusBadGateway
+	if err = sink.SendMulti(alerts); err == nil {
+		t.Error("expected error for a non 2xx response")
+	}
+}
+
+func TestSyslogSink(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	lines := make(chan string, 2)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		scanner := bufio.NewScanner(conn)
+		for scanner.Scan() {
+			lines <- scanner.Text()
+		}
+	}()
+	sink, err := NewSyslogSink("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = sink.SendMulti([]*xdrclient.Alert{testAlert("one", xdrclient.SeverityHigh), testAlert("two", xdrclient.SeverityLow)}); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"one", "two"} {
+		select {
+		case line := <-lines:
+			if !strings.HasPrefix(line, "<13>1 ") || !strings.Contains(line, " xdrgateway - - - {") || !strings.Contains(line, `"`+name+`"`) {
+				t.Errorf("unexpected syslog message %q", line)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatal("syslog message not received")
+		}
+	}
+}
+
+// TestPipeArchive checks that a stuck archive sink does not delay the primary one and that its failures and drops
+// are counted
+func TestPipeArchive(t *testing.T) {
+	primary, failing := &recordingSink{}, &recordingSink{errors: []error{errors.New("down")}}
+	stuck := &blockingSink{release: make(chan struct{})}
+	pipe := newAlertPipe([]Sink{primary, stuck, failing}, testPipeOps(1000, 0))
+	batches := archiveBacklog + 5
+	for i := 0; i < batches; i++ {
+		pipe.ingest(testAlert("archive", xdrclient.SeverityHigh))
+		done := make(chan struct{})
+		go func() {
+			pipe.drain()
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-time.After(2 * time.Second):
+			t.Fatal("primary delivery stalled by the archive sink")
+		}
+	}
+	close(stuck.release)
+	stats := pipe.close().Snapshot()
+	if len(primary.alerts()) != batches {
+		t.Errorf("primary got %v alerts", len(primary.alerts()))
+	}
+	// the failing archive may also drop batches if its worker falls behind the loop
+	failingStats := stats.Sinks[2]
+	if archived := uint64(len(failing.alerts())); archived != failingStats.Batches || failingStats.Failures != 1 || archived+failingStats.Dropped+1 != uint64(batches) {
+		t.Errorf("failing archive got %v alerts (%+v)", archived, failingStats)
+	}
+	if stuckStats := stats.Sinks[1]; stuckStats.Dropped < uint64(batches-archiveBacklog-1) || stuckStats.Dropped+stuckStats.Batches != uint64(batches) {
+		t.Errorf("unexpected stuck archive stats %+v", stats.Sinks[1])
+	}
+	if stats.ArchiveFailures != stats.Sinks[1].Dropped+failingStats.Dropped+1 {
+		t.Errorf("unexpected archive failures %v", stats.ArchiveFailures)
+	}
+}
@@ -0,0 +1,352 @@
+package xdrgateway
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	syslogMaxMessage       = 64 * 1024
+	syslogHandshakeTimeout = 10 * time.Second
+)
+
+// SyslogListener receives PAN-OS logs over syslog (UDP, TCP or TLS) and feeds them into the pipe. TCP and TLS
+// streams support both octet-counting and LF-delimited framing (RFC 6587)
+type SyslogListener struct {
+	api      *API
+	parser   *parserEntry
+	name     string
+	packet   net.PacketConn
+	listener net.Listener
+	mu       sync.Mutex
+	conns    map[net.Conn]bool
+	closed   bool
+	wg       sync.WaitGroup
+}
+
+// ListenSyslog starts a syslog listener on address. Supported networks are udp, tcp and tls (config is required for
+// the latter). Messages are converted into alerts by parser (typically a *CSVParser) and routed as any other alert.
+// Parser counters are reported under the `syslog` name. The tls listener requires firewalls to present a client
+// certificate verified by the ClientCertAuth (SetClientCertAuth must be called before). Messages are accepted from
+// the addresses provided to SetSyslogAllowedCIDRs only (any address if none)
+func (a *API) ListenSyslog(network, address string, parser Parser, config *tls.Config) (l *SyslogListener, err error) {
+	if a.syslog == nil || a.syslog.parser != parser {
+		a.syslog = a.newParserEntry(syslogParserName, parser)
+	}
+	l = &SyslogListener{
+		api:    a,
+		parser: a.syslog,
+		name:   network + "://" + address,
+		conns:  make(map[net.Conn]bool),
+	}
+	switch network {
+	case "udp":
+		if l.packet, err = net.ListenPacket("udp", address); err == nil {
+			l.wg.Add(1)
+			go l.servePackets()
+		}
+	case "tcp", "tls":
+		if network == "tls" {
+			if config == nil {
+				err = fmt.Errorf("syslog - missing TLS configuration for %v", l.name)
+				return
+			}
+			if a.clientAuth == nil {
+				err = fmt.Errorf("syslog - client certificate authentication required by %v", l.name)
+				return
+			}
+			// verification is left to the ClientCertAuth so denials are counted
+			config = config.Clone()
+			config.ClientAuth = tls.RequestClientCert
+			l.listener, err = tls.Listen("tcp", address, config)
+		} else {
+			l.listener, err = net.Listen("tcp", address)
+		}
+		if err == nil {
+			l.wg.Add(1)
+			go l.serveStreams()
+		}
+	default:
+		err = fmt.Errorf("syslog - unsupported network %v", network)
+	}
+	if err != nil {
+		l = nil
+		return
+	}
+	a.listeners = append(a.listeners, l)
+	log.Println("starting syslog listener on", l.name)
+	if len(a.syslogNets) == 0 {
+		log.Printf("syslog - %v accepts messages from any address", l.name)
+	}
+	return
+}
+
+// SetSyslogAllowedCIDRs restricts the addresses the syslog listeners accept messages from. Messages from other
+// addresses are dropped and counted in SyslogDenied
+func (a *API) SetSyslogAllowedCIDRs(cidrs []string) (err error) {
+	var nets []*net.IPNet
+	for _, cidr := range cidrs {
+		var ipnet *net.IPNet
+		if _, ipnet, err = net.ParseCIDR(strings.TrimSpace(cidr)); err != nil {
+			return
+		}
+		nets = append(nets, ipnet)
+	}
+	a.syslogNets = nets
+	return
+}
+
+// syslogAllowed returns true if the syslog listeners accept messages from remote
+func (a *API) syslogAllowed(remote net.IP) bool {
+	if len(a.syslogNets) == 0 {
+		return true
+	}
+	if remote != nil {
+		for _, ipnet := range a.syslogNets {
+			if ipnet.Contains(remote) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Close stops accepting messages and waits for the listener goroutines to end
+func (l *SyslogListener) Close() (err error) {
+	l.mu.Lock()
+	if l.closed {
+		l.mu.Unlock()
+		return
+	}
+	l.closed = true
+	if l.packet != nil {
+		err = l.packet.Close()
+	} else {
+		err = l.listener.Close()
+	}
+	for conn := range l.conns {
+		conn.Close()
+	}
+	l.mu.Unlock()
+	l.wg.Wait()
+	log.Println("syslog listener on", l.name, "closed")
+	return
+}
+
+func (l *SyslogListener) isClosed() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.closed
+}
+
+func (l *SyslogListener) servePackets() {
+	defer l.wg.Done()
+	buff := make([]byte, syslogMaxMessage)
+	for {
+		n, addr, err := l.packet.ReadFrom(buff)
+		if err != nil {
+			if l.isClosed() {
+				return
+			}
+			atomic.AddUint64(&l.api.stats.SyslogErrors, 1)
+			log.Println("syslog error -", err)
+			continue
+		}
+		src := &origin{}
+		if udpAddr, ok := addr.(*net.UDPAddr); ok {
+			src.remote = udpAddr.IP
+		}
+		l.handle(buff[:n], src)
+	}
+}
+
+func (l *SyslogListener) serveStreams() {
+	defer l.wg.Done()
+	for {
+		conn, err := l.listener.Accept()
+		if err != nil {
+			if l.isClosed() {
+				return
+			}
+			atomic.AddUint64(&l.api.stats.SyslogErrors, 1)
+			log.Println("syslog error -", err)
+			continue
+		}
+		l.mu.Lock()
+		if l.closed {
+			l.mu.Unlock()
+			conn.Close()
+			return
+		}
+		l.conns[conn] = true
+		l.wg.Add(1)
+		l.mu.Unlock()
+		go l.serveStream(conn)
+	}
+}
+
+func (l *SyslogListener) serveStream(conn net.Conn) {
+	defer func() {
+		l.mu.Lock()
+		delete(l.conns, conn)
+		l.mu.Unlock()
+		conn.Close()
+		l.wg.Done()
+	}()
+	src := &origin{}
+	if tcpAddr, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+		src.remote = tcpAddr.IP
+	}
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		var verified bool
+		if src.identity, verified = l.verify(tlsConn); !verified {
+			return
+		}
+	}
+	scanner := bufio.NewScanner(conn)
+	scanner.Buffer(make([]byte, 4096), syslogMaxMessage)
+	scanner.Split(syslogSplit)
+	for scanner.Scan() {
+		l.handle(scanner.Bytes(), src)
+	}
+	if err := scanner.Err(); err != nil && !l.isClosed() {
+		atomic.AddUint64(&l.api.stats.SyslogErrors, 1)
+		log.Println("syslog error -", err)
+	}
+}
+
+// verify completes the TLS handshake and returns the device identity of the client certificate
+func (l *SyslogListener) verify(conn *tls.Conn) (identity string, verified bool) {
+	conn.SetDeadline(time.Now().Add(syslogHandshakeTimeout))
+	if err := conn.Handshake(); err != nil {
+		if !l.isClosed() {
+			atomic.AddUint64(&l.api.stats.SyslogErrors, 1)
+			log.Println("syslog error -", err)
+		}
+		return
+	}
+	conn.SetDeadline(time.Time{})
+	denial := denialMissingCertificate
+	if chain := conn.ConnectionState().PeerCertificates; len(chain) > 0 {
+		identity, denial = l.api.clientAuth.identity(chain)
+	}
+	if denial != "" {
+		l.api.stats.ClientCertDenials.count(denial)
+		log.Printf("syslog error - connection from %v rejected: %v", conn.RemoteAddr(), denialMessages[denial])
+		return
+	}
+	verified = true
+	return
+}
+
+func (l *SyslogListener) handle(msg []byte, src *origin) {
+	if msg = bytes.TrimRight(msg, "\r\n\x00"); len(msg) == 0 {
+		return
+	}
+	atomic.AddUint64(&l.api.stats.SyslogMessages, 1)
+	if !l.api.syslogAllowed(src.remote) {
+		atomic.AddUint64(&l.api.stats.SyslogDenied, 1)
+		if l.api.debug {
+			log.Println("syslog error - message from a not allowed address", src.remote)
+		}
+		return
+	}
+	switch err := l.api.ingest(l.parser, msg, src); err {
+	case nil:
+		if l.api.debug {
+			log.Println("syslog - sucessfully parsed alert")
+		}
+	case ErrPipeFull, ErrPipeClosed:
+		log.Println("syslog error - alert not accepted:", err)
+	case ErrSerialMismatch:
+		log.Printf("syslog error - alert not accepted: %v (identity %v)", err, src.identity)
+	default:
+		if l.api.debug {
+			log.Println("syslog error - unparseable message:", err)
+		}
+	}
+}
+
+// syslogSplit is a bufio.SplitFunc supporting octet-counting ("<len> <msg>") and LF-delimited framing
+func syslogSplit(data []byte, atEOF bool) (advance int, token []byte, err error) {
+	if len(data) == 0 {
+		return
+	}
+	if data[0] >= '1' && data[0] <= '9' {
+		if sp := bytes.IndexByte(data, ' '); sp > 0 {
+			var size int
+			if size, err = strconv.Atoi(string(data[:sp])); err != nil || size > syslogMaxMessage {
+				err = fmt.Errorf("syslog - invalid frame length %q", data[:sp])
+				return
+			}
+			if len(data) >= sp+1+size {
+				return sp + 1 + size, data[sp+1 : sp+1+size], nil
+			}
+		}
+		if atEOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return
+	}
+	return bufio.ScanLines(data, atEOF)
+}
+
+// syslogMessage strips the BSD (RFC 3164) or IETF (RFC 5424) header of a syslog message, if any
+func syslogMessage(data []byte) []byte {
+	if len(data) == 0 || data[0] != '<' {
+		return data
+	}
+	end := bytes.IndexByte(data, '>')
+	if end < 0 || end > 4 {
+		return data
+	}
+	msg := data[end+1:]
+	if len(msg) > 1 && msg[0] == '1' && msg[1] == ' ' {
+		// IETF: VERSION TIMESTAMP HOSTNAME APP-NAME PROCID MSGID STRUCTURED-DATA MSG
+		msg = syslogSkip(msg[2:], 5)
+		if len(msg) > 0 && msg[0] == '-' {
+			msg = msg[1:]
+		}
+		for len(msg) > 0 && msg[0] == '[' {
+			idx := 1
+			for ; idx < len(msg) && msg[idx] != ']'; idx++ {
+				if msg[idx] == '\\' {
+					idx++
+				}
+			}
+			if idx >= len(msg) {
+				return msg[len(msg):]
+			}
+			msg = msg[idx+1:]
+		}
+		return bytes.TrimPrefix(bytes.TrimLeft(msg, " "), []byte("\xef\xbb\xbf"))
+	}
+	// BSD: TIMESTAMP (Mmm dd hh:mm:ss or ISO 8601) HOSTNAME MSG
+	if len(msg) > 0 && msg[0] >= '0' && msg[0] <= '9' {
+		return syslogSkip(msg, 2)
+	}
+	return syslogSkip(msg, 4)
+}
+
+// syslogSkip removes count space-separated tokens from the beginning of msg
+func syslogSkip(msg []byte, count int) []byte {
+	for ; count > 0; count-- {
+		msg = bytes.TrimLeft(msg, " ")
+		if idx := bytes.IndexByte(msg, ' '); idx >= 0 {
+			msg = msg[idx:]
+		} else {
+			return msg[len(msg):]
+		}
+	}
+	return bytes.TrimLeft(msg, " ")
+}
@@ -0,0 +1,233 @@
+package xdrgateway
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestSyslog starts a syslog listener on a random local port. The alerts are delivered to the returned sink when
+// the pipe is drained
+func newTestSyslog(t *testing.T, network string, config *tls.Config, setup func(api *API)) (api *API, l *SyslogListener, sink *recordingSink) {
+	sink = &recordingSink{}
+	api = NewAPI(NewBasicParser(0, false), sink, "psk", false, testPipeOps(100, 0))
+	if setup != nil {
+		setup(api)
+	}
+	parser, err := NewCSVParser(0, "", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l, err = api.ListenSyslog(network, "127.0.0.1:0", parser, config); err != nil {
+		api.Close()
+		t.Fatal(err)
+	}
+	return
+}
+
+// syslogAddr returns the address the listener is bound to
+func syslogAddr(l *SyslogListener) string {
+	if l.packet != nil {
+		return l.packet.LocalAddr().String()
+	}
+	return l.listener.Addr().String()
+}
+
+// waitSyslog waits for the listener goroutines to update the statistics
+func waitSyslog(api *API, done func(stats *AppStats) bool) bool {
+	for deadline := time.Now().Add(2 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if done(api.Stats()) {
+			return true
+		}
+	}
+	return false
+}
+
+func TestSyslogAllowedCIDRs(t *testing.T) {
+	if err := newTestAPI().SetSyslogAllowedCIDRs([]string{"192.0.2.1"}); err == nil {
+		t.Error("expected error for the invalid cidr")
+	}
+	for _, test := range []struct {
+		name    string
+		cidrs   []string
+		allowed bool
+	}{
+		{"any address", nil, true},
+		{"allowed", []string{"192.0.2.0/24", " 127.0.0.0/8"}, true},
+		{"not allowed", []string{"192.0.2.0/24"}, false},
+	} {
+		api, l, sink := newTestSyslog(t, "udp", nil, func(api *API) {
+			if err := api.SetSyslogAllowedCIDRs(test.cidrs); err != nil {
+				t.Fatal(err)
+			}
+		})
+		conn, err := net.Dial("udp", syslogAddr(l))
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.Write([]byte("<14>Jul  1 12:00:00 fw01 " + testThreatLog(panosThreatType, panosThreatLayout80.severity+1)))
+		conn.Close()
+		if !waitSyslog(api, func(stats *AppStats) bool {
+			return stats.SyslogMessages == 1 && stats.EventsReceived > 0 || stats.SyslogDenied > 0
+		}) {
+			t.Errorf("%v: message not processed", test.name)
+		}
+		api.route.pipe.drain()
+		if stats := api.Stats(); (len(sink.alerts()) == 1) != test.allowed || (stats.SyslogDenied == 0) != test.allowed {
+			t.Errorf("%v: %v alerts delivered (%v denied)", test.name, len(sink.alerts()), stats.SyslogDenied)
+		}
+		l.Close()
+		api.Close()
+	}
+}
+
+func TestSyslogTLS(t *testing.T) {
+	ca, caKey := testCertificate(t, "ca", 1, nil, nil)
+	rogueCA, rogueKey := testCertificate(t, "rogue", 1, nil, nil)
+	server, serverKey := testCertificate(t, "127.0.0.1", 2, ca, caKey)
+	known, knownKey := testCertificate(t, "fw-1", 3, ca, caKey)
+	rogue, rogueCertKey := testCertificate(t, "fw-1", 3, rogueCA, rogueKey)
+	config := &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{server.Raw}, PrivateKey: serverKey}}}
+	auth := &ClientCertAuth{CAs: x509.NewCertPool(), MatchSerial: true}
+	auth.CAs.AddCert(ca)
+	if _, err := newTestAPI().ListenSyslog("tls", "127.0.0.1:0", NewBasicParser(0, false), config); err == nil {
+		t.Error("expected error for the TLS listener without client certificate authentication")
+	}
+	for _, test := range []struct {
+		name    string
+		client  []tls.Certificate
+		serial  string
+		denials ClientCertDenials
+	}{
+		{"verified", []tls.Certificate{{Certificate: [][]byte{known.Raw}, PrivateKey: knownKey}}, "fw-1", ClientCertDenials{}},
+		{"missing certificate", nil, "fw-1", ClientCertDenials{MissingCertificate: 1}},
+		{"untrusted certificate", []tls.Certificate{{Certificate: [][]byte{rogue.Raw}, PrivateKey: rogueCertKey}}, "fw-1", ClientCertDenials{UntrustedCertificate: 1}},
+		{"serial mismatch", []tls.Certificate{{Certificate: [][]byte{known.Raw}, PrivateKey: knownKey}}, "012345678901", ClientCertDenials{SerialMismatch: 1}},
+	} {
+		api, l, sink := newTestSyslog(t, "tls", config, func(api *API) { api.SetClientCertAuth(auth) })
+		conn, err := tls.Dial("tcp", syslogAddr(l), &tls.Config{Certificates: test.client, InsecureSkipVerify: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		record := testThreatLog(panosThreatType, panosThreatLayout80.severity+1)
+		record = strings.Replace(record, "012345678901", test.serial, 1)
+		conn.Write([]byte(strconv.Itoa(len(record)) + " " + record))
+		conn.Close()
+		want := test.denials != ClientCertDenials{}
+		if !waitSyslog(api, func(stats *AppStats) bool {
+			return stats.ClientCertDenials != ClientCertDenials{} || stats.EventsReceived > 0
+		}) {
+			t.Errorf("%v: connection not processed", test.name)
+		}
+		api.route.pipe.drain()
+		if stats := api.Stats(); stats.ClientCertDenials != test.denials || (len(sink.alerts()) == 1) == want {
+			t.Errorf("%v: %v alerts delivered (%+v)", test.name, len(sink.alerts()), stats.ClientCertDenials)
+		}
+		l.Close()
+		api.Close()
+	}
+}
+
+func TestSyslogSplit(t *testing.T) {
+	for _, test := range []struct {
+		name, data string
+		atEOF      bool
+		advance    int
+		token      string
+		fails      bool
+	}{
+		{"octet counting", "5 hello7 world!!", false, 7, "hello", false},
+		{"octet counting with LF", "6 hello\n", false, 8, "hello\n", false},
+		{"partial frame", "11 hello", false, 0, "", false},
+		{"partial frame at EOF", "11 hello", true, 0, "", true},
+		{"partial length", "11", false, 0, "", false},
+		{"oversized frame", "99999999 hello", false, 0, "", true},
+		{"LF delimited", "<14>hello\n<14>world", false, 10, "<14>hello", false},
+		{"CRLF delimited", "<14>hello\r\n", false, 11, "<14>hello", false},
+		{"partial line", "<14>hello", false, 0, "", false},
+		{"last line at EOF", "<14>hello", true, 9, "<14>hello", false},
+		{"empty", "", true, 0, "", false},
+	} {
+		advance, token, err := syslogSplit([]byte(test.data), test.atEOF)
+		if test.fails != (err != nil) || advance != test.advance || string(token) != test.token {
+			t.Errorf("%v: unexpected split %v %q (%v)", test.name, advance, token, err)
+		}
+	}
+}
+
+func TestSyslogMessage(t *testing.T) {
+	for _, test := range []struct {
+		name, data, expected string
+	}{
+		{"no header", "1,2021/07/01,012345678901", "1,2021/07/01,012345678901"},
+		{"bsd", "<14>Jul  1 12:00:00 fw01 1,2,3", "1,2,3"},
+		{"bsd iso timestamp", "<14>2021-07-01T12:00:00+02:00 fw01 1,2,3", "1,2,3"},
+		{"ietf", "<14>1 2021-07-01T12:00:00Z fw01 - - - - 1,2,3", "1,2,3"},
+		{"ietf nil structured data", "<14>1 2021-07-01T12:00:00Z fw01 app 42 id - 1,2,3", "1,2,3"},
+		{"ietf structured data", `<14>1 2021-07-01T12:00:00Z fw01 - - - [meta a="1"][origin ip="10.0.0.1"] 1,2,3`, "1,2,3"},
+		{"ietf escaped bracket", `<14>1 2021-07-01T12:00:00Z fw01 - - - [meta a="x\]y" b="\"z\""] 1,2,3`, "1,2,3"},
+		{"ietf unterminated structured data", `<14>1 2021-07-01T12:00:00Z fw01 - - - [meta a="1" 1,2,3`, ""},
+		{"ietf bom", "<14>1 2021-07-01T12:00:00Z fw01 - - - - \xef\xbb\xbf1,2,3", "1,2,3"},
+		{"ietf no message", "<14>1 2021-07-01T12:00:00Z fw01 - - -", ""},
+		{"invalid priority", "<14 1,2,3", "<14 1,2,3"},
+	} {
+		if msg := string(syslogMessage([]byte(test.data))); msg != test.expected {
+			t.Errorf("%v: unexpected message %q", test.name, msg)
+		}
+	}
+}
+
+func TestSyslogSkip(t *testing.T) {
+	for _, test := range []struct {
+		data     string
+		count    int
+		expected string
+	}{
+		{"a b c", 0, "a b c"},
+		{"a b c", 1, "b c"},
+		{"  a   b c", 2, "c"},
+		{"a b", 2, ""},
+		{"a b", 3, ""},
+		{"", 1, ""},
+	} {
+		if msg := string(syslogSkip([]byte(test.data), test.count)); msg != test.expected {
+			t.Errorf("%q (%v): unexpected result %q", test.data, test.count, msg)
+		}
+	}
+}
+
+func TestSyslogListener(t *testing.T) {
+	record := testThreatLog(panosThreatType, panosThreatLayout80.severity+1)
+	for _, test := range []struct {
+		network          string
+		data             string
+		messages, alerts int
+	}{
+		{"udp", "<14>Jul  1 12:00:00 fw01 " + record, 1, 1},
+		{"tcp", "<14>Jul  1 12:00:00 fw01 " + record + "\n<14>1 2021-07-01T12:00:00Z fw01 - - - - " + record + "\n", 2, 2},
+		{"tcp", strconv.Itoa(len(record)) + " " + record + "\n\nnot a threat log\n", 2, 1},
+	} {
+		api, l, sink := newTestSyslog(t, test.network, nil, nil)
+		conn, err := net.Dial(test.network, syslogAddr(l))
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.Write([]byte(test.data))
+		conn.Close()
+		if !waitSyslog(api, func(stats *AppStats) bool {
+			return stats.SyslogMessages == uint64(test.messages) && stats.EventsReceived+stats.ParseErrors == int64(test.messages)
+		}) {
+			t.Errorf("%v: messages not processed", test.network)
+		}
+		api.route.pipe.drain()
+		if alerts := sink.alerts(); len(alerts) != test.alerts || alerts[0].AlertName != "Test Threat(12345)" {
+			t.Errorf("%v: unexpected alerts %+v", test.network, alerts)
+		}
+		l.Close()
+		api.Close()
+	}
+}
@@ -0,0 +1,246 @@
+package xdrgateway
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+
+	"github.com/xhoms/xdrgateway/xdrclient"
+)
+
+const (
+	defaultRouteName = "default"
+)
+
+// Tenant is a XDR instance alerts can be routed to. Each tenant gets its own quota-enforcing pipe so a noisy
+// tenant can't use up the quota of another one.
+//
+// Alerts are routed to the first tenant whose Tokens contains the Authorization header used to push them. If none
+// matches, the first tenant whose Serials contains the serial number of the firewall (description `serial=` part)
+// and, finally, the first tenant whose CIDRs contains the address of the firewall pushing them. Alerts not matching
+// any tenant are delivered to the default sink provided to NewAPI
+type Tenant struct {
+	// Name identifies the tenant in statistics and logs
+	Name string `json:"name"`
+	// APIKey XDR API Key (only Advanced supported)
+	APIKey string `json:"api_key"`
+	// APIKeyID XDR API Key ID
+	APIKeyID string `json:"api_key_id"`
+	// FQDN XDR instance to target
+	FQDN string `json:"fqdn"`
+	// Tokens Authorization header values that route alerts to this tenant (they are accepted as valid credentials too)
+	Tokens []string `json:"tokens,omitempty"`
+	// Serials firewall serial numbers that route alerts to this tenant
+	Serials []string `json:"serials,omitempty"`
+	// CIDRs firewall address ranges that route alerts to this tenant
+	CIDRs []string `json:"cidrs,omitempty"`
+	// Sink overrides the XDR client created from APIKey, APIKeyID and FQDN
+	Sink Sink `json:"-"`
+}
+
+// TenantStats provides the statistics of a tenant
+type TenantStats struct {
+	// EventsRouted is the number of alerts routed to the tenant
+	EventsRouted uint64
+	xdrclient.Stats
+	PipeStats
+}
+
+// NewTenantsFromFile loads the tenant routing table from a JSON file. Example:
+//
+//	[
+//		{
+//			"name": "acme",
+//			"api_key": "O4Bw...wEX",
+//			"api_key_id": "36",
+//			"fqdn": "acme.xdr.us.paloaltonetworks.com",
+//			"serials": ["012345678901", "012345678902"],
+//			"cidrs": ["198.51.100.0/24"],
+//			"tokens": ["acme-secret"]
+//		}
+//	]
+func NewTenantsFromFile(path string) (tenants []*Tenant, err error) {
+	var data []byte
+	if data, err = ioutil.ReadFile(path); err == nil {
+		err = json.Unmarshal(data, &tenants)
+	}
+	return
+}
+
+// route is a delivery path: an optional aggregation stage in front of a quota-enforcing pipe
+type route struct {
+	name       string
+	pipe       *alertPipe
+	aggregator *aggregator
+	sink       Sink
+	tokens     map[string]bool
+	serials    map[string]bool
+	nets       []*net.IPNet
+	routed     uint64
+}
+
+func newRoute(name string, sinks []Sink, ops *AlertPipeOps, stats *APIStats) (r *route) {
+	r = &route{
+		name: name,
+		pipe: newAlertPipe(sinks, ops),
+		sink: sinks[0],
+	}
+	if ops != nil && ops.AggregationWindow > 0 {
+		r.aggregator = newAggregator(time.Duration(ops.AggregationWindow)*time.Second, ops.AggregationKeys, r.pipe.ingest, stats)
+	}
+	return
+}
+
+func (r *route) ingest(alert *xdrclient.Alert) (err error) {
+	atomic.AddUint64(&r.routed, 1)
+	if r.aggregator != nil {
+		err = r.aggregator.add(alert)
+	} else {
+		err = r.pipe.ingest(alert)
+	}
+	return
+}
+
+func (r *route) close() {
+	if r.aggregator != nil {
+		r.aggregator.close()
+	}
+	r.pipe.close()
+}
+
+func (r *route) tenantStats() (stats *TenantStats) {
+	stats = &TenantStats{
+		EventsRouted: atomic.LoadUint64(&r.routed),
+		PipeStats:    r.pipe.stats.Snapshot(),
+	}
+	if client, ok := r.sink.(*xdrclient.Client); ok && client.Stats != nil {
+		stats.Stats = client.Stats.Snapshot()
+	}
+	return
+}
+
+// AddTenant creates a dedicated pipe (using a copy of ops) for the tenant and adds it to the routing table.
+// The persistent queue and dead-letter directories (if any) get a per-tenant sub-directory
+func (a *API) AddTenant(tenant *Tenant, ops *AlertPipeOps) (err error) {
+	if tenant.Name == "" || tenant.Name == defaultRouteName || a.routeByName(tenant.Name) != nil {
+		err = fmt.Errorf("invalid or duplicated tenant name %q", tenant.Name)
+		return
+	}
+	var nets []*net.IPNet
+	for _, cidr := range tenant.CIDRs {
+		var ipnet *net.IPNet
+		if _, ipnet, err = net.ParseCIDR(cidr); err != nil {
+			return
+		}
+		nets = append(nets, ipnet)
+	}
+	tokens := make(map[string]bool, len(tenant.Tokens))
+	for _, token := range tenant.Tokens {
+		if token == "" {
+			err = errors.New("empty tenant token")
+			return
+		}
+		tokens[token] = true
+	}
+	serials := make(map[string]bool, len(tenant.Serials))
+	for _, serial := range tenant.Serials {
+		serials[serial] = true
+	}
+	sink := tenant.Sink
+	if sink == nil {
+		client := &xdrclient.Client{
+			APIKey:   tenant.APIKey,
+			APIKeyID: tenant.APIKeyID,
+			FQDN:     tenant.FQDN,
+			Debug:    a.debug,
+		}
+		if err = client.Init(); err != nil {
+			return
+		}
+		sink = client
+	}
+	var tenantOps *AlertPipeOps
+	if ops != nil {
+		opsCopy := *ops
+		if opsCopy.QueueDir != "" {
+			opsCopy.QueueDir = filepath.Join(opsCopy.QueueDir, tenant.Name)
+		}
+		if opsCopy.DeadLetterDir != "" {
+			opsCopy.DeadLetterDir = filepath.Join(opsCopy.DeadLetterDir, tenant.Name)
+		}
+		tenantOps = &opsCopy
+	}
+	r := newRoute(tenant.Name, []Sink{sink}, tenantOps, a.stats)
+	r.tokens, r.serials, r.nets = tokens, serials, nets
+	a.tenants = append(a.tenants, r)
+	log.Printf("api - tenant %v added to the routing table", tenant.Name)
+	return
+}
+
+// routeByName returns the route with the provided name (the default one if name is empty)
+func (a *API) routeByName(name string) *route {
+	if name == "" || name == defaultRouteName {
+		return a.route
+	}
+	for _, r := range a.tenants {
+		if r.name == name {
+			return r
+		}
+	}
+	return nil
+}
+
+// tenantToken returns true if the token routes alerts to a tenant. All tokens are compared in constant time
+func (a *API) tenantToken(token string) (found bool) {
+	for _, r := range a.tenants {
+		for tenantToken := range r.tokens {
+			if tokenEqual(token, tenantToken) {
+				found = true
+			}
+		}
+	}
+	return
+}
+
+// selectRoute picks the route for the alert based on the credential tenant, auth token, firewall serial and firewall
+// address
+func (a *API) selectRoute(alert *xdrclient.Alert, src *origin) *route {
+	if len(a.tenants) == 0 {
+		return a.route
+	}
+	if src.credential != nil && src.credential.tenant != "" {
+		if r := a.routeByName(src.credential.tenant); r != nil {
+			return r
+		}
+	}
+	if src.token != "" {
+		for _, r := range a.tenants {
+			if r.tokens[src.token] {
+				return r
+			}
+		}
+	}
+	if serial := alertField(alert, "serial"); serial != "" {
+		for _, r := range a.tenants {
+			if r.serials[serial] {
+				return r
+			}
+		}
+	}
+	if src.remote != nil {
+		for _, r := range a.tenants {
+			for _, ipnet := range r.nets {
+				if ipnet.Contains(src.remote) {
+					return r
+				}
+			}
+		}
+	}
+	return a.route
+}
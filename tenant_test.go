@@ -0,0 +1,155 @@
+package xdrgateway
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/xhoms/xdrgateway/xdrclient"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestSelectRoute(t *testing.T) {
+	api := newTestAPI()
+	defer api.Close()
+	for _, tenant := range []*Tenant{
+		{Name: "acme", Tokens: []string{"acme-secret"}, Serials: []string{"012345678901"}, CIDRs: []string{"198.51.100.0/24"}, Sink: discardSink{}},
+		{Name: "globex", Tokens: []string{"globex-secret"}, Serials: []string{"012345678902"}, CIDRs: []string{"203.0.113.0/24", "198.51.100.128/25"}, Sink: discardSink{}},
+	} {
+		if err := api.AddTenant(tenant, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	alert := func(serial string) *xdrclient.Alert {
+		return &xdrclient.Alert{AlertDescription: "misc;serial=" + serial}
+	}
+	for _, test := range []struct {
+		name  string
+		alert *xdrclient.Alert
+		src   *origin
+		route string
+	}{
+		{"token", alert("012345678901"), &origin{token: "globex-secret"}, "globex"},
+		{"credential tenant", alert("012345678901"), &origin{token: "globex-secret", credential: &credential{tenant: "acme"}}, "acme"},
+		{"unknown credential tenant", alert(""), &origin{credential: &credential{tenant: "initech"}}, defaultRouteName},
+		{"serial", alert("012345678902"), &origin{token: "psk", remote: net.ParseIP("198.51.100.1")}, "globex"},
+		{"first matching cidr", alert("012345678903"), &origin{remote: net.ParseIP("198.51.100.200")}, "acme"},
+		{"cidr", alert(""), &origin{remote: net.ParseIP("203.0.113.5")}, "globex"},
+		{"default", alert("012345678903"), &origin{token: "psk", remote: net.ParseIP("192.0.2.1")}, defaultRouteName},
+	} {
+		if r := api.selectRoute(test.alert, test.src); r.name != test.route {
+			t.Errorf("%v: routed to %v", test.name, r.name)
+		}
+	}
+	for token, found := range map[string]bool{"acme-secret": true, "globex-secret": true, "psk": false, "": false} {
+		if api.tenantToken(token) != found {
+			t.Errorf("token %q: found %v", token, !found)
+		}
+	}
+}
+
+func TestAddTenant(t *testing.T) {
+	api := newTestAPI()
+	defer api.Close()
+	for _, test := range []struct {
+		name   string
+		tenant *Tenant
+		fails  bool
+	}{
+		{"valid", &Tenant{Name: "acme", CIDRs: []string{"198.51.100.0/24"}, Sink: discardSink{}}, false},
+		{"duplicated", &Tenant{Name: "acme", Sink: discardSink{}}, true},
+		{"default name", &Tenant{Name: defaultRouteName, Sink: discardSink{}}, true},
+		{"no name", &Tenant{Sink: discardSink{}}, true},
+		{"invalid cidr", &Tenant{Name: "globex", CIDRs: []string{"198.51.100.1"}, Sink: discardSink{}}, true},
+		{"empty token", &Tenant{Name: "globex", Tokens: []string{""}, Sink: discardSink{}}, true},
+		{"no xdr client", &Tenant{Name: "globex"}, true},
+	} {
+		if err := api.AddTenant(test.tenant, nil); (err != nil) != test.fails {
+			t.Errorf("%v: unexpected result %v", test.name, err)
+		}
+	}
+	if r := api.routeByName("acme"); r == nil || api.routeByName("") != api.route || api.routeByName("globex") != nil {
+		t.Error("unexpected routing table")
+	}
+}
+
+// TestManagementAuth checks that only the PSK gives access to the statistics and dead letters of all tenants
+func TestManagementAuth(t *testing.T) {
+	dir, err := ioutil.TempDir("", "xdrgw-tenant")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	api := newTestAPI()
+	defer api.Close()
+	ops := testPipeOps(10, 0)
+	ops.DeadLetterDir = dir
+	for _, tenant := range []*Tenant{
+		{Name: "acme", Tokens: []string{"acme-secret"}, Sink: discardSink{}},
+		{Name: "globex", Tokens: []string{"globex-secret"}, Sink: discardSink{}},
+	} {
+		if err = api.AddTenant(tenant, ops); err != nil {
+			t.Fatal(err)
+		}
+	}
+	path := filepath.Join(dir, "credentials.json")
+	ioutil.WriteFile(path, []byte(`[{"name": "madrid", "token": "madrid-token", "tenant": "acme"}]`), 0600)
+	credentials, err := NewCredentialsFromFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = api.SetCredentials(credentials); err != nil {
+		t.Fatal(err)
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte("acme-pass"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	basicAuth, err := NewBasicAuth(map[string]string{"acme": string(hash)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	api.SetBasicAuth(basicAuth)
+	for _, test := range []struct {
+		name, token, user string
+		status            int
+	}{
+		{"psk", "psk", "", http.StatusOK},
+		{"own tenant token", "acme-secret", "", http.StatusForbidden},
+		{"other tenant token", "globex-secret", "", http.StatusForbidden},
+		{"device credential", "madrid-token", "", http.StatusForbidden},
+		{"basic user", "", "acme", http.StatusForbidden},
+		{"unknown token", "nope", "", http.StatusUnauthorized},
+	} {
+		for _, tenant := range []string{"acme", "globex"} {
+			for _, method := range []string{http.MethodGet, http.MethodDelete, http.MethodPost} {
+				request := httptest.NewRequest(method, "/deadletter?tenant="+tenant, nil)
+				if test.user != "" {
+					request.SetBasicAuth(test.user, "acme-pass")
+				} else {
+					request.Header.Set("Authorization", test.token)
+				}
+				recorder := httptest.NewRecorder()
+				api.HandlerDeadLetter(recorder, request)
+				if recorder.Code != test.status {
+					t.Errorf("%v: %v dead letters of %q replied %v", test.name, method, tenant, recorder.Code)
+				}
+			}
+		}
+		request := httptest.NewRequest(http.MethodGet, "/stats", nil)
+		if test.user != "" {
+			request.SetBasicAuth(test.user, "acme-pass")
+		} else {
+			request.Header.Set("Authorization", test.token)
+		}
+		recorder := httptest.NewRecorder()
+		api.HandlerStats(recorder, request)
+		if granted := recorder.Body.Len() > 0; granted != (test.status == http.StatusOK) {
+			t.Errorf("%v: statistics returned %v", test.name, granted)
+		}
+	}
+}
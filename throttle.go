@@ -0,0 +1,59 @@
+package xdrgateway
+
+import (
+	"errors"
+	"log"
+	"sync/atomic"
+	"time"
+
+	"github.com/xhoms/xdrgateway/xdrclient"
+)
+
+const (
+	throttlePause  = 30 * time.Second
+	throttleGrowth = 20
+)
+
+// throttle reacts to XDR rate limiting (429) by pausing the pipe for the time requested by the XDR API and
+// halving the effective quota bucket. Returns true if the error was a rate limiting one
+func (a *alertPipe) throttle(err error) bool {
+	var httpErr *xdrclient.HTTPError
+	if !errors.As(err, &httpErr) || !httpErr.Throttled() {
+		return false
+	}
+	pause := httpErr.RetryAfter
+	if pause <= 0 {
+		pause = throttlePause
+	}
+	a.pausedUntil = time.Now().Add(pause)
+	if a.effectiveBucket = a.effectiveBucket / 2; a.effectiveBucket < len(a.buffer) {
+		a.effectiveBucket = len(a.buffer)
+	}
+	if a.t1Bucket > a.effectiveBucket {
+		a.t1Bucket = a.effectiveBucket
+	}
+	atomic.AddUint64(&a.stats.ThrottleEvents, 1)
+	atomic.StoreInt64(&a.stats.EffectiveQuota, int64(a.effectiveBucket))
+	log.Printf("pipe - throttled by XDR, pausing for %v with effective quota %v", pause, a.effectiveBucket)
+	return true
+}
+
+// unthrottle slowly grows the effective quota bucket back to its configured size after a successful update
+func (a *alertPipe) unthrottle() {
+	if a.effectiveBucket >= a.bucketSize {
+		return
+	}
+	growth := a.bucketSize / throttleGrowth
+	if growth < 1 {
+		growth = 1
+	}
+	if a.effectiveBucket += growth; a.effectiveBucket > a.bucketSize {
+		a.effectiveBucket = a.bucketSize
+	}
+	atomic.StoreInt64(&a.stats.EffectiveQuota, int64(a.effectiveBucket))
+}
+
+// paused returns true while the pipe honours a XDR Retry-After request
+func (a *alertPipe) paused() bool {
+	return time.Now().Before(a.pausedUntil)
+}
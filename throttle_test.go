@@ -0,0 +1,84 @@
+package xdrgateway
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/xhoms/xdrgateway/xdrclient"
+)
+
+func TestThrottle(t *testing.T) {
+	for _, test := range []struct {
+		name      string
+		err       error
+		effective int
+		throttled bool
+		shrunk    int
+		pause     time.Duration
+	}{
+		{"network error", errors.New("connection reset"), 100, false, 100, 0},
+		{"server error", &xdrclient.HTTPError{StatusCode: http.StatusBadGateway}, 100, false, 100, 0},
+		{"retry after", &xdrclient.HTTPError{StatusCode: http.StatusTooManyRequests, RetryAfter: 5 * time.Second}, 100, true, 50, 5 * time.Second},
+		{"default pause", &xdrclient.HTTPError{StatusCode: http.StatusTooManyRequests}, 100, true, 50, throttlePause},
+		{"update size floor", &xdrclient.HTTPError{StatusCode: http.StatusTooManyRequests}, 15, true, 10, throttlePause},
+	} {
+		pipe := newAlertPipe([]Sink{&recordingSink{}}, testPipeOps(100, 0))
+		pipe.effectiveBucket = test.effective
+		start := time.Now()
+		if throttled := pipe.throttle(test.err); throttled != test.throttled {
+			t.Errorf("%v: throttled %v", test.name, throttled)
+		}
+		if pipe.effectiveBucket != test.shrunk || pipe.t1Bucket > test.shrunk || pipe.stats.Snapshot().EffectiveQuota != int64(test.shrunk) {
+			t.Errorf("%v: effective quota %v (bucket %v)", test.name, pipe.effectiveBucket, pipe.t1Bucket)
+		}
+		if pipe.paused() != test.throttled {
+			t.Errorf("%v: paused %v", test.name, pipe.paused())
+		} else if pause := pipe.pausedUntil.Sub(start); test.throttled && (pause < test.pause || pause > test.pause+time.Second) {
+			t.Errorf("%v: paused for %v", test.name, pause)
+		}
+		pipe.close()
+	}
+}
+
+func TestUnthrottle(t *testing.T) {
+	for _, test := range []struct {
+		bucket, effective, grown int
+	}{
+		{100, 100, 100},
+		{100, 50, 55},
+		{100, 98, 100},
+		{10, 5, 6},
+	} {
+		pipe := newAlertPipe([]Sink{&recordingSink{}}, testPipeOps(test.bucket, 0))
+		pipe.effectiveBucket = test.effective
+		if pipe.unthrottle(); pipe.effectiveBucket != test.grown {
+			t.Errorf("%v/%v: grown to %v", test.effective, test.bucket, pipe.effectiveBucket)
+		}
+		pipe.close()
+	}
+}
+
+// TestPipeThrottled checks that nothing is sent while the pipe honours the XDR Retry-After request
+func TestPipeThrottled(t *testing.T) {
+	sink := &recordingSink{errors: []error{&xdrclient.HTTPError{StatusCode: http.StatusTooManyRequests, RetryAfter: time.Hour}}}
+	ops := testPipeOps(100, 0)
+	ops.RetryMaxAttempts, ops.RetryMaxAge, ops.RetryMaxDelay = 3, 60, 10
+	pipe := newAlertPipe([]Sink{sink}, ops)
+	defer pipe.close()
+	for i := 0; i < 25; i++ {
+		pipe.ingest(testAlert("throttled", xdrclient.SeverityHigh))
+	}
+	pipe.drain()
+	pipe.drain()
+	if sink.calls != 1 || pipe.queue.len() != 15 || len(pipe.retries.batches) != 1 {
+		t.Errorf("unexpected deliveries while throttled: %v calls, %v buffered", sink.calls, pipe.queue.len())
+	}
+	// the retry and the two buffered batches grow the effective quota back
+	pipe.pausedUntil = time.Time{}
+	pipe.drain()
+	if stats := pipe.stats.Snapshot(); stats.ThrottleEvents != 1 || stats.PipeOut != 25 || stats.EffectiveQuota != 65 {
+		t.Errorf("unexpected stats after the pause %+v", stats)
+	}
+}
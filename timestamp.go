@@ -0,0 +1,40 @@
+package xdrgateway
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// TimestampAuto picks the first timestamp field available (high_res_timestamp, time_generated, receive_time)
+	TimestampAuto = "auto"
+	// TimestampHighRes uses the PAN-OS $high_res_timestamp field (RFC 3339 with milliseconds and time zone)
+	TimestampHighRes = "high_res_timestamp"
+	// TimestampGenerated uses the PAN-OS $time_generated field
+	TimestampGenerated = "time_generated"
+	// TimestampReceived uses the PAN-OS $receive_time field
+	TimestampReceived = "receive_time"
+	// epochMillisecondsDigits is the minimum length of an epoch value to be considered milliseconds
+	epochMillisecondsDigits = 12
+)
+
+// parseTimestamp converts a PAN-OS timestamp into time. Supported formats are epoch seconds or milliseconds (based
+// on the number of digits), RFC 3339 (with optional fractional seconds and time zone) or layout in location
+func parseTimestamp(value, layout string, location *time.Location) (t time.Time, err error) {
+	if value == "" {
+		err = fmt.Errorf("empty timestamp")
+		return
+	}
+	if epoch, perr := strconv.ParseInt(value, 10, 64); perr == nil {
+		if len(strings.TrimPrefix(value, "-")) >= epochMillisecondsDigits {
+			return time.Unix(0, epoch*int64(time.Millisecond)), nil
+		}
+		return time.Unix(epoch, 0), nil
+	}
+	if strings.Contains(value, "T") {
+		return time.Parse(time.RFC3339Nano, value)
+	}
+	return time.ParseInLocation(layout, value, location)
+}
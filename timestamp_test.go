@@ -0,0 +1,75 @@
+package xdrgateway
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestParseTimestamp(t *testing.T) {
+	location := time.FixedZone("XGW", 2*3600)
+	for _, test := range []struct {
+		value string
+		ms    int64
+		fails bool
+	}{
+		{"1625140800", 1625140800000, false},
+		{"1625140800123", 1625140800123, false},
+		{"2021-07-01T12:00:00.123Z", 1625140800123, false},
+		{"2021-07-01T14:00:00+02:00", 1625140800000, false},
+		{"2021-07-01T12:00:00.123456789Z", 1625140800123, false},
+		{"2021/07/01 14:00:00", 1625140800000, false},
+		{"", 0, true},
+		{"2021-07-01T12:00:00", 0, true},
+		{"01/07/2021 14:00:00", 0, true},
+	} {
+		ts, err := parseTimestamp(test.value, panosTSLayout, location)
+		if test.fails {
+			if err == nil {
+				t.Errorf("%q: expected error, got %v", test.value, ts)
+			}
+			continue
+		}
+		if err != nil || ts.UnixNano()/int64(time.Millisecond) != test.ms {
+			t.Errorf("%q: unexpected time %v (%v)", test.value, ts, err)
+		}
+	}
+}
+
+func TestBasicParserTimestampField(t *testing.T) {
+	const payload = `{"src": "10.0.0.1", "dst": "10.0.0.2", "high_res_timestamp": "%v", "time_generated": "%v", "receive_time": "%v"}`
+	highRes, generated, received := "2021-07-01T12:00:00.123Z", "2021/07/01 12:00:01", "1625140802"
+	for _, test := range []struct {
+		name, field                  string
+		highRes, generated, received string
+		ms                           int64
+		fails                        bool
+	}{
+		{"auto high resolution", TimestampAuto, highRes, generated, received, 1625140800123, false},
+		{"auto unsupported variable", TimestampAuto, "$high_res_timestamp", generated, received, 1625140801000, false},
+		{"auto unparseable", TimestampAuto, "bogus", "", received, 1625140802000, false},
+		{"auto missing", TimestampAuto, "", "", "", 0, true},
+		{"high resolution", TimestampHighRes, highRes, generated, received, 1625140800123, false},
+		{"generated", TimestampGenerated, highRes, generated, received, 1625140801000, false},
+		{"received", TimestampReceived, highRes, generated, received, 1625140802000, false},
+		{"received missing", TimestampReceived, highRes, generated, "", 0, true},
+	} {
+		parser := NewBasicParser(0, false)
+		if err := parser.SetTimestampField(test.field); err != nil {
+			t.Fatal(err)
+		}
+		alert, err := parser.Parse([]byte(fmt.Sprintf(payload, test.highRes, test.generated, test.received)))
+		if test.fails {
+			if err == nil {
+				t.Errorf("%v: expected error, got %+v", test.name, alert)
+			}
+			continue
+		}
+		if err != nil || alert.Timestamp != test.ms {
+			t.Errorf("%v: unexpected alert %+v (%v)", test.name, alert, err)
+		}
+	}
+	if err := NewBasicParser(0, false).SetTimestampField("start_time"); err == nil {
+		t.Error("expected error for an unknown timestamp field")
+	}
+}
@@ -0,0 +1,105 @@
+package xdrgateway
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"regexp"
+	"strconv"
+	"time"
+
+	// the container image is distroless (no zoneinfo database)
+	_ "time/tzdata"
+)
+
+var (
+	hoursOffset        = regexp.MustCompile(`^[+-]?\d{1,2}(\.\d+)?$`)
+	hoursMinutesOffset = regexp.MustCompile(`^([+-]?)(\d{1,2}):(\d{2})$`)
+)
+
+// TimeZones resolves the location of PAN-OS timestamps (they do not include a time zone) by device serial number
+type TimeZones struct {
+	// Default location of devices not found in Serials
+	Default *time.Location
+	// Serials holds per device location overrides
+	Serials map[string]*time.Location
+}
+
+// ParseLocation parses a time zone provided as an IANA name (i.e. `Europe/Madrid`), an offset in hours (i.e. `-3`
+// or `+5.5`) or an offset in hours and minutes (i.e. `+05:30`). An empty value is UTC
+func ParseLocation(value string) (location *time.Location, err error) {
+	if value == "" {
+		return defaultLocation, nil
+	}
+	if hoursOffset.MatchString(value) {
+		hours, _ := strconv.ParseFloat(value, 64)
+		if math.Abs(hours) > 14 {
+			err = fmt.Errorf("time zone offset out of range %v", value)
+			return
+		}
+		return time.FixedZone("XGW", int(math.Round(hours*3600))), nil
+	}
+	if parts := hoursMinutesOffset.FindStringSubmatch(value); parts != nil {
+		hours, _ := strconv.Atoi(parts[2])
+		minutes, _ := strconv.Atoi(parts[3])
+		seconds := hours*3600 + minutes*60
+		if seconds > 14*3600 || minutes > 59 {
+			err = fmt.Errorf("time zone offset out of range %v", value)
+			return
+		}
+		if parts[1] == "-" {
+			seconds = -seconds
+		}
+		return time.FixedZone("XGW", seconds), nil
+	}
+	return time.LoadLocation(value)
+}
+
+// NewTimeZones returns the time zone table for the default zone and the per serial number overrides (see ParseLocation
+// for the supported formats)
+func NewTimeZones(defaultZone string, serials map[string]string) (z *TimeZones, err error) {
+	z = &TimeZones{Serials: make(map[string]*time.Location, len(serials))}
+	if z.Default, err = ParseLocation(defaultZone); err != nil {
+		return nil, err
+	}
+	for serial, zone := range serials {
+		if z.Serials[serial], err = ParseLocation(zone); err != nil {
+			return nil, fmt.Errorf("serial %v: %v", serial, err)
+		}
+	}
+	return
+}
+
+// NewTimeZonesFromFile returns the time zone table for the default zone and the per serial number overrides in the
+// JSON file. Example:
+//
+//	{
+//		"012345678901": "Europe/Madrid",
+//		"012345678902": "Asia/Kolkata",
+//		"012345678903": "-03:00"
+//	}
+func NewTimeZonesFromFile(defaultZone, path string) (z *TimeZones, err error) {
+	var data []byte
+	if data, err = ioutil.ReadFile(path); err != nil {
+		return
+	}
+	serials := make(map[string]string)
+	if err = json.Unmarshal(data, &serials); err == nil {
+		z, err = NewTimeZones(defaultZone, serials)
+	}
+	return
+}
+
+// fixedTimeZones returns a table without overrides using a whole-hour offset as default
+func fixedTimeZones(offset int) *TimeZones {
+	return &TimeZones{Default: time.FixedZone("XGW", offset*60*60)}
+}
+
+// Location returns the location of the device (the default one if it has no override)
+func (z *TimeZones) Location(serial string) *time.Location {
+	if location, exists := z.Serials[serial]; exists {
+		return location
+	}
+	return z.Default
+}
@@ -0,0 +1,85 @@
+package xdrgateway
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestParseLocation(t *testing.T) {
+	madrid, err := time.LoadLocation("Europe/Madrid")
+	if err != nil {
+		t.Fatal(err)
+	}
+	summer := time.Date(2021, 7, 1, 12, 0, 0, 0, time.UTC)
+	for _, test := range []struct {
+		value  string
+		offset int
+		fails  bool
+	}{
+		{"", 0, false},
+		{"2", 2 * 3600, false},
+		{"-3", -3 * 3600, false},
+		{"+5.5", 5*3600 + 1800, false},
+		{"+05:30", 5*3600 + 1800, false},
+		{"-09:45", -(9*3600 + 45*60), false},
+		{"14", 14 * 3600, false},
+		{"+14:00", 14 * 3600, false},
+		{"Europe/Madrid", 2 * 3600, false},
+		{"15", 0, true},
+		{"-14.5", 0, true},
+		{"+14:30", 0, true},
+		{"+05:60", 0, true},
+		{"NaN", 0, true},
+		{"Inf", 0, true},
+		{"-Infinity", 0, true},
+		{"0x1p3", 0, true},
+		{"1e1", 0, true},
+		{"Mars/Olympus", 0, true},
+	} {
+		location, err := ParseLocation(test.value)
+		if test.fails {
+			if err == nil {
+				t.Errorf("%q: expected error, got %v", test.value, location)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: unexpected error %v", test.value, err)
+			continue
+		}
+		if _, offset := summer.In(location).Zone(); offset != test.offset {
+			t.Errorf("%q: unexpected offset %v", test.value, offset)
+		}
+	}
+	// DST is applied by IANA locations
+	if _, offset := time.Date(2021, 1, 1, 12, 0, 0, 0, time.UTC).In(madrid).Zone(); offset != 3600 {
+		t.Errorf("unexpected winter offset %v", offset)
+	}
+}
+
+func TestTimeZonesFromFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "xdrgw-tz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "tz.json")
+	ioutil.WriteFile(path, []byte(`{"012345678901": "Asia/Kolkata", "012345678903": "-03:00"}`), 0600)
+	zones, err := NewTimeZonesFromFile("+1", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	for serial, offset := range map[string]int{"012345678901": 5*3600 + 1800, "012345678903": -3 * 3600, "unknown": 3600} {
+		if _, got := now.In(zones.Location(serial)).Zone(); got != offset {
+			t.Errorf("%v: unexpected offset %v", serial, got)
+		}
+	}
+	ioutil.WriteFile(path, []byte(`{"012345678901": "NaN"}`), 0600)
+	if _, err = NewTimeZonesFromFile("", path); err == nil {
+		t.Error("expected error for an invalid serial time zone")
+	}
+}
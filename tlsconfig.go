@@ -0,0 +1,139 @@
+package xdrgateway
+
+import (
+	"crypto/tls"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultTLSMinVersion is the minimum TLS version enforced by NewTLSConfig when none is provided
+	DefaultTLSMinVersion = "1.2"
+	// DefaultCertificateReloadInterval is how often CertificateReloader checks the files for changes
+	DefaultCertificateReloadInterval = 10 * time.Second
+)
+
+var (
+	tlsVersions = map[string]uint16{
+		"1.0": tls.VersionTLS10,
+		"1.1": tls.VersionTLS11,
+		"1.2": tls.VersionTLS12,
+		"1.3": tls.VersionTLS13,
+	}
+)
+
+// NewTLSConfig returns a server TLS configuration enforcing the minimum version (1.0, 1.1, 1.2 or 1.3, defaults to
+// DefaultTLSMinVersion) and the comma-separated list of cipher suites (names as in tls.CipherSuites, i.e.
+// TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256). Go's default selection is used if ciphers is empty. TLS 1.3 cipher suites
+// are not configurable
+func NewTLSConfig(minVersion, ciphers string) (config *tls.Config, err error) {
+	if minVersion == "" {
+		minVersion = DefaultTLSMinVersion
+	}
+	version, exists := tlsVersions[strings.TrimPrefix(minVersion, "TLS")]
+	if !exists {
+		err = fmt.Errorf("unsupported TLS version %v", minVersion)
+		return
+	}
+	config = &tls.Config{MinVersion: version}
+	if ciphers == "" {
+		return
+	}
+	suites := make(map[string]uint16)
+	for _, suite := range tls.CipherSuites() {
+		suites[suite.Name] = suite.ID
+	}
+	for _, name := range strings.Split(ciphers, ",") {
+		id, exists := suites[strings.TrimSpace(name)]
+		if !exists {
+			return nil, fmt.Errorf("unknown or insecure cipher suite %v", name)
+		}
+		config.CipherSuites = append(config.CipherSuites, id)
+	}
+	return
+}
+
+// CertificateReloader serves a certificate and key pair from disk reloading it when any of the files change. Handshakes
+// use the new certificate as soon as it is loaded while established connections are not affected
+type CertificateReloader struct {
+	certFile, keyFile string
+	mu                sync.RWMutex
+	cert              *tls.Certificate
+	modified          time.Time
+	done              chan struct{}
+}
+
+// NewCertificateReloader loads the certificate and key pair and checks the files for changes every interval. A
+// certificate that fails to load is logged and the previous one is kept
+func NewCertificateReloader(certFile, keyFile string, interval time.Duration) (r *CertificateReloader, err error) {
+	r = &CertificateReloader{
+		certFile: certFile,
+		keyFile:  keyFile,
+		done:     make(chan struct{}),
+	}
+	if _, err = r.reload(); err != nil {
+		return nil, err
+	}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-r.done:
+				return
+			case <-ticker.C:
+				if reloaded, err := r.reload(); err != nil {
+					log.Println("tls error - keeping the current certificate:", err)
+				} else if reloaded {
+					log.Println("tls - reloaded certificate", r.certFile)
+				}
+			}
+		}
+	}()
+	return
+}
+
+// reload loads the pair if the files were modified after the last load
+func (r *CertificateReloader) reload() (reloaded bool, err error) {
+	var modified time.Time
+	for _, file := range []string{r.certFile, r.keyFile} {
+		var info os.FileInfo
+		if info, err = os.Stat(file); err != nil {
+			return
+		}
+		if info.ModTime().After(modified) {
+			modified = info.ModTime()
+		}
+	}
+	r.mu.RLock()
+	current := r.modified
+	r.mu.RUnlock()
+	if r.cert != nil && modified.Equal(current) {
+		return
+	}
+	var cert tls.Certificate
+	if cert, err = tls.LoadX509KeyPair(r.certFile, r.keyFile); err != nil {
+		return
+	}
+	r.mu.Lock()
+	r.cert, r.modified = &cert, modified
+	r.mu.Unlock()
+	reloaded = true
+	return
+}
+
+// GetCertificate is a tls.Config GetCertificate compatible callback returning the current certificate
+func (r *CertificateReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.cert, nil
+}
+
+// Close stops watching the files
+func (r *CertificateReloader) Close() {
+	close(r.done)
+}
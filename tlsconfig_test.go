@@ -0,0 +1,105 @@
+package xdrgateway
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeTestCertificate writes a self-signed certificate and key pair for commonName
+func writeTestCertificate(t *testing.T, certFile, keyFile, commonName string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		DNSNames:     []string{commonName},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestNewTLSConfig(t *testing.T) {
+	config, err := NewTLSConfig("", "")
+	if err != nil || config.MinVersion != tls.VersionTLS12 || config.CipherSuites != nil {
+		t.Errorf("unexpected default config %+v (%v)", config, err)
+	}
+	config, err = NewTLSConfig("1.3", "TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256, TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256")
+	if err != nil || config.MinVersion != tls.VersionTLS13 || len(config.CipherSuites) != 2 {
+		t.Errorf("unexpected config %+v (%v)", config, err)
+	}
+	for _, bad := range [][2]string{{"1.4", ""}, {"1.2", "TLS_RSA_WITH_RC4_128_SHA"}, {"1.2", "nope"}} {
+		if _, err = NewTLSConfig(bad[0], bad[1]); err == nil {
+			t.Errorf("expected error for %v", bad)
+		}
+	}
+}
+
+func TestCertificateReloader(t *testing.T) {
+	dir, err := ioutil.TempDir("", "xdrgw-tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	writeTestCertificate(t, certFile, keyFile, "one")
+	reloader, err := NewCertificateReloader(certFile, keyFile, 10*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reloader.Close()
+	commonName := func() string {
+		cert, _ := reloader.GetCertificate(nil)
+		parsed, err := x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		return parsed.Subject.CommonName
+	}
+	if name := commonName(); name != "one" {
+		t.Fatalf("unexpected certificate %v", name)
+	}
+	// a broken pair keeps the current certificate
+	later := time.Now().Add(time.Minute)
+	ioutil.WriteFile(keyFile, []byte("broken"), 0600)
+	os.Chtimes(keyFile, later, later)
+	time.Sleep(50 * time.Millisecond)
+	if name := commonName(); name != "one" {
+		t.Fatalf("unexpected certificate %v after a failed reload", name)
+	}
+	writeTestCertificate(t, certFile, keyFile, "two")
+	later = later.Add(time.Minute)
+	os.Chtimes(certFile, later, later)
+	os.Chtimes(keyFile, later, later)
+	for deadline := time.Now().Add(2 * time.Second); commonName() != "two"; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("certificate not reloaded")
+		}
+	}
+}
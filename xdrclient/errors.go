@@ -0,0 +1,56 @@
+package xdrclient
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// HTTPError is returned by Send and SendMulti when the XDR API replies with a status code other than 200 OK
+type HTTPError struct {
+	// StatusCode is the HTTP status code returned by the XDR API
+	StatusCode int
+	// Status is the HTTP status line returned by the XDR API
+	Status string
+	// RetryAfter is the delay requested by the XDR API in the Retry-After header (zero if not provided)
+	RetryAfter time.Duration
+	// Body is the response payload returned by the XDR API
+	Body string
+}
+
+func (e *HTTPError) Error() string {
+	if e.RetryAfter > 0 {
+		return fmt.Sprintf("xdrclient - unexpected response status %v (retry after %v)", e.Status, e.RetryAfter)
+	}
+	return fmt.Sprintf("xdrclient - unexpected response status %v", e.Status)
+}
+
+// Throttled returns true if the XDR API rejected the request due to rate limiting (429 Too Many Requests)
+func (e *HTTPError) Throttled() bool {
+	return e.StatusCode == http.StatusTooManyRequests
+}
+
+// Temporary returns true if the request might succeed if sent again later (rate limiting or server errors)
+func (e *HTTPError) Temporary() bool {
+	return e.Throttled() || e.StatusCode >= http.StatusInternalServerError
+}
+
+// parseRetryAfter decodes the value of a Retry-After header (either delay-seconds or HTTP-date)
+func parseRetryAfter(value string, now time.Time) (delay time.Duration) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		if seconds > 0 {
+			delay = time.Duration(seconds) * time.Second
+		}
+		return
+	}
+	if t, err := http.ParseTime(value); err == nil && t.After(now) {
+		delay = t.Sub(now)
+	}
+	return
+}
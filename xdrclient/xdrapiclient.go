@@ -12,6 +12,7 @@ import (
 	"math/rand"
 	"net/http"
 	"os"
+	"sync/atomic"
 	"time"
 )
 
@@ -27,12 +28,23 @@ var (
 	headerContentType = http.CanonicalHeaderKey("Content-Type")
 )
 
-// Stats provides counters for the XDR API client
+// Stats provides counters for the XDR API client. They are updated atomically (use Snapshot to read them)
 type Stats struct {
 	// POSTSend amount of successful POST's to the XDR alert ingestion API (status == 200 OK)
 	POSTSend uint64
 	// POSTFailures amount of unsuccessful POST's to the XDR alert ingestion API (status ""= 200 OK)
 	POSTFailures uint64
+	// POSTThrottled amount of POST's rejected by the XDR alert ingestion API due to rate limiting (status = 429)
+	POSTThrottled uint64
+}
+
+// Snapshot returns a copy of the counters that is safe to read while the client is in use
+func (s *Stats) Snapshot() Stats {
+	return Stats{
+		POSTSend:      atomic.LoadUint64(&s.POSTSend),
+		POSTFailures:  atomic.LoadUint64(&s.POSTFailures),
+		POSTThrottled: atomic.LoadUint64(&s.POSTThrottled),
+	}
 }
 
 // Client provides a XDR alert API client implementation for the insert_parsed_alerts endpoint
@@ -124,6 +136,7 @@ func (x *Client) hash(tsmillis string) (apiKeyHash string) {
 	return
 }
 
+// push posts the payload to the XDR API. Non 200 OK responses are returned as *HTTPError
 func (x *Client) push(payload []byte) (err error) {
 	if !x.init {
 		err = errors.New("XDRClient Init() not completed yet")
@@ -147,23 +160,33 @@ func (x *Client) push(payload []byte) (err error) {
 				if x.Debug {
 					log.Println("xdrclient - successful call to insert_parsed_alerts")
 				}
-				x.Stats.POSTSend++
+				atomic.AddUint64(&x.Stats.POSTSend, 1)
 			} else {
 				log.Printf("xdrclient error %v - %v", resp.Status, buff.String())
-				x.Stats.POSTFailures++
+				atomic.AddUint64(&x.Stats.POSTFailures, 1)
+				httpErr := &HTTPError{
+					StatusCode: resp.StatusCode,
+					Status:     resp.Status,
+					RetryAfter: parseRetryAfter(resp.Header.Get("Retry-After"), time.Now()),
+					Body:       buff.String(),
+				}
+				if httpErr.Throttled() {
+					atomic.AddUint64(&x.Stats.POSTThrottled, 1)
+				}
+				err = httpErr
 			}
 		} else {
 			log.Printf("xdrclient error reading response (%v)", resp.Status)
 			err = buferr
 		}
 	} else {
-		x.Stats.POSTFailures++
+		atomic.AddUint64(&x.Stats.POSTFailures, 1)
 		log.Printf("error - %v", err)
 	}
 	return
 }
 
-// Send sends a single alert
+// Send sends a single alert. A *HTTPError is returned if the XDR API rejects the update
 func (x *Client) Send(alert *Alert) (err error) {
 	var payload []byte
 	jalert := jsonalert{}
@@ -174,15 +197,11 @@ func (x *Client) Send(alert *Alert) (err error) {
 	return
 }
 
-// SendMulti sends multiple alerts in a single update
+// SendMulti sends multiple alerts in a single update. A *HTTPError is returned if the XDR API rejects the update
 // (notice that XDR max update of 60 is not enforced here)
 func (x *Client) SendMulti(alert []*Alert) (err error) {
 	var payload []byte
-	jalert := make([]jsonalert, len(alert))
-	for idx := range alert {
-		jalert[idx].copy(alert[idx])
-	}
-	if payload, err = newXDRPayload(jalert); err == nil {
+	if payload, err = EncodePayload(alert); err == nil {
 		err = x.push(payload)
 	}
 	return
@@ -222,6 +241,24 @@ type xdrPayload struct {
 	} `json:"request_data"`
 }
 
+// EncodeAlert renders a single alert using the XDR insert_parsed_alerts JSON representation
+func EncodeAlert(alert *Alert) (data []byte, err error) {
+	jalert := jsonalert{}
+	jalert.copy(alert)
+	data, err = json.Marshal(&jalert)
+	return
+}
+
+// EncodePayload renders the XDR insert_parsed_alerts request payload for the alerts
+func EncodePayload(alert []*Alert) (data []byte, err error) {
+	jalert := make([]jsonalert, len(alert))
+	for idx := range alert {
+		jalert[idx].copy(alert[idx])
+	}
+	data, err = newXDRPayload(jalert)
+	return
+}
+
 func newXDRPayload(alerts []jsonalert) (data []byte, err error) {
 	xp := &xdrPayload{RequestData: struct {
 		Alerts []jsonalert `json:"alerts"`